@@ -3,16 +3,20 @@ module waguri-centralized-control/dns
 go 1.25.0
 
 require (
+	github.com/insomniacslk/dhcp v0.0.0-20260901064844-234b97448fae
+	github.com/miekg/dns v1.1.68
+	golang.org/x/net v0.55.0
 	waguri-centralized-control/packages/go-utils/config v0.0.0
 	waguri-centralized-control/packages/go-utils/telemetry v0.0.0
 )
 
 require (
-	github.com/miekg/dns v1.1.68 // indirect
+	github.com/josharian/native v1.1.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.14 // indirect
+	github.com/u-root/uio v0.0.0-20230220225925-ffce2a382923 // indirect
 	golang.org/x/mod v0.24.0 // indirect
-	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/sync v0.14.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/sys v0.45.0 // indirect
 	golang.org/x/tools v0.33.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
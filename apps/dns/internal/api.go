@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// defaultSearchLimit bounds query log results when no limit is given
+const defaultSearchLimit = 100
+
+// Defaults of the statistics endpoint
+const (
+	defaultStatsWindow = time.Hour
+	defaultStatsTop    = 10
+)
+
+// newAPIServer creates the HTTP listener for the query log, statistics and
+// the DS records of signed zones
+func (s *Server) newAPIServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/querylog", s.serveQueryLog)
+	mux.HandleFunc("/api/stats", s.serveStats)
+	mux.HandleFunc("/api/dnssec/ds", s.serveDS)
+
+	return &http.Server{
+		Addr:              s.cfg.API.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// serveQueryLog searches the query log. Parameters (all optional):
+// client (IP or CIDR), name (glob or substring), source, since and until
+// (RFC 3339 time or a duration ago such as 15m) and limit.
+func (s *Server) serveQueryLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseQueryLogFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.queryLog.search(filter)); err != nil {
+		s.logger.Error("Error encoding query log response:", err)
+	}
+}
+
+// parseQueryLogFilter reads search parameters from the request URL
+func parseQueryLogFilter(r *http.Request) (queryLogFilter, error) {
+	params := r.URL.Query()
+	filter := queryLogFilter{
+		name:   strings.TrimSuffix(strings.ToLower(params.Get("name")), "."),
+		source: params.Get("source"),
+		limit:  defaultSearchLimit,
+	}
+
+	if client := params.Get("client"); client != "" {
+		if !strings.Contains(client, "/") {
+			if ip := net.ParseIP(client); ip != nil && ip.To4() != nil {
+				client += "/32"
+			} else {
+				client += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return filter, fmt.Errorf("invalid client '%s'", params.Get("client"))
+		}
+		filter.client = network
+	}
+
+	var err error
+	if filter.since, err = parseSearchTime(params.Get("since")); err != nil {
+		return filter, err
+	}
+	if filter.until, err = parseSearchTime(params.Get("until")); err != nil {
+		return filter, err
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return filter, fmt.Errorf("invalid limit '%s'", limit)
+		}
+		filter.limit = n
+	}
+	return filter, nil
+}
+
+// parseSearchTime accepts an RFC 3339 timestamp or a duration before now
+func parseSearchTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s', use RFC 3339 or a duration such as 15m", value)
+	}
+	return t, nil
+}
+
+// serveStats reports aggregated query statistics. Parameters (optional):
+// window (duration up to 24h, default 1h) and top (size of the top lists).
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	window := defaultStatsWindow
+	if value := params.Get("window"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute || d > statsRetention {
+			http.Error(w, fmt.Sprintf("invalid window '%s', use a duration between 1m and %s", value, statsRetention), http.StatusBadRequest)
+			return
+		}
+		window = d.Truncate(time.Minute)
+	}
+	top := defaultStatsTop
+	if value := params.Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid top '%s'", value), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	report := s.stats.report(time.Now(), window, top)
+	report.Transports = s.transports.snapshot()
+	report.Blocklists = s.blocker.hits.snapshot()
+	report.Limits = s.limits.hits.snapshot()
+
+	// The dashboard may be served from another origin, e.g. the proxy menu
+	if origin := r.Header.Get("Origin"); origin != "" && slices.Contains(s.cfg.API.AllowedOrigins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		s.logger.Error("Error encoding stats response:", err)
+	}
+}
+
+// zoneDS is the DS record of a signed local zone
+type zoneDS struct {
+	Zone string `json:"zone"`
+	DS   string `json:"ds"`
+}
+
+// serveDS lists the DS records of the signed local zones. They belong in the
+// parent zone or a validator's trust anchors, so the zones do not serve them.
+func (s *Server) serveDS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	records := []zoneDS{}
+	for _, z := range s.signers {
+		records = append(records, zoneDS{Zone: z.name, DS: z.ksk.key.ToDS(dnslib.SHA256).String()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		s.logger.Error("Error encoding DS response:", err)
+	}
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"waguri-centralized-control/packages/go-utils/config"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// blockedTTL is the TTL of synthesized answers for blocked names
+const blockedTTL = 60
+
+// allowlistName marks allowlist entries in the allow trie
+const allowlistName = "allowlist"
+
+// domainTrie is a suffix trie keyed by labels from the TLD down. A name
+// matches an entry when the entry is the name itself or one of its parents.
+type domainTrie struct {
+	root *trieNode
+	size int
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// lists holds the names of the lists that contain this exact domain
+	lists []string
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &trieNode{}}
+}
+
+// insert adds domain as owned by list
+func (t *domainTrie) insert(domain, list string) {
+	node := t.root
+	labels := dnslib.SplitDomainName(strings.ToLower(domain))
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*trieNode)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &trieNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	for _, existing := range node.lists {
+		if existing == list {
+			return
+		}
+	}
+	if len(node.lists) == 0 {
+		t.size++
+	}
+	node.lists = append(node.lists, list)
+}
+
+// match returns the first list containing name or one of its parents for which
+// enabled returns true. A nil enabled func accepts every list.
+func (t *domainTrie) match(name string, enabled func(string) bool) (string, bool) {
+	node := t.root
+	labels := dnslib.SplitDomainName(strings.ToLower(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return "", false
+		}
+		node = child
+		for _, list := range node.lists {
+			if enabled == nil || enabled(list) {
+				return list, true
+			}
+		}
+	}
+	return "", false
+}
+
+// blockState is an immutable snapshot of the compiled lists
+type blockState struct {
+	blocked *domainTrie
+	allowed *domainTrie
+}
+
+// blocker filters queries against the configured blocklists
+type blocker struct {
+	cfg    BlockingConfig
+	logger *telemetry.Logger
+	state  atomic.Pointer[blockState]
+	// Number of blocked queries per list
+	hits namedCounters
+
+	mu sync.Mutex
+	// lastGood keeps the last successfully loaded domains of each list so a
+	// failed refresh does not unblock everything
+	lastGood map[string][]string
+}
+
+func newBlocker(cfg BlockingConfig, logger *telemetry.Logger) *blocker {
+	b := &blocker{cfg: cfg, logger: logger, lastGood: make(map[string][]string)}
+	b.state.Store(&blockState{blocked: newDomainTrie(), allowed: newDomainTrie()})
+	return b
+}
+
+// refresh downloads or reads every list and swaps in the compiled tries
+func (b *blocker) refresh() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := &blockState{blocked: newDomainTrie(), allowed: newDomainTrie()}
+	for _, name := range b.cfg.Allowlist {
+		state.allowed.insert(name, allowlistName)
+	}
+
+	for _, list := range b.cfg.Lists {
+		blocked, allowed, err := loadBlocklist(list)
+		if err != nil {
+			b.logger.Error("Failed to load blocklist", list.Name, "from", list.Source, err)
+			blocked = b.lastGood[list.Name]
+		} else {
+			b.lastGood[list.Name] = blocked
+			b.logger.Info("Loaded blocklist", list.Name, "- domains:", len(blocked), "exceptions:", len(allowed))
+		}
+
+		for _, domain := range blocked {
+			state.blocked.insert(domain, list.Name)
+		}
+		for _, domain := range allowed {
+			state.allowed.insert(domain, allowlistName)
+		}
+	}
+
+	b.state.Store(state)
+	b.logger.Info("Blocklists compiled - blocked domains:", state.blocked.size, "allowed domains:", state.allowed.size)
+}
+
+// run refreshes the lists periodically until stop is closed
+func (b *blocker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(b.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			b.refresh()
+		}
+	}
+}
+
+// check reports which list blocks name, honoring the allowlist. Only lists
+// accepted by enabled are considered; a nil enabled func accepts all lists.
+func (b *blocker) check(name string, enabled func(string) bool) (string, bool) {
+	state := b.state.Load()
+	if _, ok := state.allowed.match(name, nil); ok {
+		return "", false
+	}
+	list, ok := state.blocked.match(name, enabled)
+	if ok {
+		b.hits.inc(list)
+	}
+	return list, ok
+}
+
+// blockedResponse fills m with the configured answer for a blocked question
+func (b *blocker) blockedResponse(m *dnslib.Msg, q dnslib.Question) {
+	switch b.cfg.Response {
+	case blockResponseRefused:
+		m.Rcode = dnslib.RcodeRefused
+	case blockResponseZero:
+		hdr := dnslib.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dnslib.ClassINET, Ttl: blockedTTL}
+		switch q.Qtype {
+		case dnslib.TypeA:
+			m.Answer = append(m.Answer, &dnslib.A{Hdr: hdr, A: net.IPv4zero})
+		case dnslib.TypeAAAA:
+			m.Answer = append(m.Answer, &dnslib.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	default:
+		m.Rcode = dnslib.RcodeNameError
+	}
+}
+
+// loadBlocklist reads a list and returns its blocked and exception domains
+func loadBlocklist(list BlocklistConfig) ([]string, []string, error) {
+	data, err := config.ReadSource(list.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var blocked, allowed []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		domain, allow, ok := parseBlocklistLine(scanner.Text(), list.Format)
+		if !ok {
+			continue
+		}
+		if allow {
+			allowed = append(allowed, domain)
+		} else {
+			blocked = append(blocked, domain)
+		}
+	}
+	return blocked, allowed, scanner.Err()
+}
+
+// hostsPlaceholders are names found in hosts-format blocklists that must never be blocked
+var hostsPlaceholders = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// parseBlocklistLine extracts a domain from one line. allow is true for
+// adblock exception rules (@@||domain^).
+func parseBlocklistLine(line, format string) (domain string, allow bool, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return "", false, false
+	}
+
+	if format == blocklistFormatAuto {
+		switch {
+		case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||"):
+			format = blocklistFormatAdblock
+		case len(strings.Fields(line)) > 1:
+			format = blocklistFormatHosts
+		default:
+			format = blocklistFormatDomains
+		}
+	}
+
+	switch format {
+	case blocklistFormatAdblock:
+		if strings.HasPrefix(line, "@@") {
+			allow = true
+			line = line[2:]
+		}
+		if !strings.HasPrefix(line, "||") {
+			return "", false, false
+		}
+		rule, options, _ := strings.Cut(line[2:], "$")
+		// Modifiers other than $important only make sense for a browser blocker
+		if options != "" && options != "important" {
+			return "", false, false
+		}
+		if !strings.HasSuffix(rule, "^") {
+			return "", false, false
+		}
+		domain = strings.TrimSuffix(rule, "^")
+	case blocklistFormatHosts:
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return "", false, false
+		}
+		domain = fields[1]
+	default:
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 1 {
+			return "", false, false
+		}
+		domain = fields[0]
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if hostsPlaceholders[domain] || strings.ContainsAny(domain, "*/") {
+		return "", false, false
+	}
+	if _, valid := dnslib.IsDomainName(domain); !valid || !strings.Contains(domain, ".") {
+		return "", false, false
+	}
+	return domain, allow, true
+}
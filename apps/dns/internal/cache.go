@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// maxCacheTTL caps how long an answer is considered fresh
+const maxCacheTTL = 24 * time.Hour
+
+// staleAnswerTTL is the TTL of expired answers served when upstreams fail (RFC 8767 section 4)
+const staleAnswerTTL = 30
+
+// prefetchFraction is the share of the original TTL left when popular answers are refreshed
+const prefetchFraction = 10
+
+// prefetchMinHits is how often an answer must be used before it is prefetched
+const prefetchMinHits = 2
+
+// cacheEntry is one upstream answer with what is needed to refresh it
+type cacheEntry struct {
+	key    string
+	msg    *dnslib.Msg
+	query  *dnslib.Msg
+	pool   []upstream
+	stored time.Time
+	ttl    time.Duration
+	hits   int
+	// prefetching is set while a refresh of this entry is in flight
+	prefetching bool
+	elem        *list.Element
+}
+
+// answerCache is an LRU cache of upstream answers that keeps expired entries
+// for a while so they can be served when all upstreams fail
+type answerCache struct {
+	cfg CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	lru     *list.List
+}
+
+func newAnswerCache(cfg CacheConfig) *answerCache {
+	return &answerCache{cfg: cfg, entries: make(map[string]*cacheEntry), lru: list.New()}
+}
+
+// get returns a fresh answer for key with TTLs reduced by its age. When the
+// answer is popular and about to expire, a detached copy of the entry is also
+// returned for prefetching.
+func (c *answerCache) get(key string, now time.Time) (*dnslib.Msg, *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	age := now.Sub(entry.stored)
+	if age >= entry.ttl {
+		return nil, nil
+	}
+	entry.hits++
+	c.lru.MoveToFront(entry.elem)
+
+	var prefetch *cacheEntry
+	remaining := entry.ttl - age
+	if !c.cfg.DisablePrefetch && !entry.prefetching && entry.hits >= prefetchMinHits && remaining <= entry.ttl/prefetchFraction {
+		entry.prefetching = true
+		prefetch = &cacheEntry{key: entry.key, query: entry.query, pool: entry.pool}
+	}
+	elapsed := uint32(age / time.Second)
+	return withTTL(entry.msg, func(ttl uint32) uint32 { return ttl - min(ttl, elapsed) }), prefetch
+}
+
+// stale returns an expired answer for key if it is still within the serve-stale window
+func (c *answerCache) stale(key string, now time.Time) *dnslib.Msg {
+	if c.cfg.DisableServeStale {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || now.Sub(entry.stored) > entry.ttl+c.cfg.ServeStale {
+		return nil
+	}
+	c.lru.MoveToFront(entry.elem)
+
+	msg := withTTL(entry.msg, func(uint32) uint32 { return staleAnswerTTL })
+	// RFC 8914 extended error 3 tells the client the data is stale
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(ednsUDPSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dnslib.EDNS0_EDE{InfoCode: dnslib.ExtendedErrorCodeStaleAnswer})
+	return msg
+}
+
+// store caches a successful or NXDOMAIN answer, evicting the least recently used entry when full
+func (c *answerCache) store(key string, query *dnslib.Msg, pool []upstream, resp *dnslib.Msg, now time.Time) {
+	if resp.Truncated || (resp.Rcode != dnslib.RcodeSuccess && resp.Rcode != dnslib.RcodeNameError) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cacheEntry{key: key}
+		entry.elem = c.lru.PushFront(entry)
+		c.entries[key] = entry
+		for c.lru.Len() > c.cfg.Size {
+			oldest := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+			delete(c.entries, oldest.key)
+		}
+	} else {
+		c.lru.MoveToFront(entry.elem)
+	}
+
+	entry.msg = resp.Copy()
+	entry.query = query.Copy()
+	entry.pool = pool
+	entry.stored = now
+	entry.ttl = answerTTL(resp)
+	entry.hits = 0
+	entry.prefetching = false
+}
+
+// release clears the prefetch mark of an entry whose refresh failed
+func (c *answerCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.prefetching = false
+	}
+}
+
+// answerTTL is how long a response stays fresh: the smallest TTL of its
+// records in any section, so none outlives its own TTL when served from the
+// cache. For negative answers the SOA counts with its minimum field (RFC 2308).
+func answerTTL(resp *dnslib.Msg) time.Duration {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dnslib.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dnslib.TypeOPT {
+				continue
+			}
+			rrTTL := rr.Header().Ttl
+			if soa, ok := rr.(*dnslib.SOA); ok && len(resp.Answer) == 0 {
+				rrTTL = min(rrTTL, soa.Minttl)
+			}
+			if !found || rrTTL < ttl {
+				ttl, found = rrTTL, true
+			}
+		}
+	}
+	return min(time.Duration(ttl)*time.Second, maxCacheTTL)
+}
+
+// withTTL returns a copy of m with every record TTL rewritten by fn
+func withTTL(m *dnslib.Msg, fn func(uint32) uint32) *dnslib.Msg {
+	out := m.Copy()
+	for _, section := range [][]dnslib.RR{out.Answer, out.Ns, out.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dnslib.TypeOPT {
+				rr.Header().Ttl = fn(rr.Header().Ttl)
+			}
+		}
+	}
+	return out
+}
+
+// resolveUpstream answers query from the cache or the upstream pool. When
+// every upstream fails, an expired answer is served if one is still kept.
+func (s *Server) resolveUpstream(query *dnslib.Msg, pool []upstream) (*dnslib.Msg, string, error) {
+	name := query.Question[0].Name
+	key := flightKey(query, pool)
+
+	if s.cache != nil {
+		if resp, prefetch := s.cache.get(key, time.Now()); resp != nil {
+			s.logger.Info("Cache hit for", name, "- Answers:", len(resp.Answer))
+			if prefetch != nil {
+				go s.prefetch(prefetch)
+			}
+			return resp, sourceCache, nil
+		}
+	}
+
+	resp, used, err := s.forward(context.Background(), query, pool)
+	if err != nil {
+		if s.cache != nil {
+			if stale := s.cache.stale(key, time.Now()); stale != nil {
+				s.logger.Warn("Upstreams failed for", name, "- serving stale answer:", err)
+				return stale, sourceCache, nil
+			}
+		}
+		return nil, sourceUpstream, err
+	}
+	s.logger.Info("Upstream response for", name, "from", used, "- Answers:", len(resp.Answer), "Rcode:", dnslib.RcodeToString[resp.Rcode])
+
+	if s.cache != nil {
+		s.cache.store(key, query, pool, resp, time.Now())
+	}
+	return resp, sourceUpstream, nil
+}
+
+// prefetch refreshes a popular cache entry before it expires
+func (s *Server) prefetch(entry *cacheEntry) {
+	name := entry.query.Question[0].Name
+	resp, _, err := s.forward(context.Background(), entry.query, entry.pool)
+	if err != nil {
+		s.logger.Warn("Prefetch failed for", name, err)
+		s.cache.release(entry.key)
+		return
+	}
+	s.cache.store(entry.key, entry.query, entry.pool, resp, time.Now())
+	s.logger.Info("Prefetched", name, "- Answers:", len(resp.Answer))
+}
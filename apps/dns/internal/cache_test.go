@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// cachedTTLs stores resp, reads it back after age and returns the TTL of each
+// record by owner name and type, or nil when the entry has expired
+func cachedTTLs(t *testing.T, resp *dnslib.Msg, age time.Duration) map[string]uint32 {
+	t.Helper()
+	c := newAnswerCache(CacheConfig{Size: 10})
+	now := time.Now()
+	query := new(dnslib.Msg)
+	query.SetQuestion(resp.Question[0].Name, resp.Question[0].Qtype)
+	c.store("key", query, nil, resp, now)
+
+	msg, _ := c.get("key", now.Add(age))
+	if msg == nil {
+		return nil
+	}
+	ttls := make(map[string]uint32)
+	for _, section := range [][]dnslib.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			ttls[rr.Header().Name+" "+dnslib.TypeToString[rr.Header().Rrtype]] = rr.Header().Ttl
+		}
+	}
+	return ttls
+}
+
+func newTestResponse(t *testing.T, question string, qtype uint16, answer, ns, extra []string) *dnslib.Msg {
+	t.Helper()
+	resp := new(dnslib.Msg)
+	resp.SetQuestion(question, qtype)
+	resp.Response = true
+	for _, section := range []struct {
+		records []string
+		dst     *[]dnslib.RR
+	}{{answer, &resp.Answer}, {ns, &resp.Ns}, {extra, &resp.Extra}} {
+		for _, record := range section.records {
+			rr, err := dnslib.NewRR(record)
+			if err != nil {
+				t.Fatalf("NewRR(%q): %v", record, err)
+			}
+			*section.dst = append(*section.dst, rr)
+		}
+	}
+	return resp
+}
+
+func TestAnswerCacheAgesAllSections(t *testing.T) {
+	resp := newTestResponse(t, "www.example.", dnslib.TypeA,
+		[]string{"www.example. 300 IN A 192.0.2.1"},
+		[]string{"example. 200 IN NS ns.example."},
+		[]string{"ns.example. 60 IN A 192.0.2.53"})
+
+	ttls := cachedTTLs(t, resp, 30*time.Second)
+	want := map[string]uint32{"www.example. A": 270, "example. NS": 170, "ns.example. A": 30}
+	for key, ttl := range want {
+		if ttls[key] != ttl {
+			t.Errorf("%s TTL after 30s = %d, want %d", key, ttls[key], ttl)
+		}
+	}
+
+	// The glue expires first, taking the entry with it rather than wrapping
+	// its TTL around
+	if ttls := cachedTTLs(t, resp, 90*time.Second); ttls != nil {
+		t.Errorf("entry still served after its glue expired: %v", ttls)
+	}
+}
+
+func TestAnswerTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *dnslib.Msg
+		want time.Duration
+	}{
+		{"answer", newTestResponse(t, "a.example.", dnslib.TypeA,
+			[]string{"a.example. 300 IN A 192.0.2.1", "a.example. 120 IN A 192.0.2.2"}, nil, nil), 120 * time.Second},
+		{"short additional", newTestResponse(t, "a.example.", dnslib.TypeA,
+			[]string{"a.example. 300 IN A 192.0.2.1"}, nil, []string{"ns.example. 10 IN A 192.0.2.53"}), 10 * time.Second},
+		{"negative bounded by SOA minimum", newTestResponse(t, "x.example.", dnslib.TypeA, nil,
+			[]string{"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 300"}, nil), 300 * time.Second},
+		{"capped", newTestResponse(t, "a.example.", dnslib.TypeA,
+			[]string{"a.example. 604800 IN A 192.0.2.1"}, nil, nil), maxCacheTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := answerTTL(tt.resp); got != tt.want {
+				t.Errorf("answerTTL = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
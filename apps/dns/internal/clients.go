@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"net"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// clientGroup is a compiled per-client policy
+type clientGroup struct {
+	name    string
+	sources []*net.IPNet
+	// records holds the group's overrides, consulted before the global records
+	records *recordSet
+	// blocklists limits which lists apply; nil means all lists
+	blocklists map[string]bool
+	// upstreams replaces the default pool when set
+	upstreams []upstream
+}
+
+// compileClientGroups builds the per-client policies from config
+func compileClientGroups(cfg *DNSConfig, logger *telemetry.Logger) []*clientGroup {
+	var groups []*clientGroup
+	for _, groupCfg := range cfg.ClientGroups {
+		group := &clientGroup{name: groupCfg.Name}
+
+		for _, cidr := range groupCfg.Sources {
+			if _, network, err := net.ParseCIDR(cidr); err == nil {
+				group.sources = append(group.sources, network)
+			}
+		}
+
+		source := "client group " + groupCfg.Name
+		b := newRecordSetBuilder(logger)
+		for _, domain := range groupCfg.Domains {
+			b.addDomain(domain, source)
+		}
+		if !cfg.Reverse.Disabled {
+			b.synthesizePTR(cfg.Reverse.Canonical)
+		}
+		group.records = b.build()
+
+		if groupCfg.Blocklists != nil {
+			group.blocklists = make(map[string]bool)
+			for _, name := range groupCfg.Blocklists {
+				group.blocklists[name] = true
+			}
+		}
+
+		group.upstreams = newUpstreamPool(groupCfg.Upstreams, logger)
+
+		groups = append(groups, group)
+		logger.Info("Registered client group:", group.name, "sources:", groupCfg.Sources, "overrides:", group.records.count())
+	}
+	return groups
+}
+
+// blocklistEnabled returns the filter for blocker.check, nil meaning all lists
+func (g *clientGroup) blocklistEnabled() func(string) bool {
+	if g == nil || g.blocklists == nil {
+		return nil
+	}
+	return func(list string) bool { return g.blocklists[list] }
+}
+
+// clientIP returns the address used to pick a client group: the EDNS Client
+// Subnet address when enabled and present, otherwise the source address
+func (s *Server) clientIP(w dnslib.ResponseWriter, r *dnslib.Msg) net.IP {
+	if s.cfg.UseECS {
+		if opt := r.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if subnet, ok := option.(*dnslib.EDNS0_SUBNET); ok {
+					return subnet.Address
+				}
+			}
+		}
+	}
+
+	return addrIP(w.RemoteAddr())
+}
+
+// addrIP extracts the IP of a UDP or TCP address
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// matchClientGroup returns the group with the most specific source range containing ip
+func (s *Server) matchClientGroup(ip net.IP) *clientGroup {
+	if ip == nil {
+		return nil
+	}
+
+	var best *clientGroup
+	bestLen := -1
+	for _, group := range s.groups {
+		for _, network := range group.sources {
+			if !network.Contains(ip) {
+				continue
+			}
+			if ones, _ := network.Mask.Size(); ones > bestLen {
+				best = group
+				bestLen = ones
+			}
+		}
+	}
+	return best
+}
+
+// recordsFor returns the record layers visible to a client group
+func (s *Server) recordsFor(group *clientGroup) recordLayers {
+	if group == nil || group.records.count() == 0 {
+		return recordLayers{s.records.Load()}
+	}
+	return recordLayers{group.records, s.records.Load()}
+}
+
+// upstreamsFor returns the default upstream pool for a client group
+func (s *Server) upstreamsFor(group *clientGroup) []upstream {
+	if group == nil || len(group.upstreams) == 0 {
+		return s.upstreams
+	}
+	return group.upstreams
+}
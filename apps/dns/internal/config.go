@@ -1,16 +1,384 @@
 package internal
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 	"waguri-centralized-control/packages/go-utils/config"
+
+	dnslib "github.com/miekg/dns"
 )
 
 // DNSConfig embeds the base config and adds DNS-specific fields
 type DNSConfig struct {
-	config.Config `yaml:",inline"`
-	Domains       map[string]string `yaml:"domains"`
+	config.Config  `yaml:",inline"`
+	Domains        []DomainConfig   `yaml:"domains"`
+	ZoneFiles      []ZoneFileConfig `yaml:"zone_files"`
+	HostsFiles     []string         `yaml:"hosts_files"`
+	ReloadInterval time.Duration    `yaml:"reload_interval"`
+	Reverse        ReverseConfig    `yaml:"reverse"`
+	TLS            TLSConfig        `yaml:"tls"`
+	DoT            DoTConfig        `yaml:"dot"`
+	DoH            DoHConfig        `yaml:"doh"`
+	Upstreams      []UpstreamConfig `yaml:"upstreams"`
+	ForwardRules   []ForwardRule    `yaml:"forward_rules"`
+	Blocking       BlockingConfig   `yaml:"blocking"`
+	ClientGroups   []ClientGroup    `yaml:"client_groups"`
+	DNSSEC         DNSSECConfig     `yaml:"dnssec"`
+	QueryLog       QueryLogConfig   `yaml:"query_log"`
+	API            APIConfig        `yaml:"api"`
+	Limits         LimitsConfig     `yaml:"limits"`
+	Cache          CacheConfig      `yaml:"cache"`
+	DHCP           DHCPConfig       `yaml:"dhcp"`
+	MDNS           MDNSConfig       `yaml:"mdns"`
+	TSIGKeys       []TSIGKeyConfig  `yaml:"tsig_keys"`
+	Transfer       TransferConfig   `yaml:"transfer"`
+	SecondaryZones []SecondaryZone  `yaml:"secondary_zones"`
+	// UseECS identifies clients by their EDNS Client Subnet when present,
+	// e.g. when queries are relayed by another resolver
+	UseECS bool `yaml:"use_ecs"`
+}
+
+// QueryLogConfig sizes the in-memory query history and optionally persists it
+type QueryLogConfig struct {
+	// Size is the number of recent queries kept in memory
+	Size int `yaml:"size"`
+	// File receives every entry as a JSON line when set
+	File string `yaml:"file"`
+}
+
+// DHCPConfig enables the DHCPv4 server on Interface when set. Hostnames of
+// active leases are published as <hostname>.<domain> A and PTR records.
+type DHCPConfig struct {
+	Interface string `yaml:"interface"`
+	// ServerIP identifies this server to clients; defaults to the interface address in Subnet
+	ServerIP string `yaml:"server_ip"`
+	// Subnet is the network leases are handed out in, e.g. 192.168.1.0/24
+	Subnet       string              `yaml:"subnet"`
+	Ranges       []DHCPRangeConfig   `yaml:"ranges"`
+	StaticLeases []StaticLeaseConfig `yaml:"static_leases"`
+	LeaseTime    time.Duration       `yaml:"lease_time"`
+	// LeaseFile keeps leases across restarts when set
+	LeaseFile string `yaml:"lease_file"`
+	// Router, DNSServers and Domain are sent to clients; DNSServers defaults to ServerIP
+	Router     string   `yaml:"router"`
+	DNSServers []string `yaml:"dns_servers"`
+	Domain     string   `yaml:"domain"`
+}
+
+// DHCPRangeConfig is an inclusive range of dynamically leased addresses
+type DHCPRangeConfig struct {
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+// StaticLeaseConfig pins the address, and optionally the hostname, of a client by MAC
+type StaticLeaseConfig struct {
+	MAC      string `yaml:"mac"`
+	IP       string `yaml:"ip"`
+	Hostname string `yaml:"hostname"`
+}
+
+// TSIGKeyConfig is a shared secret signing zone transfers and NOTIFY messages
+type TSIGKeyConfig struct {
+	Name string `yaml:"name"`
+	// Algorithm is hmac-sha256 (default), hmac-sha1, hmac-sha224, hmac-sha384 or hmac-sha512
+	Algorithm string `yaml:"algorithm"`
+	// Secret is base64 encoded, e.g. from "tsig-keygen" or "openssl rand -base64 32"
+	Secret string `yaml:"secret"`
+}
+
+// TransferConfig serves local zones to secondary servers over AXFR and IXFR
+type TransferConfig struct {
+	Zones []string `yaml:"zones"`
+	// AllowedClients are the secondaries' source ranges
+	AllowedClients []string `yaml:"allowed_clients"`
+	// TSIGKey must sign transfer requests when set; it also signs NOTIFY messages
+	TSIGKey string `yaml:"tsig_key"`
+	// Notify lists secondaries (host or host:port) told when a zone's serial changes
+	Notify []string `yaml:"notify"`
+}
+
+// SecondaryZone is pulled from a primary server and served read-only. The
+// SOA refresh, retry and expire timers of the zone are honored.
+type SecondaryZone struct {
+	Zone string `yaml:"zone"`
+	// Primaries are tried in order (host or host:port); NOTIFY is accepted from them
+	Primaries []string `yaml:"primaries"`
+	TSIGKey   string   `yaml:"tsig_key"`
+}
+
+// MDNSConfig bridges multicast DNS (IPv4) into the unicast resolver
+type MDNSConfig struct {
+	// Zone answers unicast queries from announced .local records, e.g.
+	// printer.lan.waguri.san is answered with the records of printer.local
+	Zone string `yaml:"zone"`
+	// Interfaces to listen on; defaults to the system's multicast interface
+	Interfaces []string `yaml:"interfaces"`
+	// Announce publishes the local A/AAAA records under these domains over
+	// mDNS, with the domain replaced by .local (nas.waguri.san as nas.local)
+	Announce []string `yaml:"announce"`
+}
+
+// CacheConfig controls caching of forwarded answers
+type CacheConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// Size is the maximum number of cached answers
+	Size int `yaml:"size"`
+	// ServeStale is how long after expiry an answer may still be served when
+	// every upstream fails (RFC 8767)
+	ServeStale        time.Duration `yaml:"serve_stale"`
+	DisableServeStale bool          `yaml:"disable_serve_stale"`
+	// DisablePrefetch stops refreshing popular answers shortly before they expire
+	DisablePrefetch bool `yaml:"disable_prefetch"`
+}
+
+// LimitsConfig protects the resolver from abuse and runaway clients
+type LimitsConfig struct {
+	// AllowedClients are the source ranges that may query; others get REFUSED.
+	// Empty allows everyone.
+	AllowedClients []string `yaml:"allowed_clients"`
+	// ClientQPS rate limits queries per client address; 0 disables the limit
+	ClientQPS float64 `yaml:"client_qps"`
+	// ClientBurst is how many queries a client may send at once; defaults to twice ClientQPS
+	ClientBurst int `yaml:"client_burst"`
+	// MaxConcurrentUpstream caps in-flight upstream queries; 0 is unlimited
+	MaxConcurrentUpstream int       `yaml:"max_concurrent_upstream"`
+	RRL                   RRLConfig `yaml:"rrl"`
+}
+
+// RRLConfig limits identical UDP responses to one client network, which stops
+// the resolver from being used to amplify spoofed traffic
+type RRLConfig struct {
+	// ResponsesPerSecond per client network and response; 0 disables RRL
+	ResponsesPerSecond float64 `yaml:"responses_per_second"`
+	// Slip answers every Nth limited response with an empty truncated reply
+	// instead of dropping it; 0 drops all. Defaults to 2.
+	Slip             *int `yaml:"slip"`
+	IPv4PrefixLength int  `yaml:"ipv4_prefix_length"`
+	IPv6PrefixLength int  `yaml:"ipv6_prefix_length"`
+}
+
+// APIConfig enables the HTTP API (query log search) when Listen is set
+type APIConfig struct {
+	Listen string `yaml:"listen"`
+	// AllowedOrigins may read the statistics from a browser, e.g. the proxy
+	// menu; none by default, as the statistics name clients
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// DNSSECConfig controls validation of forwarded answers and signing of local zones
+type DNSSECConfig struct {
+	Validate bool `yaml:"validate"`
+	// TrustAnchors are DS or DNSKEY records in presentation format; defaults to the root KSKs
+	TrustAnchors []string `yaml:"trust_anchors"`
+	// NegativeTrustAnchors are domains (and their subdomains) that are never validated
+	NegativeTrustAnchors []string `yaml:"negative_trust_anchors"`
+	// Sign lists local zones that are signed online
+	Sign []SignedZoneConfig `yaml:"sign"`
+	// SignatureValidity is how long signatures are valid; zones are re-signed halfway through
+	SignatureValidity time.Duration `yaml:"signature_validity"`
+}
+
+// SignedZoneConfig selects the keys and denial-of-existence method of a signed zone
+type SignedZoneConfig struct {
+	Name string `yaml:"name"`
+	// Algorithm is "ecdsap256" (default) or "ed25519"
+	Algorithm string `yaml:"algorithm"`
+	// KeyDir holds BIND-style K<zone>+<alg>+<tag>.key/.private files. Missing
+	// keys are generated and saved there; without a directory keys are
+	// generated on every start and the DS record changes.
+	KeyDir string `yaml:"key_dir"`
+	// NSEC3 uses hashed denial of existence (RFC 9276 parameters) instead of NSEC
+	NSEC3 bool `yaml:"nsec3"`
+}
+
+// ClientGroup applies its own policy to clients from the listed source ranges.
+// When ranges of several groups match, the most specific one wins.
+type ClientGroup struct {
+	Name    string   `yaml:"name"`
+	Sources []string `yaml:"sources"`
+	// Domains override the global records for this group (split horizon)
+	Domains []DomainConfig `yaml:"domains"`
+	// Blocklists restricts blocking to these list names; omit for all lists, [] for none
+	Blocklists []string `yaml:"blocklists"`
+	// Upstreams replace the default upstream pool; forward rules still apply
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+}
+
+// BlockingConfig configures ad and tracker blocklists
+type BlockingConfig struct {
+	// Response is how blocked names are answered: "nxdomain", "zero" (0.0.0.0 / ::) or "refused"
+	Response        string            `yaml:"response"`
+	RefreshInterval time.Duration     `yaml:"refresh_interval"`
+	Lists           []BlocklistConfig `yaml:"lists"`
+	// Allowlist names (and their subdomains) are never blocked
+	Allowlist []string `yaml:"allowlist"`
+}
+
+// BlocklistConfig is a single blocklist loaded from a local file or URL
+type BlocklistConfig struct {
+	Name   string `yaml:"name"`
+	Source string `yaml:"source"`
+	// Format is "hosts", "domains", "adblock" or "auto" (detected per line)
+	Format string `yaml:"format"`
+}
+
+// ForwardRule sends names under Suffix to dedicated upstreams instead of the
+// default pool. The rule with the longest matching suffix wins.
+type ForwardRule struct {
+	Suffix    string           `yaml:"suffix"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+}
+
+// UpstreamConfig describes a resolver unknown names are forwarded to.
+// Address accepts "host:port", "udp://", "tcp://", "tls://host:853" and
+// "https://host/dns-query". Upstreams are tried in order until one answers.
+type UpstreamConfig struct {
+	Address string `yaml:"address"`
+	// Bootstrap is the IP used to reach the upstream host, so it never has to be resolved by DNS
+	Bootstrap string        `yaml:"bootstrap"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// DomainConfig maps a single name (optionally a "*." wildcard) to an IP address
+// or, alternatively, to another name via a CNAME record
+type DomainConfig struct {
+	Name  string `yaml:"name"`
+	IP    string `yaml:"ip"`
+	CNAME string `yaml:"cname"`
+}
+
+// ZoneFileConfig references a BIND-style RFC 1035 zone file
+type ZoneFileConfig struct {
+	Path string `yaml:"path"`
+	// Origin is used for relative names when the file has no $ORIGIN directive
+	Origin string `yaml:"origin"`
+}
+
+// ReverseConfig controls PTR answers for in-addr.arpa and ip6.arpa names
+type ReverseConfig struct {
+	// Disabled turns off PTR synthesis from local A/AAAA records
+	Disabled bool `yaml:"disabled"`
+	// Canonical selects the PTR target when several names share an IP: "first" or "shortest"
+	Canonical string `yaml:"canonical"`
+	// Overrides pin the PTR target for specific addresses
+	Overrides []PTROverride `yaml:"overrides"`
+	// PrivateRanges are answered with authoritative NXDOMAIN instead of being forwarded
+	PrivateRanges []string `yaml:"private_ranges"`
+}
+
+// PTROverride maps an IP address to an explicit PTR target name
+type PTROverride struct {
+	IP   string `yaml:"ip"`
+	Name string `yaml:"name"`
+}
+
+// TLSConfig points at the certificate used by the DoT and DoH listeners.
+// The files are re-read automatically when they change on disk.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// DoTConfig enables the DNS-over-TLS (RFC 7858) listener when Listen is set
+type DoTConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+// DoHConfig enables the DNS-over-HTTPS (RFC 8484) listener when Listen is set
+type DoHConfig struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+	// Plaintext serves DoH over plain HTTP, e.g. behind the waguri proxy
+	Plaintext bool `yaml:"plaintext"`
+}
+
+// Canonical name selection strategies for synthesized PTR records
+const (
+	canonicalFirst    = "first"
+	canonicalShortest = "shortest"
+)
+
+// defaultPrivateRanges are the RFC 1918, link-local and unique local ranges
+var defaultPrivateRanges = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// Responses for blocked names
+const (
+	blockResponseNXDomain = "nxdomain"
+	blockResponseZero     = "zero"
+	blockResponseRefused  = "refused"
+)
+
+// Blocklist formats
+const (
+	blocklistFormatAuto    = "auto"
+	blocklistFormatHosts   = "hosts"
+	blocklistFormatDomains = "domains"
+	blocklistFormatAdblock = "adblock"
+)
+
+// defaultBlocklistRefresh is how often blocklists are downloaded again
+const defaultBlocklistRefresh = 24 * time.Hour
+
+// defaultTrustAnchors are the DS records of the root zone KSK-2017 and KSK-2024
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
 }
 
+// defaultUpstream is used when no upstreams are configured
+const defaultUpstream = "1.1.1.1:53"
+
+// defaultUpstreamTimeout bounds a single upstream exchange
+const defaultUpstreamTimeout = 5 * time.Second
+
+// defaultDoHPath is the conventional RFC 8484 endpoint
+const defaultDoHPath = "/dns-query"
+
+// Supported signing algorithms for local zones
+const (
+	signingECDSAP256 = "ecdsap256"
+	signingEd25519   = "ed25519"
+)
+
+// defaultSignatureValidity is the lifetime of signatures on local zones
+const defaultSignatureValidity = 14 * 24 * time.Hour
+
+// Defaults of response rate limiting, as in BIND
+const (
+	defaultRRLSlip       = 2
+	defaultRRLIPv4Prefix = 24
+	defaultRRLIPv6Prefix = 56
+)
+
+// defaultQueryLogSize is how many recent queries are kept for searching
+const defaultQueryLogSize = 10000
+
+// defaultTSIGAlgorithm is used for TSIG keys without an explicit algorithm
+const defaultTSIGAlgorithm = "hmac-sha256"
+
+// defaultDHCPLeaseTime is how long dynamic and static leases last
+const defaultDHCPLeaseTime = 12 * time.Hour
+
+// Defaults of the answer cache
+const (
+	defaultCacheSize  = 10000
+	defaultServeStale = 24 * time.Hour
+)
+
+// defaultReloadInterval is how often record source files are checked for changes
+const defaultReloadInterval = 30 * time.Second
+
 // LoadDNSConfig loads DNS-specific configuration
 func LoadDNSConfig(pathOrURL string) (*DNSConfig, error) {
 	cfg := &DNSConfig{}
@@ -19,6 +387,82 @@ func LoadDNSConfig(pathOrURL string) (*DNSConfig, error) {
 		return nil, err
 	}
 
+	if cfg.ReloadInterval == 0 {
+		cfg.ReloadInterval = defaultReloadInterval
+	}
+	if len(cfg.Upstreams) == 0 {
+		cfg.Upstreams = []UpstreamConfig{{Address: defaultUpstream}}
+	}
+	applyUpstreamDefaults(cfg.Upstreams)
+	for _, rule := range cfg.ForwardRules {
+		applyUpstreamDefaults(rule.Upstreams)
+	}
+	if cfg.Blocking.Response == "" {
+		cfg.Blocking.Response = blockResponseNXDomain
+	}
+	if cfg.Blocking.RefreshInterval == 0 {
+		cfg.Blocking.RefreshInterval = defaultBlocklistRefresh
+	}
+	for _, group := range cfg.ClientGroups {
+		applyUpstreamDefaults(group.Upstreams)
+	}
+	for i := range cfg.Blocking.Lists {
+		if cfg.Blocking.Lists[i].Format == "" {
+			cfg.Blocking.Lists[i].Format = blocklistFormatAuto
+		}
+	}
+	if cfg.DNSSEC.TrustAnchors == nil {
+		cfg.DNSSEC.TrustAnchors = defaultTrustAnchors
+	}
+	if cfg.Limits.ClientBurst == 0 {
+		cfg.Limits.ClientBurst = int(max(1, 2*cfg.Limits.ClientQPS))
+	}
+	if cfg.Limits.RRL.Slip == nil {
+		slip := defaultRRLSlip
+		cfg.Limits.RRL.Slip = &slip
+	}
+	if cfg.Limits.RRL.IPv4PrefixLength == 0 {
+		cfg.Limits.RRL.IPv4PrefixLength = defaultRRLIPv4Prefix
+	}
+	if cfg.Limits.RRL.IPv6PrefixLength == 0 {
+		cfg.Limits.RRL.IPv6PrefixLength = defaultRRLIPv6Prefix
+	}
+	if cfg.QueryLog.Size == 0 {
+		cfg.QueryLog.Size = defaultQueryLogSize
+	}
+	if cfg.Cache.Size == 0 {
+		cfg.Cache.Size = defaultCacheSize
+	}
+	if cfg.Cache.ServeStale == 0 {
+		cfg.Cache.ServeStale = defaultServeStale
+	}
+	if cfg.DHCP.LeaseTime == 0 {
+		cfg.DHCP.LeaseTime = defaultDHCPLeaseTime
+	}
+	if cfg.DNSSEC.SignatureValidity == 0 {
+		cfg.DNSSEC.SignatureValidity = defaultSignatureValidity
+	}
+	for i := range cfg.TSIGKeys {
+		if cfg.TSIGKeys[i].Algorithm == "" {
+			cfg.TSIGKeys[i].Algorithm = defaultTSIGAlgorithm
+		}
+	}
+	for i := range cfg.DNSSEC.Sign {
+		if cfg.DNSSEC.Sign[i].Algorithm == "" {
+			cfg.DNSSEC.Sign[i].Algorithm = signingECDSAP256
+		}
+	}
+	if cfg.DoH.Path == "" {
+		cfg.DoH.Path = defaultDoHPath
+	}
+	if cfg.Reverse.Canonical == "" {
+		cfg.Reverse.Canonical = canonicalFirst
+	}
+	// An explicit empty list disables private range handling
+	if cfg.Reverse.PrivateRanges == nil {
+		cfg.Reverse.PrivateRanges = defaultPrivateRanges
+	}
+
 	// Validate that domains are configured
 	if err := validateDNSConfig(cfg); err != nil {
 		return nil, fmt.Errorf("DNS configuration validation failed: %w", err)
@@ -29,16 +473,403 @@ func LoadDNSConfig(pathOrURL string) (*DNSConfig, error) {
 
 // validateDNSConfig ensures the DNS configuration is valid
 func validateDNSConfig(cfg *DNSConfig) error {
-	if len(cfg.Domains) == 0 {
-		return fmt.Errorf("no domains configured")
+	if len(cfg.Domains) == 0 && len(cfg.ZoneFiles) == 0 && len(cfg.HostsFiles) == 0 && cfg.DHCP.Interface == "" && len(cfg.SecondaryZones) == 0 {
+		return fmt.Errorf("no domains, zone files, hosts files, secondary zones or DHCP server configured")
+	}
+
+	if err := validateDomains(cfg.Domains); err != nil {
+		return err
+	}
+
+	for i, zone := range cfg.ZoneFiles {
+		if zone.Path == "" {
+			return fmt.Errorf("zone file %d: path is required", i)
+		}
+	}
+
+	for i, path := range cfg.HostsFiles {
+		if path == "" {
+			return fmt.Errorf("hosts file %d: path is required", i)
+		}
+	}
+
+	if err := validateReverseConfig(&cfg.Reverse); err != nil {
+		return err
+	}
+
+	for i, upstream := range cfg.Upstreams {
+		if upstream.Address == "" {
+			return fmt.Errorf("upstream %d: address is required", i)
+		}
+		if upstream.Bootstrap != "" && net.ParseIP(upstream.Bootstrap) == nil {
+			return fmt.Errorf("upstream %d (%s): invalid bootstrap IP '%s'", i, upstream.Address, upstream.Bootstrap)
+		}
+	}
+
+	for i, rule := range cfg.ForwardRules {
+		if rule.Suffix == "" {
+			return fmt.Errorf("forward rule %d: suffix is required", i)
+		}
+		if _, ok := dnslib.IsDomainName(rule.Suffix); !ok {
+			return fmt.Errorf("forward rule %d: invalid suffix '%s'", i, rule.Suffix)
+		}
+		if len(rule.Upstreams) == 0 {
+			return fmt.Errorf("forward rule %d (%s): at least one upstream is required", i, rule.Suffix)
+		}
+		for j, upstream := range rule.Upstreams {
+			if upstream.Address == "" {
+				return fmt.Errorf("forward rule %d (%s): upstream %d: address is required", i, rule.Suffix, j)
+			}
+		}
+	}
+
+	if err := validateBlockingConfig(&cfg.Blocking); err != nil {
+		return err
+	}
+
+	if err := validateClientGroups(cfg); err != nil {
+		return err
 	}
 
-	for domain, ip := range cfg.Domains {
-		if domain == "" {
-			return fmt.Errorf("empty domain name found")
+	if err := validateDNSSECConfig(&cfg.DNSSEC); err != nil {
+		return err
+	}
+
+	needsCert := cfg.DoT.Listen != "" || (cfg.DoH.Listen != "" && !cfg.DoH.Plaintext)
+	if needsCert && (cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file are required for DoT and DoH listeners")
+	}
+	if err := validateLimitsConfig(&cfg.Limits); err != nil {
+		return err
+	}
+	if cfg.QueryLog.Size < 0 {
+		return fmt.Errorf("query_log: size must be positive")
+	}
+	if cfg.Cache.Size < 0 || cfg.Cache.ServeStale < 0 {
+		return fmt.Errorf("cache: size and serve_stale must be positive")
+	}
+	if cfg.DHCP.Interface != "" {
+		if err := validateDHCPConfig(&cfg.DHCP); err != nil {
+			return err
+		}
+	}
+	if _, ok := dnslib.IsDomainName(cfg.MDNS.Zone); cfg.MDNS.Zone != "" && !ok {
+		return fmt.Errorf("mdns: invalid zone '%s'", cfg.MDNS.Zone)
+	}
+	for _, domain := range cfg.MDNS.Announce {
+		if _, ok := dnslib.IsDomainName(domain); !ok || domain == "" {
+			return fmt.Errorf("mdns: invalid announce domain '%s'", domain)
+		}
+	}
+	if err := validateTransferConfig(cfg); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(cfg.DoH.Path, "/") {
+		return fmt.Errorf("doh: path must start with '/'")
+	}
+
+	if cfg.ReloadInterval < 0 {
+		return fmt.Errorf("reload_interval must not be negative")
+	}
+
+	return nil
+}
+
+// validateDomains checks that each domain maps to exactly one IP or CNAME target
+func validateDomains(domains []DomainConfig) error {
+	for i, domain := range domains {
+		if domain.Name == "" {
+			return fmt.Errorf("domain %d: empty domain name found", i)
+		}
+		if domain.IP == "" && domain.CNAME == "" {
+			return fmt.Errorf("domain '%s' has empty IP address", domain.Name)
+		}
+		if domain.IP != "" && domain.CNAME != "" {
+			return fmt.Errorf("domain '%s' cannot have both an IP address and a CNAME", domain.Name)
+		}
+		if domain.IP != "" && net.ParseIP(domain.IP) == nil {
+			return fmt.Errorf("domain '%s' has invalid IP address '%s'", domain.Name, domain.IP)
+		}
+		if _, ok := dnslib.IsDomainName(domain.CNAME); domain.CNAME != "" && !ok {
+			return fmt.Errorf("domain '%s' has invalid CNAME '%s'", domain.Name, domain.CNAME)
+		}
+	}
+	return nil
+}
+
+// validateClientGroups checks client group sources and references to blocklists
+func validateClientGroups(cfg *DNSConfig) error {
+	lists := make(map[string]bool)
+	for _, list := range cfg.Blocking.Lists {
+		lists[list.Name] = true
+	}
+
+	for i, group := range cfg.ClientGroups {
+		if group.Name == "" {
+			return fmt.Errorf("client group %d: name is required", i)
+		}
+		if len(group.Sources) == 0 {
+			return fmt.Errorf("client group %d (%s): at least one source is required", i, group.Name)
+		}
+		for _, cidr := range group.Sources {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("client group %d (%s): invalid source '%s': %w", i, group.Name, cidr, err)
+			}
+		}
+		if err := validateDomains(group.Domains); err != nil {
+			return fmt.Errorf("client group %d (%s): %w", i, group.Name, err)
+		}
+		for _, name := range group.Blocklists {
+			if !lists[name] {
+				return fmt.Errorf("client group %d (%s): unknown blocklist '%s'", i, group.Name, name)
+			}
+		}
+		for j, upstream := range group.Upstreams {
+			if upstream.Address == "" {
+				return fmt.Errorf("client group %d (%s): upstream %d: address is required", i, group.Name, j)
+			}
+		}
+	}
+	return nil
+}
+
+// validateLimitsConfig checks client ranges and rate limit parameters
+func validateLimitsConfig(cfg *LimitsConfig) error {
+	for i, cidr := range cfg.AllowedClients {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("limits: allowed client %d: invalid CIDR '%s'", i, cidr)
+		}
+	}
+	if cfg.ClientQPS < 0 || cfg.ClientBurst < 0 {
+		return fmt.Errorf("limits: client_qps and client_burst must not be negative")
+	}
+	if cfg.MaxConcurrentUpstream < 0 {
+		return fmt.Errorf("limits: max_concurrent_upstream must not be negative")
+	}
+	if cfg.RRL.ResponsesPerSecond < 0 || *cfg.RRL.Slip < 0 {
+		return fmt.Errorf("limits: rrl responses_per_second and slip must not be negative")
+	}
+	if cfg.RRL.IPv4PrefixLength < 1 || cfg.RRL.IPv4PrefixLength > 32 {
+		return fmt.Errorf("limits: rrl ipv4_prefix_length must be between 1 and 32")
+	}
+	if cfg.RRL.IPv6PrefixLength < 1 || cfg.RRL.IPv6PrefixLength > 128 {
+		return fmt.Errorf("limits: rrl ipv6_prefix_length must be between 1 and 128")
+	}
+	return nil
+}
+
+// validateTransferConfig checks TSIG keys, zones served to secondaries and
+// zones pulled from primaries
+func validateTransferConfig(cfg *DNSConfig) error {
+	keys := make(map[string]bool)
+	for i, key := range cfg.TSIGKeys {
+		if _, ok := dnslib.IsDomainName(key.Name); key.Name == "" || !ok {
+			return fmt.Errorf("tsig key %d: invalid name '%s'", i, key.Name)
+		}
+		if tsigAlgorithms[key.Algorithm] == "" {
+			return fmt.Errorf("tsig key %d (%s): unsupported algorithm '%s'", i, key.Name, key.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil || key.Secret == "" {
+			return fmt.Errorf("tsig key %d (%s): secret must be base64", i, key.Name)
+		}
+		keys[dnslib.CanonicalName(key.Name)] = true
+	}
+	knownKey := func(name string) bool {
+		return name == "" || keys[dnslib.CanonicalName(name)]
+	}
+
+	transfer := cfg.Transfer
+	for _, zone := range transfer.Zones {
+		if _, ok := dnslib.IsDomainName(zone); zone == "" || !ok {
+			return fmt.Errorf("transfer: invalid zone '%s'", zone)
+		}
+	}
+	if len(transfer.Zones) > 0 && len(transfer.AllowedClients) == 0 {
+		return fmt.Errorf("transfer: allowed_clients is required to serve zones")
+	}
+	for i, cidr := range transfer.AllowedClients {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("transfer: allowed client %d: invalid CIDR '%s'", i, cidr)
+		}
+	}
+	if !knownKey(transfer.TSIGKey) {
+		return fmt.Errorf("transfer: unknown tsig_key '%s'", transfer.TSIGKey)
+	}
+
+	for i, zone := range cfg.SecondaryZones {
+		if _, ok := dnslib.IsDomainName(zone.Zone); zone.Zone == "" || !ok {
+			return fmt.Errorf("secondary zone %d: invalid zone '%s'", i, zone.Zone)
+		}
+		if len(zone.Primaries) == 0 {
+			return fmt.Errorf("secondary zone %d (%s): at least one primary is required", i, zone.Zone)
 		}
-		if ip == "" {
-			return fmt.Errorf("domain '%s' has empty IP address", domain)
+		if !knownKey(zone.TSIGKey) {
+			return fmt.Errorf("secondary zone %d (%s): unknown tsig_key '%s'", i, zone.Zone, zone.TSIGKey)
+		}
+	}
+	return nil
+}
+
+// validateDHCPConfig checks that every address lies in the subnet and that
+// static leases have a valid MAC address and hostname
+func validateDHCPConfig(cfg *DHCPConfig) error {
+	_, subnet, err := net.ParseCIDR(cfg.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return fmt.Errorf("dhcp: subnet must be an IPv4 CIDR, got '%s'", cfg.Subnet)
+	}
+	inSubnet := func(value string) bool {
+		ip := net.ParseIP(value)
+		return ip != nil && ip.To4() != nil && subnet.Contains(ip)
+	}
+
+	if cfg.ServerIP != "" && !inSubnet(cfg.ServerIP) {
+		return fmt.Errorf("dhcp: server_ip '%s' is not in subnet %s", cfg.ServerIP, cfg.Subnet)
+	}
+	if cfg.Router != "" && !inSubnet(cfg.Router) {
+		return fmt.Errorf("dhcp: router '%s' is not in subnet %s", cfg.Router, cfg.Subnet)
+	}
+	for _, server := range cfg.DNSServers {
+		if ip := net.ParseIP(server); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("dhcp: invalid IPv4 DNS server '%s'", server)
+		}
+	}
+	if _, ok := dnslib.IsDomainName(cfg.Domain); cfg.Domain == "" || !ok {
+		return fmt.Errorf("dhcp: domain is required to publish lease hostnames")
+	}
+	if len(cfg.Ranges) == 0 && len(cfg.StaticLeases) == 0 {
+		return fmt.Errorf("dhcp: at least one range or static lease is required")
+	}
+	for i, r := range cfg.Ranges {
+		if !inSubnet(r.Start) || !inSubnet(r.End) {
+			return fmt.Errorf("dhcp: range %d: start and end must be IPv4 addresses in subnet %s", i, cfg.Subnet)
+		}
+		if ipToUint32(net.ParseIP(r.Start)) > ipToUint32(net.ParseIP(r.End)) {
+			return fmt.Errorf("dhcp: range %d: start %s is after end %s", i, r.Start, r.End)
+		}
+	}
+	for i, lease := range cfg.StaticLeases {
+		if _, err := net.ParseMAC(lease.MAC); err != nil {
+			return fmt.Errorf("dhcp: static lease %d: invalid MAC '%s'", i, lease.MAC)
+		}
+		if !inSubnet(lease.IP) {
+			return fmt.Errorf("dhcp: static lease %d (%s): IP '%s' is not in subnet %s", i, lease.MAC, lease.IP, cfg.Subnet)
+		}
+		if lease.Hostname != "" && sanitizeHostname(lease.Hostname) != strings.ToLower(lease.Hostname) {
+			return fmt.Errorf("dhcp: static lease %d (%s): hostname '%s' must be a single DNS label", i, lease.MAC, lease.Hostname)
+		}
+	}
+	if cfg.LeaseTime < time.Minute {
+		return fmt.Errorf("dhcp: lease_time must be at least 1m")
+	}
+	return nil
+}
+
+// validateDNSSECConfig checks that trust anchors parse as DS or DNSKEY records
+// and that signed zones use a supported algorithm
+func validateDNSSECConfig(cfg *DNSSECConfig) error {
+	if cfg.Validate && len(cfg.TrustAnchors) == 0 {
+		return fmt.Errorf("dnssec: validation needs at least one trust anchor")
+	}
+	for i, anchor := range cfg.TrustAnchors {
+		rr, err := dnslib.NewRR(anchor)
+		if err != nil {
+			return fmt.Errorf("dnssec: trust anchor %d: %w", i, err)
+		}
+		if _, ok := rr.(*dnslib.DS); ok {
+			continue
+		}
+		if _, ok := rr.(*dnslib.DNSKEY); ok {
+			continue
+		}
+		return fmt.Errorf("dnssec: trust anchor %d must be a DS or DNSKEY record", i)
+	}
+	for i, name := range cfg.NegativeTrustAnchors {
+		if _, ok := dnslib.IsDomainName(name); !ok || name == "" {
+			return fmt.Errorf("dnssec: invalid negative trust anchor %d '%s'", i, name)
+		}
+	}
+
+	if len(cfg.Sign) > 0 && cfg.SignatureValidity < time.Hour {
+		return fmt.Errorf("dnssec: signature_validity must be at least 1h")
+	}
+	seen := make(map[string]bool)
+	for i, zone := range cfg.Sign {
+		if _, ok := dnslib.IsDomainName(zone.Name); !ok || zone.Name == "" {
+			return fmt.Errorf("dnssec: signed zone %d: invalid name '%s'", i, zone.Name)
+		}
+		name := strings.ToLower(dnslib.Fqdn(zone.Name))
+		if seen[name] {
+			return fmt.Errorf("dnssec: signed zone %d: duplicate zone '%s'", i, zone.Name)
+		}
+		seen[name] = true
+		if zone.Algorithm != signingECDSAP256 && zone.Algorithm != signingEd25519 {
+			return fmt.Errorf("dnssec: signed zone %d (%s): unsupported algorithm '%s'", i, zone.Name, zone.Algorithm)
+		}
+	}
+	return nil
+}
+
+// applyUpstreamDefaults fills in optional upstream settings
+func applyUpstreamDefaults(upstreams []UpstreamConfig) {
+	for i := range upstreams {
+		if upstreams[i].Timeout == 0 {
+			upstreams[i].Timeout = defaultUpstreamTimeout
+		}
+	}
+}
+
+// validateBlockingConfig checks blocklist sources and the block response
+func validateBlockingConfig(cfg *BlockingConfig) error {
+	switch cfg.Response {
+	case blockResponseNXDomain, blockResponseZero, blockResponseRefused:
+	default:
+		return fmt.Errorf("blocking: unknown response '%s'", cfg.Response)
+	}
+
+	if cfg.RefreshInterval < 0 {
+		return fmt.Errorf("blocking: refresh_interval must not be negative")
+	}
+
+	names := make(map[string]bool)
+	for i, list := range cfg.Lists {
+		if list.Name == "" {
+			return fmt.Errorf("blocklist %d: name is required", i)
+		}
+		if names[list.Name] {
+			return fmt.Errorf("blocklist %d: duplicate name '%s'", i, list.Name)
+		}
+		names[list.Name] = true
+		if list.Source == "" {
+			return fmt.Errorf("blocklist %d (%s): source is required", i, list.Name)
+		}
+		switch list.Format {
+		case blocklistFormatAuto, blocklistFormatHosts, blocklistFormatDomains, blocklistFormatAdblock:
+		default:
+			return fmt.Errorf("blocklist %d (%s): unknown format '%s'", i, list.Name, list.Format)
+		}
+	}
+
+	return nil
+}
+
+// validateReverseConfig checks PTR overrides and private ranges
+func validateReverseConfig(cfg *ReverseConfig) error {
+	if cfg.Canonical != canonicalFirst && cfg.Canonical != canonicalShortest {
+		return fmt.Errorf("reverse: unknown canonical strategy '%s'", cfg.Canonical)
+	}
+
+	for i, override := range cfg.Overrides {
+		if net.ParseIP(override.IP) == nil {
+			return fmt.Errorf("reverse override %d: invalid IP address '%s'", i, override.IP)
+		}
+		if override.Name == "" {
+			return fmt.Errorf("reverse override %d (%s): name is required", i, override.IP)
+		}
+	}
+
+	for _, cidr := range cfg.PrivateRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("reverse: invalid private range '%s': %w", cidr, err)
 		}
 	}
 
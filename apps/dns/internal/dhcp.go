@@ -0,0 +1,457 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	dnslib "github.com/miekg/dns"
+)
+
+// sourceDHCP attributes records published for DHCP leases
+const sourceDHCP = "dhcp"
+
+// dhcpRecordTTL is short so clients notice when a lease moves or ends
+const dhcpRecordTTL = 300
+
+// dhcpOfferTimeout is how long an offered address is held for the client's REQUEST
+const dhcpOfferTimeout = time.Minute
+
+// dhcpExpiryInterval is how often expired leases are removed
+const dhcpExpiryInterval = 30 * time.Second
+
+// dhcpServer hands out IPv4 leases and reports when the set of published
+// hostnames changes so the local records can be rebuilt
+type dhcpServer struct {
+	cfg      DHCPConfig
+	logger   *telemetry.Logger
+	subnet   *net.IPNet
+	serverIP net.IP
+	router   net.IP
+	dns      []net.IP
+	domain   string
+	// static maps a lowercase MAC address to its pinned lease
+	static map[string]StaticLeaseConfig
+	// reserved are the addresses of static leases, never handed out dynamically
+	reserved map[uint32]bool
+	ranges   [][2]uint32
+	// onChange is called after the published leases changed
+	onChange func()
+	server   *server4.Server
+
+	mu     sync.Mutex
+	leases *leaseStore
+}
+
+func newDHCPServer(cfg DHCPConfig, logger *telemetry.Logger, onChange func()) (*dhcpServer, error) {
+	_, subnet, _ := net.ParseCIDR(cfg.Subnet)
+	d := &dhcpServer{
+		cfg:      cfg,
+		logger:   logger,
+		subnet:   subnet,
+		router:   net.ParseIP(cfg.Router).To4(),
+		domain:   strings.ToLower(dnslib.Fqdn(cfg.Domain)),
+		static:   make(map[string]StaticLeaseConfig),
+		reserved: make(map[uint32]bool),
+		onChange: onChange,
+		leases:   newLeaseStore(cfg.LeaseFile),
+	}
+
+	d.serverIP = net.ParseIP(cfg.ServerIP).To4()
+	if d.serverIP == nil {
+		ip, err := interfaceAddress(cfg.Interface, subnet)
+		if err != nil {
+			return nil, err
+		}
+		d.serverIP = ip
+	}
+	for _, server := range cfg.DNSServers {
+		d.dns = append(d.dns, net.ParseIP(server).To4())
+	}
+	if len(d.dns) == 0 {
+		d.dns = []net.IP{d.serverIP}
+	}
+
+	for _, lease := range cfg.StaticLeases {
+		mac, _ := net.ParseMAC(lease.MAC)
+		d.static[mac.String()] = lease
+		d.reserved[ipToUint32(net.ParseIP(lease.IP))] = true
+	}
+	for _, r := range cfg.Ranges {
+		d.ranges = append(d.ranges, [2]uint32{ipToUint32(net.ParseIP(r.Start)), ipToUint32(net.ParseIP(r.End))})
+	}
+
+	if err := d.leases.load(time.Now()); err != nil {
+		return nil, err
+	}
+	logger.Info("DHCP leases restored:", len(d.leases.byMAC))
+	return d, nil
+}
+
+// interfaceAddress returns the first address of iface inside subnet
+func interfaceAddress(iface string, subnet *net.IPNet) (net.IP, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: %w", err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: failed to read addresses of %s: %w", iface, err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && subnet.Contains(ipNet.IP) {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("dhcp: interface %s has no address in %s, set server_ip", iface, subnet)
+}
+
+// listen binds the DHCP port on the configured interface
+func (d *dhcpServer) listen() error {
+	server, err := server4.NewServer(d.cfg.Interface, &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}, d.handle)
+	if err != nil {
+		return fmt.Errorf("failed to start DHCP server on %s: %w", d.cfg.Interface, err)
+	}
+	d.server = server
+	return nil
+}
+
+// serve answers DHCP requests until close is called
+func (d *dhcpServer) serve() error {
+	err := d.server.Serve()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// run removes expired leases until stop is closed
+func (d *dhcpServer) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(dhcpExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.expireLeases(time.Now())
+		}
+	}
+}
+
+// expireLeases removes the leases that ended before now and unpublishes their hostnames
+func (d *dhcpServer) expireLeases(now time.Time) {
+	d.mu.Lock()
+	expired := d.leases.expire(now)
+	d.mu.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+	for _, lease := range expired {
+		d.logger.Info("DHCP lease expired:", lease.IP, lease.MAC, lease.Hostname)
+	}
+	d.save()
+	d.onChange()
+}
+
+// close stops the listener and persists the leases
+func (d *dhcpServer) close() error {
+	if d.server != nil {
+		if err := d.server.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	d.save()
+	return nil
+}
+
+func (d *dhcpServer) save() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.leases.save(); err != nil {
+		d.logger.Error("Failed to save DHCP leases:", err)
+	}
+}
+
+// activeLeases returns the bound leases that have a hostname
+func (d *dhcpServer) activeLeases() []dhcpLease {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.leases.published(time.Now())
+}
+
+// handle answers one DHCP message
+func (d *dhcpServer) handle(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		return
+	}
+
+	var resp *dhcpv4.DHCPv4
+	changed := false
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		resp = d.offer(req)
+	case dhcpv4.MessageTypeRequest:
+		resp, changed = d.request(req)
+	case dhcpv4.MessageTypeRelease:
+		changed = d.release(req)
+	case dhcpv4.MessageTypeDecline:
+		changed = d.decline(req)
+	case dhcpv4.MessageTypeInform:
+		resp = d.reply(req, dhcpv4.MessageTypeAck, nil)
+	default:
+		return
+	}
+
+	if changed {
+		d.save()
+		d.onChange()
+	}
+	if resp == nil {
+		return
+	}
+	if _, err := conn.WriteTo(resp.ToBytes(), replyAddress(req, resp, peer)); err != nil {
+		d.logger.Error("Failed to send DHCP", resp.MessageType(), "to", req.ClientHWAddr, err)
+	}
+}
+
+// offer reserves an address for a DISCOVER
+func (d *dhcpServer) offer(req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	mac := req.ClientHWAddr.String()
+	now := time.Now()
+
+	d.mu.Lock()
+	ip := d.allocateLocked(mac, req.RequestedIPAddress(), now)
+	if ip != nil {
+		d.leases.offer(mac, ip, now.Add(dhcpOfferTimeout))
+	}
+	d.mu.Unlock()
+
+	if ip == nil {
+		d.logger.Warn("DHCP pool exhausted, no offer for", mac)
+		return nil
+	}
+	d.logger.Info("DHCP offer", ip, "to", mac)
+	return d.reply(req, dhcpv4.MessageTypeOffer, ip)
+}
+
+// request binds the lease a client asks for, or refuses it with a NAK. It
+// reports whether the published leases changed.
+func (d *dhcpServer) request(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	mac := req.ClientHWAddr.String()
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The client accepted another server's offer
+	if id := req.ServerIdentifier(); id != nil && !id.Equal(d.serverIP) {
+		d.leases.dropOffer(mac)
+		return nil, false
+	}
+
+	ip := req.RequestedIPAddress()
+	if ip == nil || ip.IsUnspecified() {
+		ip = req.ClientIPAddr
+	}
+	ip = ip.To4()
+	if ip == nil || !d.availableLocked(mac, ip, now) {
+		d.logger.Warn("DHCP NAK for", mac, "requesting", ip)
+		return d.reply(req, dhcpv4.MessageTypeNak, nil), false
+	}
+
+	hostname := sanitizeHostname(req.HostName())
+	if static, ok := d.static[mac]; ok && static.Hostname != "" {
+		hostname = strings.ToLower(static.Hostname)
+	}
+	if owner := d.leases.hostnameOwner(hostname, now); owner != "" && owner != mac {
+		d.logger.Warn("DHCP hostname", hostname, "requested by", mac, "is already used by", owner)
+		hostname = ""
+	}
+
+	changed := d.leases.bind(dhcpLease{MAC: mac, IP: ip, Hostname: hostname, Expires: now.Add(d.cfg.LeaseTime)})
+	d.logger.Info("DHCP lease", ip, "to", mac, hostname, "for", d.cfg.LeaseTime)
+	return d.reply(req, dhcpv4.MessageTypeAck, ip), changed
+}
+
+// release ends the lease of a client that gives its address back
+func (d *dhcpServer) release(req *dhcpv4.DHCPv4) bool {
+	mac := req.ClientHWAddr.String()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logger.Info("DHCP release of", req.ClientIPAddr, "by", mac)
+	return d.leases.remove(mac)
+}
+
+// decline quarantines an address the client found already in use
+func (d *dhcpServer) decline(req *dhcpv4.DHCPv4) bool {
+	mac := req.ClientHWAddr.String()
+	ip := req.RequestedIPAddress().To4()
+	if ip == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logger.Warn("DHCP decline of", ip, "by", mac, "- address is in use on the network")
+	changed := d.leases.remove(mac)
+	d.leases.quarantine(ip, time.Now().Add(d.cfg.LeaseTime))
+	return changed
+}
+
+// allocateLocked picks the address for mac: its static address, its current
+// or previous lease, the requested address, or the first free one in the ranges
+func (d *dhcpServer) allocateLocked(mac string, requested net.IP, now time.Time) net.IP {
+	if static, ok := d.static[mac]; ok {
+		return net.ParseIP(static.IP).To4()
+	}
+	if lease, ok := d.leases.byMAC[mac]; ok && d.availableLocked(mac, lease.IP, now) {
+		return lease.IP
+	}
+	if requested = requested.To4(); requested != nil && d.availableLocked(mac, requested, now) {
+		return requested
+	}
+	for _, r := range d.ranges {
+		for n := r[0]; n <= r[1] && n >= r[0]; n++ {
+			if ip := uint32ToIP(n); d.availableLocked(mac, ip, now) {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+// availableLocked reports whether mac may lease ip
+func (d *dhcpServer) availableLocked(mac string, ip net.IP, now time.Time) bool {
+	if static, ok := d.static[mac]; ok {
+		return ip.Equal(net.ParseIP(static.IP))
+	}
+	n := ipToUint32(ip)
+	if d.reserved[n] || ip.Equal(d.serverIP) || ip.Equal(d.router) {
+		return false
+	}
+	inRange := false
+	for _, r := range d.ranges {
+		if n >= r[0] && n <= r[1] {
+			inRange = true
+			break
+		}
+	}
+	if !inRange {
+		return false
+	}
+	holder, ok := d.leases.byIP[n]
+	return !ok || holder.MAC == mac || !holder.Expires.After(now)
+}
+
+// reply builds an OFFER, ACK or NAK. yourIP is nil for NAK and INFORM replies.
+func (d *dhcpServer) reply(req *dhcpv4.DHCPv4, messageType dhcpv4.MessageType, yourIP net.IP) *dhcpv4.DHCPv4 {
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(messageType),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(d.serverIP)),
+	}
+	if messageType != dhcpv4.MessageTypeNak {
+		modifiers = append(modifiers,
+			dhcpv4.WithNetmask(d.subnet.Mask),
+			dhcpv4.WithDNS(d.dns...),
+			dhcpv4.WithOption(dhcpv4.OptDomainName(strings.TrimSuffix(d.domain, "."))),
+		)
+		if d.router != nil {
+			modifiers = append(modifiers, dhcpv4.WithRouter(d.router))
+		}
+	}
+	if yourIP != nil {
+		modifiers = append(modifiers,
+			dhcpv4.WithYourIP(yourIP),
+			dhcpv4.WithLeaseTime(uint32(d.cfg.LeaseTime/time.Second)),
+		)
+	}
+
+	resp, err := dhcpv4.NewReplyFromRequest(req, modifiers...)
+	if err != nil {
+		d.logger.Error("Failed to build DHCP reply:", err)
+		return nil
+	}
+	return resp
+}
+
+// replyAddress follows RFC 2131 section 4.1: replies go to the relay agent,
+// to a client that already has an address, or are broadcast
+func replyAddress(req, resp *dhcpv4.DHCPv4, peer net.Addr) net.Addr {
+	switch {
+	case !req.GatewayIPAddr.IsUnspecified() && req.GatewayIPAddr != nil:
+		return &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	case resp.MessageType() == dhcpv4.MessageTypeNak:
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	case !req.ClientIPAddr.IsUnspecified() && req.ClientIPAddr != nil:
+		return peer
+	default:
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	}
+}
+
+// addDHCPLeases publishes A records for the hostnames of active leases. PTR
+// records are added as well unless an address already has one.
+func (b *recordSetBuilder) addDHCPLeases(leases []dhcpLease, domain string) {
+	for _, lease := range leases {
+		name := lease.Hostname + "." + domain
+		b.add(&dnslib.A{
+			Hdr: dnslib.RR_Header{Name: name, Rrtype: dnslib.TypeA, Class: dnslib.ClassINET, Ttl: dhcpRecordTTL},
+			A:   lease.IP,
+		}, sourceDHCP)
+
+		reverse, err := dnslib.ReverseAddr(lease.IP.String())
+		if err != nil {
+			continue
+		}
+		if _, exists := b.owners[recordKey{name: reverse, rrtype: dnslib.TypePTR}]; exists {
+			continue
+		}
+		b.add(&dnslib.PTR{
+			Hdr: dnslib.RR_Header{Name: reverse, Rrtype: dnslib.TypePTR, Class: dnslib.ClassINET, Ttl: dhcpRecordTTL},
+			Ptr: name,
+		}, sourceDHCP)
+	}
+	if len(leases) > 0 {
+		b.logger.Info("Published DHCP leases:", len(leases))
+	}
+}
+
+// sanitizeHostname turns a client supplied hostname into a lowercase DNS
+// label; characters outside [a-z0-9-] become hyphens
+func sanitizeHostname(hostname string) string {
+	// Some clients send their FQDN
+	hostname, _, _ = strings.Cut(strings.ToLower(hostname), ".")
+	label := []byte(hostname)
+	for i, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			label[i] = '-'
+		}
+	}
+	hostname = strings.Trim(string(label), "-")
+	if len(hostname) > 63 {
+		hostname = strings.TrimRight(hostname[:63], "-")
+	}
+	return hostname
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip4)
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
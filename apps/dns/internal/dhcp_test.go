@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	dnslib "github.com/miekg/dns"
+)
+
+var (
+	testMAC1 = "02:00:00:00:00:01"
+	testMAC2 = "02:00:00:00:00:02"
+)
+
+func TestLeaseStoreBindTakesOverOffer(t *testing.T) {
+	ls := newLeaseStore("")
+	now := time.Now()
+	ip := net.ParseIP("192.168.1.50")
+
+	ls.offer(testMAC1, ip, now.Add(time.Minute))
+	if !ls.bind(dhcpLease{MAC: testMAC2, IP: ip, Hostname: "b", Expires: now.Add(time.Hour)}) {
+		t.Errorf("first bind of %s reported no change", testMAC2)
+	}
+	if _, ok := ls.byMAC[testMAC1]; ok {
+		t.Errorf("offer to %s survived the takeover of its address", testMAC1)
+	}
+	if holder := ls.byIP[ipToUint32(ip)]; holder == nil || holder.MAC != testMAC2 {
+		t.Errorf("address held by %v, want %s", holder, testMAC2)
+	}
+	if ls.bind(dhcpLease{MAC: testMAC2, IP: ip, Hostname: "b", Expires: now.Add(2 * time.Hour)}) {
+		t.Errorf("renewal with the same address and hostname reported a change")
+	}
+
+	// A new offer for the bound address keeps the lease
+	ls.offer(testMAC2, ip, now.Add(time.Minute))
+	if lease := ls.byMAC[testMAC2]; lease.Offered || lease.Hostname != "b" {
+		t.Errorf("offer replaced the bound lease: %+v", lease)
+	}
+}
+
+func TestLeaseStoreExpire(t *testing.T) {
+	ls := newLeaseStore("")
+	now := time.Now()
+	ls.bind(dhcpLease{MAC: testMAC1, IP: net.ParseIP("192.168.1.50"), Hostname: "a", Expires: now.Add(time.Minute)})
+	ls.bind(dhcpLease{MAC: testMAC2, IP: net.ParseIP("192.168.1.51"), Expires: now.Add(time.Minute)})
+	ls.offer("02:00:00:00:00:03", net.ParseIP("192.168.1.52"), now.Add(time.Minute))
+	ls.quarantine(net.ParseIP("192.168.1.53"), now.Add(time.Minute))
+	ls.bind(dhcpLease{MAC: "02:00:00:00:00:04", IP: net.ParseIP("192.168.1.54"), Hostname: "d", Expires: now.Add(time.Hour)})
+
+	if expired := ls.expire(now); len(expired) != 0 {
+		t.Errorf("expire before the end of the leases = %v", expired)
+	}
+	expired := ls.expire(now.Add(2 * time.Minute))
+	if len(expired) != 1 || expired[0].Hostname != "a" {
+		t.Errorf("expire = %v, want only the published lease a", expired)
+	}
+	if len(ls.byMAC) != 1 || len(ls.byIP) != 1 {
+		t.Errorf("after expiry byMAC=%d byIP=%d, want the one active lease", len(ls.byMAC), len(ls.byIP))
+	}
+}
+
+func TestLeaseStoreSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leases.json")
+	now := time.Now()
+	ls := newLeaseStore(file)
+	ls.bind(dhcpLease{MAC: testMAC1, IP: net.ParseIP("192.168.1.50"), Hostname: "a", Expires: now.Add(time.Hour)})
+	ls.bind(dhcpLease{MAC: testMAC2, IP: net.ParseIP("192.168.1.51"), Hostname: "b", Expires: now.Add(time.Minute)})
+	ls.offer("02:00:00:00:00:03", net.ParseIP("192.168.1.52"), now.Add(time.Minute))
+	if err := ls.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	restored := newLeaseStore(file)
+	if err := restored.load(now.Add(30 * time.Minute)); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	leases := restored.published(now.Add(30 * time.Minute))
+	if len(leases) != 1 || leases[0].MAC != testMAC1 || !leases[0].IP.Equal(net.ParseIP("192.168.1.50")) || leases[0].Hostname != "a" {
+		t.Errorf("restored leases = %v, want only the unexpired lease of %s", leases, testMAC1)
+	}
+	if _, ok := restored.byMAC["02:00:00:00:00:03"]; ok {
+		t.Errorf("offer was persisted")
+	}
+}
+
+// testPacketConn records the packets written to it
+type testPacketConn struct {
+	net.PacketConn
+	sent []*dhcpv4.DHCPv4
+}
+
+func (c *testPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	msg, err := dhcpv4.FromBytes(b)
+	if err != nil {
+		return 0, err
+	}
+	c.sent = append(c.sent, msg)
+	return len(b), nil
+}
+
+// exchange hands req to the server and returns its single reply
+func (c *testPacketConn) exchange(t *testing.T, d *dhcpServer, req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+	c.sent = nil
+	d.handle(c, &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}, req)
+	if len(c.sent) != 1 {
+		t.Fatalf("%s got %d replies, want 1", req.MessageType(), len(c.sent))
+	}
+	return c.sent[0]
+}
+
+func newTestDHCPServer(t *testing.T) (*Server, *dhcpServer) {
+	t.Helper()
+	logger := telemetry.NewLogger("/dev/null", "test")
+	cfg := &DNSConfig{
+		DHCP: DHCPConfig{
+			ServerIP:  "192.168.1.1",
+			Subnet:    "192.168.1.0/24",
+			Ranges:    []DHCPRangeConfig{{Start: "192.168.1.100", End: "192.168.1.101"}},
+			LeaseTime: time.Hour,
+			Domain:    "lan",
+		},
+		Cache: CacheConfig{Disabled: true},
+	}
+	s := NewServer(cfg, logger)
+	d, err := newDHCPServer(cfg.DHCP, logger, func() {
+		if err := s.reloadRecords(); err != nil {
+			t.Errorf("reloadRecords: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("newDHCPServer: %v", err)
+	}
+	s.dhcp = d
+	if err := s.reloadRecords(); err != nil {
+		t.Fatalf("reloadRecords: %v", err)
+	}
+	return s, d
+}
+
+func TestDHCPLeasePublishesRecords(t *testing.T) {
+	s, d := newTestDHCPServer(t)
+	conn := &testPacketConn{}
+	mac, _ := net.ParseMAC(testMAC1)
+
+	discover, err := dhcpv4.NewDiscovery(mac)
+	if err != nil {
+		t.Fatalf("NewDiscovery: %v", err)
+	}
+	offer := conn.exchange(t, d, discover)
+	if offer.MessageType() != dhcpv4.MessageTypeOffer || !offer.YourIPAddr.Equal(net.ParseIP("192.168.1.100")) {
+		t.Fatalf("got %s of %s, want OFFER of 192.168.1.100", offer.MessageType(), offer.YourIPAddr)
+	}
+
+	request, err := dhcpv4.NewRequestFromOffer(offer, dhcpv4.WithOption(dhcpv4.OptHostName("Laptop")))
+	if err != nil {
+		t.Fatalf("NewRequestFromOffer: %v", err)
+	}
+	ack := conn.exchange(t, d, request)
+	if ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(offer.YourIPAddr) {
+		t.Fatalf("got %s of %s, want ACK of %s", ack.MessageType(), ack.YourIPAddr, offer.YourIPAddr)
+	}
+
+	records, ok := s.records.Load().lookup("laptop.lan.")
+	if !ok || len(records) != 1 || !records[0].(*dnslib.A).A.Equal(ack.YourIPAddr) {
+		t.Fatalf("laptop.lan. A = %v, want %s", records, ack.YourIPAddr)
+	}
+	records, ok = s.records.Load().lookup("100.1.168.192.in-addr.arpa.")
+	if !ok || len(records) != 1 || records[0].(*dnslib.PTR).Ptr != "laptop.lan." {
+		t.Fatalf("PTR of 192.168.1.100 = %v, want laptop.lan.", records)
+	}
+
+	d.expireLeases(time.Now().Add(2 * time.Hour))
+	if records, ok := s.records.Load().lookup("laptop.lan."); ok {
+		t.Errorf("laptop.lan. still published after expiry: %v", records)
+	}
+	if records, ok := s.records.Load().lookup("100.1.168.192.in-addr.arpa."); ok {
+		t.Errorf("PTR of 192.168.1.100 still published after expiry: %v", records)
+	}
+}
+
+func TestDHCPDeclineQuarantinesAddress(t *testing.T) {
+	_, d := newTestDHCPServer(t)
+	conn := &testPacketConn{}
+	mac, _ := net.ParseMAC(testMAC1)
+
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	offer := conn.exchange(t, d, discover)
+	decline, err := dhcpv4.NewRequestFromOffer(offer, dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline))
+	if err != nil {
+		t.Fatalf("NewRequestFromOffer: %v", err)
+	}
+	d.handle(conn, &net.UDPAddr{}, decline)
+
+	other, _ := net.ParseMAC(testMAC2)
+	discover, _ = dhcpv4.NewDiscovery(other)
+	if offer := conn.exchange(t, d, discover); !offer.YourIPAddr.Equal(net.ParseIP("192.168.1.101")) {
+		t.Errorf("offer after decline = %s, want 192.168.1.101", offer.YourIPAddr)
+	}
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// dhcpLease is an address bound to a client, or offered to it while Offered is set
+type dhcpLease struct {
+	MAC      string    `json:"mac"`
+	IP       net.IP    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  time.Time `json:"expires"`
+	Offered  bool      `json:"-"`
+}
+
+// leaseStore indexes leases by MAC and address. Quarantined addresses
+// (declined by a client) are held in byIP without an owner.
+type leaseStore struct {
+	file  string
+	byMAC map[string]*dhcpLease
+	byIP  map[uint32]*dhcpLease
+}
+
+func newLeaseStore(file string) *leaseStore {
+	return &leaseStore{
+		file:  file,
+		byMAC: make(map[string]*dhcpLease),
+		byIP:  make(map[uint32]*dhcpLease),
+	}
+}
+
+// load restores unexpired leases from the lease file, if there is one
+func (ls *leaseStore) load(now time.Time) error {
+	if ls.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(ls.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read DHCP lease file: %w", err)
+	}
+
+	var leases []dhcpLease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("failed to parse DHCP lease file %s: %w", ls.file, err)
+	}
+	for _, lease := range leases {
+		if lease.IP.To4() != nil && lease.Expires.After(now) {
+			ls.bind(lease)
+		}
+	}
+	return nil
+}
+
+// save writes the bound leases to the lease file, replacing it atomically
+func (ls *leaseStore) save() error {
+	if ls.file == "" {
+		return nil
+	}
+	leases := []dhcpLease{}
+	for _, lease := range ls.byMAC {
+		if !lease.Offered {
+			leases = append(leases, *lease)
+		}
+	}
+	sortLeases(leases)
+
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(ls.file), ".leases-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), ls.file)
+}
+
+// bind stores a lease for its MAC, replacing any previous lease of that client.
+// It reports whether the published address or hostname changed.
+func (ls *leaseStore) bind(lease dhcpLease) bool {
+	lease.IP = lease.IP.To4()
+	previous, ok := ls.byMAC[lease.MAC]
+	changed := !ok || previous.Offered || !previous.IP.Equal(lease.IP) || previous.Hostname != lease.Hostname
+	if ok {
+		ls.removeLease(previous)
+	}
+	if holder, ok := ls.byIP[ipToUint32(lease.IP)]; ok {
+		ls.removeLease(holder)
+	}
+	ls.byMAC[lease.MAC] = &lease
+	ls.byIP[ipToUint32(lease.IP)] = &lease
+	return changed
+}
+
+// offer holds ip for mac until expires. A bound lease of mac for the same
+// address is kept as is.
+func (ls *leaseStore) offer(mac string, ip net.IP, expires time.Time) {
+	if lease, ok := ls.byMAC[mac]; ok && !lease.Offered && lease.IP.Equal(ip) {
+		return
+	}
+	ls.bind(dhcpLease{MAC: mac, IP: ip, Expires: expires, Offered: true})
+}
+
+// dropOffer forgets an offer the client did not take
+func (ls *leaseStore) dropOffer(mac string) {
+	if lease, ok := ls.byMAC[mac]; ok && lease.Offered {
+		ls.removeLease(lease)
+	}
+}
+
+// remove ends the lease of mac and reports whether a published lease ended
+func (ls *leaseStore) remove(mac string) bool {
+	lease, ok := ls.byMAC[mac]
+	if !ok {
+		return false
+	}
+	ls.removeLease(lease)
+	return !lease.Offered && lease.Hostname != ""
+}
+
+// quarantine keeps ip from being leased until expires
+func (ls *leaseStore) quarantine(ip net.IP, expires time.Time) {
+	ls.byIP[ipToUint32(ip)] = &dhcpLease{IP: ip, Expires: expires}
+}
+
+func (ls *leaseStore) removeLease(lease *dhcpLease) {
+	if ls.byMAC[lease.MAC] == lease {
+		delete(ls.byMAC, lease.MAC)
+	}
+	if n := ipToUint32(lease.IP); ls.byIP[n] == lease {
+		delete(ls.byIP, n)
+	}
+}
+
+// expire removes leases and quarantines that ended before now and returns
+// the published leases among them
+func (ls *leaseStore) expire(now time.Time) []dhcpLease {
+	var expired []dhcpLease
+	for _, lease := range ls.byIP {
+		if lease.Expires.After(now) {
+			continue
+		}
+		ls.removeLease(lease)
+		if lease.MAC != "" && !lease.Offered && lease.Hostname != "" {
+			expired = append(expired, *lease)
+		}
+	}
+	// Offers whose address was taken over are only indexed by MAC
+	for _, lease := range ls.byMAC {
+		if !lease.Expires.After(now) {
+			ls.removeLease(lease)
+		}
+	}
+	sortLeases(expired)
+	return expired
+}
+
+// hostnameOwner returns the MAC of the active lease using hostname, if any
+func (ls *leaseStore) hostnameOwner(hostname string, now time.Time) string {
+	if hostname == "" {
+		return ""
+	}
+	for _, lease := range ls.byMAC {
+		if lease.Hostname == hostname && !lease.Offered && lease.Expires.After(now) {
+			return lease.MAC
+		}
+	}
+	return ""
+}
+
+// published returns the active bound leases with a hostname, ordered by address
+func (ls *leaseStore) published(now time.Time) []dhcpLease {
+	var leases []dhcpLease
+	for _, lease := range ls.byMAC {
+		if !lease.Offered && lease.Hostname != "" && lease.Expires.After(now) {
+			leases = append(leases, *lease)
+		}
+	}
+	sortLeases(leases)
+	return leases
+}
+
+func sortLeases(leases []dhcpLease) {
+	sort.Slice(leases, func(i, j int) bool {
+		return ipToUint32(leases[i].IP) < ipToUint32(leases[j].IP)
+	})
+}
@@ -0,0 +1,867 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// securityState is the DNSSEC validation outcome (RFC 4035 section 4.3)
+type securityState int
+
+const (
+	stateInsecure securityState = iota
+	stateSecure
+	stateBogus
+)
+
+func (st securityState) String() string {
+	switch st {
+	case stateSecure:
+		return "secure"
+	case stateBogus:
+		return "bogus"
+	default:
+		return "insecure"
+	}
+}
+
+// validationTimeout bounds the whole chain-of-trust walk for one answer
+const validationTimeout = 10 * time.Second
+
+// maxValidatorCacheTTL caps how long validated keys and DS sets are reused
+const maxValidatorCacheTTL = time.Hour
+
+// bogusCacheTTL is how long failures are remembered to avoid query storms
+const bogusCacheTTL = 30 * time.Second
+
+// maxValidatorCacheEntries triggers pruning of expired cache entries
+const maxValidatorCacheEntries = 10000
+
+// keyEntry is a cached DNSKEY lookup
+type keyEntry struct {
+	keys    []*dnslib.DNSKEY
+	state   securityState
+	reason  string
+	expires time.Time
+}
+
+// dsEntry is a cached DS lookup. noCut is set when the name is provably not a
+// delegation point, so the walk continues below it within the same zone.
+type dsEntry struct {
+	ds      []*dnslib.DS
+	state   securityState
+	noCut   bool
+	reason  string
+	expires time.Time
+}
+
+// validator checks forwarded answers against a chain of trust that starts at
+// the configured trust anchors. It asks upstreams for DNSKEY and DS records
+// itself, with CD set so upstream validation cannot hide bogus data.
+type validator struct {
+	server   *Server
+	anchors  map[string][]dnslib.RR
+	negative []string
+
+	mu   sync.Mutex
+	keys map[string]*keyEntry
+	ds   map[string]*dsEntry
+}
+
+func newValidator(server *Server, cfg DNSSECConfig) *validator {
+	v := &validator{
+		server:  server,
+		anchors: make(map[string][]dnslib.RR),
+		keys:    make(map[string]*keyEntry),
+		ds:      make(map[string]*dsEntry),
+	}
+
+	for _, anchor := range cfg.TrustAnchors {
+		// Anchors were checked when the config was loaded
+		rr, err := dnslib.NewRR(anchor)
+		if err != nil || rr == nil {
+			continue
+		}
+		zone := strings.ToLower(dnslib.Fqdn(rr.Header().Name))
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	for _, name := range cfg.NegativeTrustAnchors {
+		v.negative = append(v.negative, strings.ToLower(dnslib.Fqdn(name)))
+	}
+
+	return v
+}
+
+// isNegative reports whether name is covered by a negative trust anchor
+func (v *validator) isNegative(name string) bool {
+	name = strings.ToLower(dnslib.Fqdn(name))
+	for _, nta := range v.negative {
+		if dnslib.IsSubDomain(nta, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// anchorFor returns the closest trust anchor zone at or above name, or "" if none
+func (v *validator) anchorFor(name string) string {
+	name = strings.ToLower(dnslib.Fqdn(name))
+	best, bestLabels := "", -1
+	for zone := range v.anchors {
+		if dnslib.IsSubDomain(zone, name) && dnslib.CountLabel(zone) > bestLabels {
+			best, bestLabels = zone, dnslib.CountLabel(zone)
+		}
+	}
+	return best
+}
+
+// dnssecOK reports whether the client set the DO bit
+func dnssecOK(r *dnslib.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// prepareQuery sets DO and CD on an upstream query so signatures come back unfiltered
+func prepareQuery(m *dnslib.Msg) {
+	m.CheckingDisabled = true
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+		return
+	}
+	m.SetEdns0(ednsUDPSize, true)
+}
+
+// query fetches name/qtype from the upstreams responsible for name
+func (v *validator) query(ctx context.Context, name string, qtype uint16) (*dnslib.Msg, error) {
+	m := new(dnslib.Msg)
+	m.SetQuestion(name, qtype)
+	prepareQuery(m)
+
+	pool, _ := v.server.poolFor(name, nil)
+	resp, _, err := v.server.forward(ctx, m, pool)
+	return resp, err
+}
+
+// validateResponse checks every RRset of a forwarded response
+func (v *validator) validateResponse(ctx context.Context, q dnslib.Question, resp *dnslib.Msg) (securityState, string) {
+	ctx, cancel := context.WithTimeout(ctx, validationTimeout)
+	defer cancel()
+
+	if resp.Rcode != dnslib.RcodeSuccess && resp.Rcode != dnslib.RcodeNameError {
+		return stateInsecure, ""
+	}
+
+	result := stateSecure
+	sets, sigs := splitRRsets(resp.Answer)
+	expanded := make(map[string]uint8)
+	for key, set := range sets {
+		state, reason := v.validateRRset(ctx, key, set, sigs[key])
+		switch state {
+		case stateBogus:
+			return stateBogus, reason
+		case stateInsecure:
+			result = stateInsecure
+		case stateSecure:
+			if labels, ok := wildcardLabels(key.name, sigs[key]); ok {
+				expanded[key.name] = labels
+			}
+		}
+	}
+
+	if len(expanded) > 0 {
+		proof, state, reason := v.denialRecords(ctx, resp.Ns)
+		if state != stateSecure {
+			return state, reason
+		}
+		for owner, labels := range expanded {
+			switch state, reason := proveWildcardExpansion(owner, labels, proof); state {
+			case stateBogus:
+				return stateBogus, reason
+			case stateInsecure:
+				result = stateInsecure
+			}
+		}
+	}
+
+	if len(sets) == 0 {
+		state, reason := v.validateDenial(ctx, q, q.Name, resp)
+		if state != stateSecure {
+			return state, reason
+		}
+	}
+
+	return result, ""
+}
+
+// validateRRset verifies one RRset, or proves that its zone is unsigned
+func (v *validator) validateRRset(ctx context.Context, key recordKey, set []dnslib.RR, sigs []*dnslib.RRSIG) (securityState, string) {
+	if len(sigs) == 0 {
+		state, reason := v.zoneSecurity(ctx, key.name)
+		if state == stateSecure {
+			return stateBogus, "missing RRSIG for " + key.name + " " + dnslib.TypeToString[key.rrtype]
+		}
+		return state, reason
+	}
+	return v.verifyRRset(ctx, set, sigs)
+}
+
+// validateDenial checks a negative answer: the authority records must be
+// signed and prove the denial with NSEC or NSEC3 records. Unsigned answers
+// are accepted when owner lies in an insecure zone.
+func (v *validator) validateDenial(ctx context.Context, q dnslib.Question, owner string, resp *dnslib.Msg) (securityState, string) {
+	proof, state, reason := v.denialRecords(ctx, resp.Ns)
+	if state != stateSecure {
+		return state, reason
+	}
+
+	if proof.signed == 0 {
+		state, reason := v.zoneSecurity(ctx, owner)
+		if state == stateSecure {
+			return stateBogus, "unsigned negative answer for " + q.Name
+		}
+		return state, reason
+	}
+
+	if len(proof.nsec3s) > 0 {
+		return proveNSEC3Denial(q, resp.Rcode, proof.nsec3s)
+	}
+	return proveNSECDenial(q, resp.Rcode, proof.nsecs)
+}
+
+// denialProof holds the validated NSEC and NSEC3 records of an authority section
+type denialProof struct {
+	signed int // number of signed RRsets
+	nsecs  []*dnslib.NSEC
+	nsec3s []*dnslib.NSEC3
+}
+
+// denialRecords verifies the signed RRsets of an authority section and
+// collects their NSEC and NSEC3 records
+func (v *validator) denialRecords(ctx context.Context, section []dnslib.RR) (denialProof, securityState, string) {
+	var proof denialProof
+	sets, sigs := splitRRsets(section)
+	for key, set := range sets {
+		if len(sigs[key]) == 0 {
+			continue
+		}
+		proof.signed++
+
+		state, reason := v.verifyRRset(ctx, set, sigs[key])
+		if state != stateSecure {
+			return proof, state, reason
+		}
+		for _, rr := range set {
+			switch denial := rr.(type) {
+			case *dnslib.NSEC:
+				proof.nsecs = append(proof.nsecs, denial)
+			case *dnslib.NSEC3:
+				proof.nsec3s = append(proof.nsec3s, denial)
+			}
+		}
+	}
+	return proof, stateSecure, ""
+}
+
+// wildcardLabels reports whether the RRset at owner was synthesized from a
+// wildcard: its RRSIG labels count is below that of the owner name, not
+// counting a leading "*" (RFC 4035 section 5.3.2). It returns the labels of
+// the wildcard's closest encloser; with several RRSIGs the lowest count wins,
+// so an added signature cannot hide an expansion.
+func wildcardLabels(owner string, sigs []*dnslib.RRSIG) (uint8, bool) {
+	ownerLabels := dnslib.CountLabel(owner)
+	if strings.HasPrefix(owner, "*.") {
+		ownerLabels--
+	}
+	labels, expanded := uint8(0), false
+	for _, sig := range sigs {
+		if int(sig.Labels) < ownerLabels && (!expanded || sig.Labels < labels) {
+			labels, expanded = sig.Labels, true
+		}
+	}
+	return labels, expanded
+}
+
+// proveWildcardExpansion checks that a wildcard answer at owner comes with
+// the proof that owner itself does not exist: an NSEC covering it (RFC 4035
+// section 5.3.4), or an NSEC3 covering the next closer name below the
+// closest encloser (RFC 5155 section 8.8)
+func proveWildcardExpansion(owner string, labels uint8, proof denialProof) (securityState, string) {
+	owner = strings.ToLower(owner)
+	if len(proof.nsec3s) > 0 {
+		names := dnslib.SplitDomainName(owner)
+		nextCloser := strings.Join(names[len(names)-int(labels)-1:], ".") + "."
+		cover := coveringNSEC3(proof.nsec3s, nextCloser)
+		if cover == nil {
+			return stateBogus, "missing NSEC3 proof that " + nextCloser + " does not exist for wildcard answer " + owner
+		}
+		if cover.Flags&1 == 1 {
+			return stateInsecure, ""
+		}
+		return stateSecure, ""
+	}
+	if coveringNSEC(proof.nsecs, owner) == nil {
+		return stateBogus, "missing NSEC proof that " + owner + " does not exist for wildcard answer"
+	}
+	return stateSecure, ""
+}
+
+// verifyRRset checks that at least one RRSIG over set verifies with a validated key
+func (v *validator) verifyRRset(ctx context.Context, set []dnslib.RR, sigs []*dnslib.RRSIG) (securityState, string) {
+	owner := strings.ToLower(set[0].Header().Name)
+	reason := "no valid signature for " + owner + " " + dnslib.TypeToString[set[0].Header().Rrtype]
+
+	for _, sig := range sigs {
+		signer := strings.ToLower(dnslib.Fqdn(sig.SignerName))
+		if !dnslib.IsSubDomain(signer, owner) {
+			reason = "signer " + signer + " is not an ancestor of " + owner
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			reason = "signature for " + owner + " is expired or not yet valid"
+			continue
+		}
+
+		keys, state, keyReason := v.dnskeys(ctx, signer)
+		switch state {
+		case stateInsecure:
+			return stateInsecure, ""
+		case stateBogus:
+			reason = keyReason
+			continue
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set) == nil {
+				return stateSecure, ""
+			}
+		}
+	}
+	return stateBogus, reason
+}
+
+// dnskeys returns the validated DNSKEY set of zone
+func (v *validator) dnskeys(ctx context.Context, zone string) ([]*dnslib.DNSKEY, securityState, string) {
+	zone = strings.ToLower(dnslib.Fqdn(zone))
+
+	v.mu.Lock()
+	if entry, ok := v.keys[zone]; ok && time.Now().Before(entry.expires) {
+		v.mu.Unlock()
+		return entry.keys, entry.state, entry.reason
+	}
+	v.mu.Unlock()
+
+	keys, state, reason, ttl := v.fetchDNSKEYs(ctx, zone)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.keys) > maxValidatorCacheEntries {
+		v.pruneLocked()
+	}
+	v.keys[zone] = &keyEntry{keys: keys, state: state, reason: reason, expires: time.Now().Add(ttl)}
+	return keys, state, reason
+}
+
+// fetchDNSKEYs queries and validates the DNSKEY set of zone against its DS
+// records, or against the trust anchor when zone is an anchor itself
+func (v *validator) fetchDNSKEYs(ctx context.Context, zone string) ([]*dnslib.DNSKEY, securityState, string, time.Duration) {
+	anchor := v.anchorFor(zone)
+	if anchor == "" {
+		return nil, stateInsecure, "", maxValidatorCacheTTL
+	}
+
+	var trusted func(*dnslib.DNSKEY) bool
+	if zone == anchor {
+		anchors := v.anchors[anchor]
+		trusted = func(key *dnslib.DNSKEY) bool { return matchesAnchor(key, anchors) }
+	} else {
+		ds, state, noCut, reason := v.dsRecords(ctx, zone)
+		switch {
+		case state == stateInsecure:
+			return nil, stateInsecure, "", maxValidatorCacheTTL
+		case state == stateBogus:
+			return nil, stateBogus, reason, bogusCacheTTL
+		case noCut || len(ds) == 0:
+			return nil, stateBogus, "no DS records for signer zone " + zone, bogusCacheTTL
+		}
+		trusted = func(key *dnslib.DNSKEY) bool { return matchesAnyDS(key, ds) }
+	}
+
+	resp, err := v.query(ctx, zone, dnslib.TypeDNSKEY)
+	if err != nil {
+		return nil, stateBogus, "failed to fetch DNSKEY for " + zone + ": " + err.Error(), bogusCacheTTL
+	}
+
+	sets, sigs := splitRRsets(resp.Answer)
+	key := recordKey{name: zone, rrtype: dnslib.TypeDNSKEY}
+	set := sets[key]
+	if len(set) == 0 {
+		return nil, stateBogus, "no DNSKEY records for " + zone, bogusCacheTTL
+	}
+
+	var keys []*dnslib.DNSKEY
+	for _, rr := range set {
+		if k, ok := rr.(*dnslib.DNSKEY); ok {
+			keys = append(keys, k)
+		}
+	}
+
+	// The DNSKEY set must be self-signed by a key vouched for by the DS set or anchor
+	for _, sig := range sigs[key] {
+		if !sig.ValidityPeriod(time.Now()) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && trusted(k) && sig.Verify(k, set) == nil {
+				return keys, stateSecure, "", cacheTTL(set)
+			}
+		}
+	}
+	return nil, stateBogus, "DNSKEY set of " + zone + " is not signed by a trusted key", bogusCacheTTL
+}
+
+// dsRecords returns the validated DS set of name, or proves there is none
+func (v *validator) dsRecords(ctx context.Context, name string) ([]*dnslib.DS, securityState, bool, string) {
+	name = strings.ToLower(dnslib.Fqdn(name))
+
+	v.mu.Lock()
+	if entry, ok := v.ds[name]; ok && time.Now().Before(entry.expires) {
+		v.mu.Unlock()
+		return entry.ds, entry.state, entry.noCut, entry.reason
+	}
+	v.mu.Unlock()
+
+	entry := v.fetchDS(ctx, name)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.ds) > maxValidatorCacheEntries {
+		v.pruneLocked()
+	}
+	v.ds[name] = entry
+	return entry.ds, entry.state, entry.noCut, entry.reason
+}
+
+// fetchDS queries the DS set of name from the parent zone
+func (v *validator) fetchDS(ctx context.Context, name string) *dsEntry {
+	resp, err := v.query(ctx, name, dnslib.TypeDS)
+	if err != nil {
+		return &dsEntry{state: stateBogus, reason: "failed to fetch DS for " + name + ": " + err.Error(), expires: time.Now().Add(bogusCacheTTL)}
+	}
+
+	sets, sigs := splitRRsets(resp.Answer)
+	key := recordKey{name: name, rrtype: dnslib.TypeDS}
+	if set := sets[key]; len(set) > 0 {
+		state, reason := v.validateRRset(ctx, key, set, sigs[key])
+		if state != stateSecure {
+			return &dsEntry{state: state, reason: reason, expires: time.Now().Add(bogusCacheTTL)}
+		}
+		var ds []*dnslib.DS
+		for _, rr := range set {
+			if d, ok := rr.(*dnslib.DS); ok {
+				ds = append(ds, d)
+			}
+		}
+		return &dsEntry{ds: ds, state: stateSecure, expires: time.Now().Add(cacheTTL(set))}
+	}
+
+	// No DS: the denial must be validly signed by the parent zone
+	q := dnslib.Question{Name: name, Qtype: dnslib.TypeDS, Qclass: dnslib.ClassINET}
+	parent := "."
+	if i, end := dnslib.NextLabel(name, 0); !end {
+		parent = name[i:]
+	}
+	state, reason := v.validateDenial(ctx, q, parent, resp)
+	if state != stateSecure {
+		return &dsEntry{state: state, reason: reason, expires: time.Now().Add(bogusCacheTTL)}
+	}
+
+	// A matching NSEC/NSEC3 with NS but without DS marks an insecure delegation;
+	// an opt-out NSEC3 may hide one as well
+	entry := &dsEntry{state: stateSecure, noCut: true, expires: time.Now().Add(cacheTTL(resp.Ns))}
+	for _, rr := range resp.Ns {
+		switch denial := rr.(type) {
+		case *dnslib.NSEC:
+			if strings.EqualFold(denial.Hdr.Name, name) && hasType(denial.TypeBitMap, dnslib.TypeNS) {
+				entry.state, entry.noCut = stateInsecure, false
+			}
+		case *dnslib.NSEC3:
+			if denial.Match(name) && hasType(denial.TypeBitMap, dnslib.TypeNS) {
+				entry.state, entry.noCut = stateInsecure, false
+			} else if denial.Cover(name) && denial.Flags&1 == 1 {
+				entry.state, entry.noCut = stateInsecure, false
+			}
+		}
+	}
+	return entry
+}
+
+// zoneSecurity walks down from the trust anchor to name and reports whether an
+// insecure delegation lies in between
+func (v *validator) zoneSecurity(ctx context.Context, name string) (securityState, string) {
+	name = strings.ToLower(dnslib.Fqdn(name))
+	anchor := v.anchorFor(name)
+	if anchor == "" {
+		return stateInsecure, ""
+	}
+
+	labels := dnslib.SplitDomainName(name)
+	for i := dnslib.CountLabel(anchor) + 1; i <= len(labels); i++ {
+		candidate := strings.Join(labels[len(labels)-i:], ".") + "."
+		_, state, _, reason := v.dsRecords(ctx, candidate)
+		if state != stateSecure {
+			return state, reason
+		}
+	}
+	return stateSecure, ""
+}
+
+// pruneLocked drops expired cache entries; v.mu must be held
+func (v *validator) pruneLocked() {
+	now := time.Now()
+	for zone, entry := range v.keys {
+		if now.After(entry.expires) {
+			delete(v.keys, zone)
+		}
+	}
+	for name, entry := range v.ds {
+		if now.After(entry.expires) {
+			delete(v.ds, name)
+		}
+	}
+}
+
+// splitRRsets groups a section into RRsets and the RRSIGs covering them
+func splitRRsets(section []dnslib.RR) (map[recordKey][]dnslib.RR, map[recordKey][]*dnslib.RRSIG) {
+	sets := make(map[recordKey][]dnslib.RR)
+	sigs := make(map[recordKey][]*dnslib.RRSIG)
+	for _, rr := range section {
+		name := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dnslib.RRSIG); ok {
+			key := recordKey{name: name, rrtype: sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if rr.Header().Rrtype == dnslib.TypeOPT {
+			continue
+		}
+		key := recordKey{name: name, rrtype: rr.Header().Rrtype}
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, sigs
+}
+
+// matchesAnchor reports whether key is one of the configured trust anchors
+func matchesAnchor(key *dnslib.DNSKEY, anchors []dnslib.RR) bool {
+	for _, anchor := range anchors {
+		switch a := anchor.(type) {
+		case *dnslib.DS:
+			if matchesDS(key, a) {
+				return true
+			}
+		case *dnslib.DNSKEY:
+			if a.Algorithm == key.Algorithm && a.Flags == key.Flags && a.PublicKey == key.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesAnyDS reports whether key is referenced by one of the DS records
+func matchesAnyDS(key *dnslib.DNSKEY, ds []*dnslib.DS) bool {
+	for _, d := range ds {
+		if matchesDS(key, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesDS compares the digest of key with a DS record
+func matchesDS(key *dnslib.DNSKEY, ds *dnslib.DS) bool {
+	if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+		return false
+	}
+	computed := key.ToDS(ds.DigestType)
+	return computed != nil && strings.EqualFold(computed.Digest, ds.Digest)
+}
+
+// cacheTTL returns the smallest TTL of rrs, capped by maxValidatorCacheTTL
+func cacheTTL(rrs []dnslib.RR) time.Duration {
+	ttl := maxValidatorCacheTTL
+	for _, rr := range rrs {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ttl
+}
+
+// hasType reports whether an NSEC/NSEC3 type bitmap contains rrtype
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name falls strictly between the NSEC owner and
+// its next name in canonical order (RFC 4034 section 6.1)
+func nsecCovers(nsec *dnslib.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// The last NSEC of a zone wraps around to the apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// proveNSECDenial checks that validated NSEC records prove the NXDOMAIN or
+// NODATA answer for q (RFC 4035 section 5.4): a matching NSEC without the
+// type, or a covering NSEC together with the proof about the wildcard at the
+// closest encloser
+func proveNSECDenial(q dnslib.Question, rcode int, nsecs []*dnslib.NSEC) (securityState, string) {
+	qname := strings.ToLower(dnslib.Fqdn(q.Name))
+
+	if match := matchingNSEC(nsecs, qname); match != nil {
+		if rcode == dnslib.RcodeNameError {
+			return stateBogus, "NSEC proves that " + qname + " exists"
+		}
+		return nodataBitmap(match.TypeBitMap, q.Qtype, qname)
+	}
+
+	cover := coveringNSEC(nsecs, qname)
+	if cover == nil {
+		return stateBogus, "missing NSEC proof for " + qname
+	}
+	// An empty non-terminal has no NSEC of its own; the next name lies below it
+	if rcode == dnslib.RcodeSuccess && dnslib.IsSubDomain(qname, strings.ToLower(cover.NextDomain)) {
+		return stateSecure, ""
+	}
+
+	encloser := commonAncestor(qname, cover.Hdr.Name)
+	if next := commonAncestor(qname, cover.NextDomain); dnslib.CountLabel(next) > dnslib.CountLabel(encloser) {
+		encloser = next
+	}
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+
+	if rcode == dnslib.RcodeNameError {
+		if matchingNSEC(nsecs, wildcard) != nil {
+			return stateBogus, "NSEC proves that wildcard " + wildcard + " exists"
+		}
+		if coveringNSEC(nsecs, wildcard) == nil {
+			return stateBogus, "missing NSEC proof that wildcard " + wildcard + " does not exist"
+		}
+		return stateSecure, ""
+	}
+
+	// NODATA from a wildcard needs the wildcard's own NSEC without the type
+	match := matchingNSEC(nsecs, wildcard)
+	if match == nil {
+		return stateBogus, "missing NSEC for wildcard " + wildcard
+	}
+	return nodataBitmap(match.TypeBitMap, q.Qtype, wildcard)
+}
+
+// matchingNSEC returns the NSEC owned by name
+func matchingNSEC(nsecs []*dnslib.NSEC, name string) *dnslib.NSEC {
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+// coveringNSEC returns an NSEC that covers name. NSECs at a delegation point
+// or DNAME above name cannot deny names below it (RFC 4035 section 5.4).
+func coveringNSEC(nsecs []*dnslib.NSEC, name string) *dnslib.NSEC {
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		owner := strings.ToLower(nsec.Hdr.Name)
+		if dnslib.IsSubDomain(owner, name) && (hasType(nsec.TypeBitMap, dnslib.TypeDNAME) ||
+			(hasType(nsec.TypeBitMap, dnslib.TypeNS) && !hasType(nsec.TypeBitMap, dnslib.TypeSOA))) {
+			continue
+		}
+		return nsec
+	}
+	return nil
+}
+
+// proveNSEC3Denial checks that validated NSEC3 records prove the NXDOMAIN or
+// NODATA answer for q (RFC 5155 sections 8.4 to 8.7). An opt-out NSEC3
+// covering the next closer name only proves an insecure answer.
+func proveNSEC3Denial(q dnslib.Question, rcode int, nsec3s []*dnslib.NSEC3) (securityState, string) {
+	qname := strings.ToLower(dnslib.Fqdn(q.Name))
+
+	if match := matchingNSEC3(nsec3s, qname); match != nil {
+		if rcode == dnslib.RcodeNameError {
+			return stateBogus, "NSEC3 proves that " + qname + " exists"
+		}
+		// NODATA (section 8.5), or no DS at a delegation (section 8.6)
+		return nodataBitmap(match.TypeBitMap, q.Qtype, qname)
+	}
+
+	encloser, cover := nsec3ClosestEncloser(nsec3s, qname)
+	if cover == nil {
+		return stateBogus, "missing NSEC3 closest encloser proof for " + qname
+	}
+	state := stateSecure
+	if cover.Flags&1 == 1 {
+		state = stateInsecure
+	}
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+
+	switch {
+	case rcode == dnslib.RcodeNameError:
+		// Section 8.4: the wildcard at the closest encloser does not exist either
+		if coveringNSEC3(nsec3s, wildcard) == nil {
+			return stateBogus, "missing NSEC3 proof that wildcard " + wildcard + " does not exist"
+		}
+		return state, ""
+	case q.Qtype == dnslib.TypeDS:
+		// Section 8.6: an unsigned delegation under an opt-out span
+		if state != stateInsecure {
+			return stateBogus, "missing NSEC3 for " + qname
+		}
+		return stateInsecure, ""
+	default:
+		// Section 8.7: NODATA from a wildcard needs the wildcard's NSEC3 without the type
+		match := matchingNSEC3(nsec3s, wildcard)
+		if match == nil {
+			return stateBogus, "missing NSEC3 for wildcard " + wildcard
+		}
+		if bitmapState, reason := nodataBitmap(match.TypeBitMap, q.Qtype, wildcard); bitmapState != stateSecure {
+			return bitmapState, reason
+		}
+		return state, ""
+	}
+}
+
+// nsec3ClosestEncloser finds the closest encloser of qname: the longest
+// ancestor with a matching NSEC3 whose next closer name is covered
+// (RFC 5155 section 8.3). It returns the NSEC3 covering the next closer name.
+func nsec3ClosestEncloser(nsec3s []*dnslib.NSEC3, qname string) (string, *dnslib.NSEC3) {
+	next := qname
+	for {
+		i, end := dnslib.NextLabel(next, 0)
+		if end {
+			return "", nil
+		}
+		candidate := next[i:]
+		if match := matchingNSEC3(nsec3s, candidate); match != nil {
+			// A delegation or DNAME cannot be the encloser of names below it
+			if hasType(match.TypeBitMap, dnslib.TypeDNAME) ||
+				(hasType(match.TypeBitMap, dnslib.TypeNS) && !hasType(match.TypeBitMap, dnslib.TypeSOA)) {
+				return "", nil
+			}
+			return candidate, coveringNSEC3(nsec3s, next)
+		}
+		next = candidate
+	}
+}
+
+// matchingNSEC3 returns the NSEC3 whose hashed owner matches name
+func matchingNSEC3(nsec3s []*dnslib.NSEC3, name string) *dnslib.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Hash == dnslib.SHA1 && nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// coveringNSEC3 returns an NSEC3 whose hash range strictly covers name.
+// NSEC3.Cover also reports a match, which proves existence instead.
+func coveringNSEC3(nsec3s []*dnslib.NSEC3, name string) *dnslib.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Hash == dnslib.SHA1 && nsec3.Cover(name) && !nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// nodataBitmap checks that a type bitmap proves there is no qtype record and
+// no CNAME at name. At a zone cut only the parent's record denies DS, and it
+// says nothing about the other types, which live in the child zone.
+func nodataBitmap(bitmap []uint16, qtype uint16, name string) (securityState, string) {
+	if hasType(bitmap, qtype) || hasType(bitmap, dnslib.TypeCNAME) {
+		return stateBogus, "denial record shows " + dnslib.TypeToString[qtype] + " or CNAME at " + name
+	}
+	delegation := hasType(bitmap, dnslib.TypeNS) && !hasType(bitmap, dnslib.TypeSOA)
+	if qtype == dnslib.TypeDS && hasType(bitmap, dnslib.TypeSOA) {
+		return stateBogus, "denial record from the child apex cannot deny DS at " + name
+	}
+	if qtype != dnslib.TypeDS && delegation {
+		return stateBogus, "denial record from the parent side of the delegation at " + name
+	}
+	return stateSecure, ""
+}
+
+// commonAncestor returns the longest name both a and b are subdomains of
+func commonAncestor(a, b string) string {
+	n := dnslib.CompareDomainName(a, b)
+	labels := dnslib.SplitDomainName(strings.ToLower(a))
+	if n == 0 {
+		return "."
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// canonicalCompare orders names by their labels from the root down, comparing
+// each label case-insensitively as raw bytes
+func canonicalCompare(a, b string) int {
+	la := dnslib.SplitDomainName(strings.ToLower(a))
+	lb := dnslib.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// stripDNSSEC removes DNSSEC records a client without the DO bit did not ask for
+func stripDNSSEC(m *dnslib.Msg, qtype uint16) {
+	filter := func(section []dnslib.RR) []dnslib.RR {
+		var out []dnslib.RR
+		for _, rr := range section {
+			switch rr.Header().Rrtype {
+			case dnslib.TypeRRSIG, dnslib.TypeNSEC, dnslib.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	m.Answer = filter(m.Answer)
+	m.Ns = filter(m.Ns)
+	m.Extra = filter(m.Extra)
+}
+
+// bogusReply is the SERVFAIL sent for answers that failed validation, with an
+// RFC 8914 extended error explaining why
+func bogusReply(r *dnslib.Msg, reason string) *dnslib.Msg {
+	m := newReply(r, dnslib.RcodeServerFailure)
+	opt := &dnslib.OPT{Hdr: dnslib.RR_Header{Name: ".", Rrtype: dnslib.TypeOPT}}
+	opt.Option = append(opt.Option, &dnslib.EDNS0_EDE{InfoCode: dnslib.ExtendedErrorCodeDNSBogus, ExtraText: reason})
+	m.Extra = append(m.Extra, opt)
+	return m
+}
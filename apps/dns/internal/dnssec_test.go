@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// testZoneRecords make up example.: a.example. exists, c.example. is an empty
+// non-terminal, *.w.example. is a wildcard next to v.w.example. and
+// sub.example. an unsigned delegation
+var testZoneRecords = []string{
+	"a.example. 300 IN A 192.0.2.1",
+	"b.c.example. 300 IN A 192.0.2.2",
+	"*.w.example. 300 IN TXT \"wildcard\"",
+	"v.w.example. 300 IN A 192.0.2.3",
+	"sub.example. 300 IN NS ns.sub.example.",
+}
+
+// signTestZone signs example. with the online signer
+func signTestZone(t *testing.T, nsec3 bool) *recordSetBuilder {
+	t.Helper()
+	logger := telemetry.NewLogger("/dev/null", "test")
+	signers, err := loadZoneSigners(DNSSECConfig{Sign: []SignedZoneConfig{{Name: "example.", NSEC3: nsec3}}}, logger)
+	if err != nil {
+		t.Fatalf("loadZoneSigners: %v", err)
+	}
+	b := newRecordSetBuilder(logger)
+	for _, record := range testZoneRecords {
+		rr, err := dnslib.NewRR(record)
+		if err != nil {
+			t.Fatalf("NewRR(%q): %v", record, err)
+		}
+		b.add(rr, "test")
+	}
+	b.signZones(signers, time.Hour)
+	return b
+}
+
+// startTestUpstream serves the zone's records and their signatures, standing
+// in for the upstream the validator fetches DNSKEYs from
+func startTestUpstream(t *testing.T, b *recordSetBuilder) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &dnslib.Server{PacketConn: conn, Handler: dnslib.HandlerFunc(func(w dnslib.ResponseWriter, r *dnslib.Msg) {
+		m := new(dnslib.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		for _, rr := range b.records[strings.ToLower(q.Name)] {
+			sig, isSig := rr.(*dnslib.RRSIG)
+			if rr.Header().Rrtype == q.Qtype || (isSig && sig.TypeCovered == q.Qtype) {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// newTestValidator returns a validator that trusts the zone's KSK and asks
+// the stand-in upstream for keys
+func newTestValidator(t *testing.T, b *recordSetBuilder) *validator {
+	t.Helper()
+	var anchors []string
+	for _, rr := range b.records["example."] {
+		if key, ok := rr.(*dnslib.DNSKEY); ok && key.Flags == flagsKSK {
+			anchors = append(anchors, key.String())
+		}
+	}
+	cfg := &DNSConfig{
+		Upstreams: []UpstreamConfig{{Address: startTestUpstream(t, b), Timeout: 2 * time.Second}},
+		DNSSEC:    DNSSECConfig{Validate: true, TrustAnchors: anchors},
+		Cache:     CacheConfig{Disabled: true},
+	}
+	return NewServer(cfg, telemetry.NewLogger("/dev/null", "test")).validator
+}
+
+// denialTest is a negative answer put together from records of the signed
+// zone, as an on-path attacker replaying them could
+type denialTest struct {
+	name   string
+	qname  string
+	qtype  uint16
+	rcode  int
+	answer string   // wildcard whose records, expanded to qname, form the answer
+	match  []string // names whose own NSEC/NSEC3 is included
+	covers []string // names whose covering NSEC/NSEC3 is included
+	want   securityState
+}
+
+func runDenialTests(t *testing.T, nsec3 bool, tests []denialTest) {
+	b := signTestZone(t, nsec3)
+	zone := b.zones[0]
+	v := newTestValidator(t, b)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(dnslib.Msg)
+			resp.SetQuestion(tt.qname, tt.qtype)
+			resp.Rcode = tt.rcode
+			if tt.answer != "" {
+				resp.Answer = expandWildcard(b, tt.answer, tt.qname, tt.qtype)
+			} else {
+				resp.Ns = append(resp.Ns, zone.soa...)
+			}
+			for _, name := range tt.match {
+				proof := zone.cover(name)
+				if !denialMatches(proof[0], name) {
+					t.Fatalf("zone has no denial record owned by %s", name)
+				}
+				resp.Ns = appendProofs(resp.Ns, proof)
+			}
+			for _, name := range tt.covers {
+				proof := zone.cover(name)
+				if denialMatches(proof[0], name) {
+					t.Fatalf("zone has a denial record owned by %s, not covering it", name)
+				}
+				resp.Ns = appendProofs(resp.Ns, proof)
+			}
+
+			got, reason := v.validateResponse(context.Background(), resp.Question[0], resp)
+			if got != tt.want {
+				t.Errorf("validateResponse = %v (%s), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+// expandWildcard returns the qtype records of wildcard and their signatures
+// renamed to qname, as a server synthesizes them
+func expandWildcard(b *recordSetBuilder, wildcard, qname string, qtype uint16) []dnslib.RR {
+	var out []dnslib.RR
+	for _, rr := range b.records[wildcard] {
+		sig, isSig := rr.(*dnslib.RRSIG)
+		if rr.Header().Rrtype == qtype || (isSig && sig.TypeCovered == qtype) {
+			rr = dnslib.Copy(rr)
+			rr.Header().Name = qname
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func denialMatches(rr dnslib.RR, name string) bool {
+	if nsec3, ok := rr.(*dnslib.NSEC3); ok {
+		return nsec3.Match(name)
+	}
+	return strings.EqualFold(rr.Header().Name, name)
+}
+
+func TestValidateDenialNSEC(t *testing.T) {
+	runDenialTests(t, false, []denialTest{
+		{name: "nxdomain", qname: "x.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			covers: []string{"x.example.", "*.example."}, want: stateSecure},
+		{name: "nxdomain without wildcard proof", qname: "x.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			covers: []string{"x.example."}, want: stateBogus},
+		{name: "nxdomain with unrelated NSEC", qname: "x.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			covers: []string{"*.example."}, want: stateBogus},
+		{name: "forged nxdomain for existing name", qname: "a.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			match: []string{"a.example."}, covers: []string{"*.example."}, want: stateBogus},
+		{name: "forged nxdomain under wildcard", qname: "x.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeNameError,
+			covers: []string{"x.w.example."}, match: []string{"*.w.example."}, want: stateBogus},
+		{name: "nodata", qname: "a.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			match: []string{"a.example."}, want: stateSecure},
+		{name: "forged nodata for existing type", qname: "a.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			match: []string{"a.example."}, want: stateBogus},
+		{name: "nodata at empty non-terminal", qname: "c.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			covers: []string{"c.example."}, want: stateSecure},
+		{name: "forged nodata from covering NSEC", qname: "x.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			covers: []string{"x.example."}, want: stateBogus},
+		{name: "forged nodata at delegation", qname: "sub.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			match: []string{"sub.example."}, want: stateBogus},
+		{name: "wildcard nodata", qname: "y.w.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			covers: []string{"y.w.example."}, match: []string{"*.w.example."}, want: stateSecure},
+		{name: "forged wildcard nodata for existing type", qname: "y.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			covers: []string{"y.w.example."}, match: []string{"*.w.example."}, want: stateBogus},
+		{name: "wildcard answer", qname: "y.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			answer: "*.w.example.", covers: []string{"y.w.example."}, want: stateSecure},
+		{name: "wildcard answer without proof", qname: "y.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			answer: "*.w.example.", want: stateBogus},
+		{name: "wildcard answer masking existing name", qname: "v.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			answer: "*.w.example.", match: []string{"v.w.example."}, want: stateBogus},
+	})
+}
+
+func TestValidateDenialNSEC3(t *testing.T) {
+	runDenialTests(t, true, []denialTest{
+		{name: "nxdomain", qname: "x.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			match: []string{"example."}, covers: []string{"x.example.", "*.example."}, want: stateSecure},
+		{name: "nxdomain without wildcard proof", qname: "x.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			match: []string{"example."}, covers: []string{"x.example."}, want: stateBogus},
+		{name: "nxdomain without closest encloser", qname: "x.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			covers: []string{"x.example.", "*.example."}, want: stateBogus},
+		{name: "forged nxdomain from replayed NSEC3", qname: "x.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			match: []string{"a.example."}, want: stateBogus},
+		{name: "forged nxdomain for existing name", qname: "a.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeNameError,
+			match: []string{"example.", "a.example."}, covers: []string{"*.example."}, want: stateBogus},
+		{name: "forged nxdomain under wildcard", qname: "x.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeNameError,
+			match: []string{"w.example.", "*.w.example."}, covers: []string{"x.w.example."}, want: stateBogus},
+		{name: "nodata", qname: "a.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			match: []string{"a.example."}, want: stateSecure},
+		{name: "forged nodata for existing type", qname: "a.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			match: []string{"a.example."}, want: stateBogus},
+		{name: "forged nodata from replayed NSEC3", qname: "a.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			match: []string{"b.c.example."}, want: stateBogus},
+		{name: "nodata at empty non-terminal", qname: "c.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			match: []string{"c.example."}, want: stateSecure},
+		{name: "forged nodata at delegation", qname: "sub.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			match: []string{"sub.example."}, want: stateBogus},
+		{name: "wildcard nodata", qname: "y.w.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			match: []string{"w.example.", "*.w.example."}, covers: []string{"y.w.example."}, want: stateSecure},
+		{name: "forged wildcard nodata for existing type", qname: "y.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			match: []string{"w.example.", "*.w.example."}, covers: []string{"y.w.example."}, want: stateBogus},
+		{name: "wildcard nodata without wildcard NSEC3", qname: "y.w.example.", qtype: dnslib.TypeA, rcode: dnslib.RcodeSuccess,
+			match: []string{"w.example."}, covers: []string{"y.w.example."}, want: stateBogus},
+		{name: "wildcard answer", qname: "y.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			answer: "*.w.example.", covers: []string{"y.w.example."}, want: stateSecure},
+		{name: "wildcard answer without proof", qname: "y.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			answer: "*.w.example.", want: stateBogus},
+		{name: "wildcard answer masking existing name", qname: "v.w.example.", qtype: dnslib.TypeTXT, rcode: dnslib.RcodeSuccess,
+			answer: "*.w.example.", match: []string{"v.w.example."}, want: stateBogus},
+	})
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// forwardRule is a compiled conditional forwarding rule
+type forwardRule struct {
+	suffix    string
+	upstreams []upstream
+}
+
+// newUpstreamPool builds upstreams from config, skipping invalid entries
+func newUpstreamPool(configs []UpstreamConfig, logger *telemetry.Logger) []upstream {
+	var pool []upstream
+	for _, cfgUpstream := range configs {
+		u, err := newUpstream(cfgUpstream)
+		if err != nil {
+			logger.Error("Skipping invalid upstream:", err)
+			continue
+		}
+		pool = append(pool, u)
+	}
+	return pool
+}
+
+// compileForwardRules builds the conditional forwarding rules, most specific first
+func compileForwardRules(rules []ForwardRule, logger *telemetry.Logger) []*forwardRule {
+	var compiled []*forwardRule
+	for _, rule := range rules {
+		pool := newUpstreamPool(rule.Upstreams, logger)
+		if len(pool) == 0 {
+			logger.Error("Skipping forward rule without valid upstreams:", rule.Suffix)
+			continue
+		}
+		compiled = append(compiled, &forwardRule{
+			suffix:    strings.ToLower(dnslib.Fqdn(rule.Suffix)),
+			upstreams: pool,
+		})
+		logger.Info("Registered forward rule:", rule.Suffix, "->", pool)
+	}
+
+	sort.SliceStable(compiled, func(i, j int) bool {
+		return dnslib.CountLabel(compiled[i].suffix) > dnslib.CountLabel(compiled[j].suffix)
+	})
+	return compiled
+}
+
+// matchForwardRule returns the rule with the longest suffix matching name, if any
+func (s *Server) matchForwardRule(name string) *forwardRule {
+	name = strings.ToLower(dnslib.Fqdn(name))
+	for _, rule := range s.forwardRules {
+		if dnslib.IsSubDomain(rule.suffix, name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// poolFor picks the upstreams for name: a matching forward rule wins, then the
+// client group's upstreams, then the default pool
+func (s *Server) poolFor(name string, group *clientGroup) ([]upstream, *forwardRule) {
+	if rule := s.matchForwardRule(name); rule != nil {
+		return rule.upstreams, rule
+	}
+	return s.upstreamsFor(group), nil
+}
+
+// questionMsg builds an upstream query for a single question, carrying over the
+// client's RD/CD flags and EDNS0 options
+func questionMsg(r *dnslib.Msg, q dnslib.Question) *dnslib.Msg {
+	m := new(dnslib.Msg)
+	m.Id = dnslib.Id()
+	m.RecursionDesired = r.RecursionDesired
+	m.CheckingDisabled = r.CheckingDisabled
+	m.Question = []dnslib.Question{q}
+	if opt := r.IsEdns0(); opt != nil {
+		m.Extra = append(m.Extra, dnslib.Copy(opt))
+	}
+	return m
+}
+
+// forward sends the query to the pool, sharing the exchange with identical
+// queries already in flight. The response carries m's message ID.
+func (s *Server) forward(ctx context.Context, m *dnslib.Msg, pool []upstream) (*dnslib.Msg, upstream, error) {
+	key := flightKey(m, pool)
+	resp, used, err, shared := s.inflight.do(key, func() (*dnslib.Msg, upstream, error) {
+		return s.exchange(ctx, m, pool)
+	})
+	if shared {
+		s.logger.Info("Joined in-flight upstream query for", m.Question[0].Name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Id = m.Id
+	return resp, used, nil
+}
+
+// exchange sends the query to each upstream of the pool in order until one
+// answers. SERVFAIL and REFUSED count as failures of that upstream, so the
+// next one is tried and a stale answer can be served when all of them fail.
+func (s *Server) exchange(ctx context.Context, m *dnslib.Msg, pool []upstream) (*dnslib.Msg, upstream, error) {
+	release, err := s.limits.acquireUpstream(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	var lastErr error
+	for _, u := range pool {
+		resp, err := u.Exchange(ctx, m)
+		if err == nil && (resp.Rcode == dnslib.RcodeServerFailure || resp.Rcode == dnslib.RcodeRefused) {
+			err = fmt.Errorf("answered %s", dnslib.RcodeToString[resp.Rcode])
+		}
+		if err == nil {
+			return resp, u, nil
+		}
+		s.logger.Error("Upstream", u, "failed:", err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstreams configured")
+	}
+	return nil, nil, lastErr
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// startRcodeUpstream answers every query with rcode, adding an A record to
+// NOERROR answers
+func startRcodeUpstream(t *testing.T, rcode *atomic.Int64) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &dnslib.Server{PacketConn: conn, Handler: dnslib.HandlerFunc(func(w dnslib.ResponseWriter, r *dnslib.Msg) {
+		m := new(dnslib.Msg)
+		m.SetRcode(r, int(rcode.Load()))
+		if m.Rcode == dnslib.RcodeSuccess {
+			rr, _ := dnslib.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func newForwardingTestServer(t *testing.T, cache CacheConfig, addresses ...string) *Server {
+	t.Helper()
+	cfg := &DNSConfig{Cache: cache}
+	for _, address := range addresses {
+		cfg.Upstreams = append(cfg.Upstreams, UpstreamConfig{Address: address, Timeout: 2 * time.Second})
+	}
+	return NewServer(cfg, telemetry.NewLogger("/dev/null", "test"))
+}
+
+func TestExchangeFailsOverOnErrorRcodes(t *testing.T) {
+	for _, rcode := range []int{dnslib.RcodeServerFailure, dnslib.RcodeRefused} {
+		t.Run(dnslib.RcodeToString[rcode], func(t *testing.T) {
+			var failing, success atomic.Int64
+			failing.Store(int64(rcode))
+			s := newForwardingTestServer(t, CacheConfig{Disabled: true}, startRcodeUpstream(t, &failing), startRcodeUpstream(t, &success))
+			pool, _ := s.poolFor("www.example.", nil)
+
+			m := new(dnslib.Msg)
+			m.SetQuestion("www.example.", dnslib.TypeA)
+			resp, used, err := s.exchange(t.Context(), m, pool)
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+			if resp.Rcode != dnslib.RcodeSuccess || used != pool[1] {
+				t.Errorf("got %s from %v, want NOERROR from the second upstream", dnslib.RcodeToString[resp.Rcode], used)
+			}
+		})
+	}
+}
+
+func TestServeStaleOnServfail(t *testing.T) {
+	var rcode atomic.Int64
+	s := newForwardingTestServer(t, CacheConfig{Size: 10, ServeStale: time.Hour, DisablePrefetch: true}, startRcodeUpstream(t, &rcode))
+	pool, _ := s.poolFor("www.example.", nil)
+	query := new(dnslib.Msg)
+	query.SetQuestion("www.example.", dnslib.TypeA)
+
+	if _, _, err := s.resolveUpstream(query, pool); err != nil {
+		t.Fatalf("resolveUpstream: %v", err)
+	}
+	// Age the cached answer past its TTL, then let the upstream fail
+	entry := s.cache.entries[flightKey(query, pool)]
+	entry.stored = entry.stored.Add(-2 * time.Minute)
+	rcode.Store(dnslib.RcodeServerFailure)
+
+	resp, source, err := s.resolveUpstream(query, pool)
+	if err != nil {
+		t.Fatalf("resolveUpstream after SERVFAIL: %v", err)
+	}
+	if source != sourceCache || len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Errorf("got %v from %s, want the stale answer from the cache", resp.Answer, source)
+	}
+}
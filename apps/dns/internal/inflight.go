@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// inflightCall is an upstream exchange shared by concurrent identical queries
+type inflightCall struct {
+	done chan struct{}
+	resp *dnslib.Msg
+	used upstream
+	err  error
+}
+
+// flightGroup deduplicates concurrent upstream queries with the same key
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+// do runs fn once for all concurrent callers with the same key. Every caller
+// gets its own copy of the response so it can rewrite the ID and flags; shared
+// reports whether the caller joined an exchange started by another one.
+func (g *flightGroup) do(key string, fn func() (*dnslib.Msg, upstream, error)) (*dnslib.Msg, upstream, error, bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*inflightCall)
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		call = &inflightCall{done: make(chan struct{})}
+		g.calls[key] = call
+	}
+	g.mu.Unlock()
+
+	if !shared {
+		call.resp, call.used, call.err = fn()
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}
+
+	<-call.done
+	if call.err != nil {
+		return nil, nil, call.err, shared
+	}
+	return call.resp.Copy(), call.used, nil, shared
+}
+
+// flightKey identifies queries that may share one upstream exchange or cache
+// entry: same question, RD/CD/DO flags and client subnet, sent to the same
+// upstream pool. Other EDNS options such as cookies do not change the answer.
+func flightKey(m *dnslib.Msg, pool []upstream) string {
+	var b strings.Builder
+	if len(pool) > 0 {
+		fmt.Fprintf(&b, "%p|", &pool[0])
+	}
+	for _, q := range m.Question {
+		fmt.Fprintf(&b, "%s|%d|%d|", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+	}
+	fmt.Fprintf(&b, "%t|%t", m.RecursionDesired, m.CheckingDisabled)
+	if opt := m.IsEdns0(); opt != nil {
+		fmt.Fprintf(&b, "|%t", opt.Do())
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dnslib.EDNS0_SUBNET); ok {
+				b.WriteString("|" + subnet.String())
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// maxTrackedBuckets triggers pruning of idle rate limit buckets
+const maxTrackedBuckets = 100000
+
+// upstreamQueueWait is how long a query waits for a free upstream slot
+const upstreamQueueWait = 2 * time.Second
+
+// errUpstreamBusy is returned when the concurrent upstream cap stays exhausted
+var errUpstreamBusy = errors.New("too many concurrent upstream queries")
+
+// Names of the limit counters
+const (
+	limitRefused     = "refused"
+	limitClientRate  = "client-rate"
+	limitRRLDropped  = "rrl-dropped"
+	limitRRLSlipped  = "rrl-slipped"
+	limitUpstreamCap = "upstream-busy"
+)
+
+// rrlAction is what response rate limiting does with a response
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// tokenBucket refills at a fixed rate up to its burst size
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// denied counts responses refused since the bucket was created, for slip
+	denied int
+}
+
+// bucketMap holds one token bucket per key
+type bucketMap struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newBucketMap(rate float64, burst float64) *bucketMap {
+	return &bucketMap{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// take consumes a token for key. When none is left it returns false and the
+// number of times key has been denied so far.
+func (m *bucketMap) take(key string, now time.Time) (bool, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxTrackedBuckets {
+			m.pruneLocked(now)
+		}
+		b = &tokenBucket{tokens: m.burst, last: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = min(m.burst, b.tokens+now.Sub(b.last).Seconds()*m.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	b.denied++
+	return false, b.denied
+}
+
+// pruneLocked drops buckets that have refilled completely; m.mu must be held
+func (m *bucketMap) pruneLocked(now time.Time) {
+	for key, b := range m.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*m.rate >= m.burst {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// limiter enforces the access list, per-client rate limits, response rate
+// limiting and the cap on concurrent upstream queries
+type limiter struct {
+	cfg     LimitsConfig
+	allowed []*net.IPNet
+	clients *bucketMap
+	rrl     *bucketMap
+	// upstreams is a semaphore of in-flight upstream exchanges
+	upstreams chan struct{}
+	hits      namedCounters
+}
+
+func newLimiter(cfg LimitsConfig) *limiter {
+	l := &limiter{cfg: cfg}
+	for _, cidr := range cfg.AllowedClients {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			l.allowed = append(l.allowed, network)
+		}
+	}
+	if cfg.ClientQPS > 0 {
+		l.clients = newBucketMap(cfg.ClientQPS, float64(cfg.ClientBurst))
+	}
+	if cfg.RRL.ResponsesPerSecond > 0 {
+		l.rrl = newBucketMap(cfg.RRL.ResponsesPerSecond, cfg.RRL.ResponsesPerSecond)
+	}
+	if cfg.MaxConcurrentUpstream > 0 {
+		l.upstreams = make(chan struct{}, cfg.MaxConcurrentUpstream)
+	}
+	return l
+}
+
+// clientAllowed reports whether ip may use the resolver at all
+func (l *limiter) clientAllowed(ip net.IP) bool {
+	if len(l.allowed) == 0 {
+		return true
+	}
+	for _, network := range l.allowed {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	l.hits.inc(limitRefused)
+	return false
+}
+
+// takeClient consumes one query from the rate limit of ip
+func (l *limiter) takeClient(ip net.IP) bool {
+	if l.clients == nil || ip == nil {
+		return true
+	}
+	ok, _ := l.clients.take(ip.String(), time.Now())
+	if !ok {
+		l.hits.inc(limitClientRate)
+	}
+	return ok
+}
+
+// limitResponse applies response rate limiting to a UDP reply. Identical
+// responses (same name, type and rcode) to one client network share a bucket.
+func (l *limiter) limitResponse(ip net.IP, m *dnslib.Msg) rrlAction {
+	if l.rrl == nil || ip == nil || len(m.Question) == 0 {
+		return rrlSend
+	}
+
+	prefix := l.cfg.RRL.IPv4PrefixLength
+	bits := 32
+	if ip.To4() == nil {
+		prefix, bits = l.cfg.RRL.IPv6PrefixLength, 128
+	}
+	network := ip.Mask(net.CIDRMask(prefix, bits))
+
+	q := m.Question[0]
+	name := q.Name
+	if m.Rcode != dnslib.RcodeSuccess {
+		// Random subdomains of one domain count as the same error response
+		if i, end := dnslib.NextLabel(name, 0); !end {
+			name = name[i:]
+		}
+	}
+	key := network.String() + "|" + name + "|" + strconv.Itoa(int(q.Qtype)) + "|" + strconv.Itoa(m.Rcode)
+
+	ok, denied := l.rrl.take(key, time.Now())
+	if ok {
+		return rrlSend
+	}
+	if slip := *l.cfg.RRL.Slip; slip > 0 && denied%slip == 0 {
+		l.hits.inc(limitRRLSlipped)
+		return rrlSlip
+	}
+	l.hits.inc(limitRRLDropped)
+	return rrlDrop
+}
+
+// acquireUpstream waits for a free upstream slot. The returned func releases it.
+func (l *limiter) acquireUpstream(ctx context.Context) (func(), error) {
+	if l.upstreams == nil {
+		return func() {}, nil
+	}
+
+	timer := time.NewTimer(upstreamQueueWait)
+	defer timer.Stop()
+	select {
+	case l.upstreams <- struct{}{}:
+		return func() { <-l.upstreams }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		l.hits.inc(limitUpstreamCap)
+		return nil, errUpstreamBusy
+	}
+}
+
+// truncatedReply is the empty TC=1 reply slipped to rate limited clients so
+// legitimate ones retry over TCP
+func truncatedReply(r *dnslib.Msg, m *dnslib.Msg) *dnslib.Msg {
+	tc := newReply(r, m.Rcode)
+	tc.Truncated = true
+	return tc
+}
@@ -0,0 +1,454 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsGroup is the IPv4 multicast address and port of mDNS (RFC 6762)
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsDomain is the domain every mDNS name lives in
+const mdnsDomain = "local."
+
+// mdnsQueryTimeout is how long a unicast query waits for devices to answer
+const mdnsQueryTimeout = time.Second
+
+// mdnsHostTTL is the TTL of announced address records (RFC 6762 section 10)
+const mdnsHostTTL = 120
+
+// mdnsMaxRecords bounds the cache of announced records
+const mdnsMaxRecords = 4096
+
+// mdnsClassFlag is the top bit of the record class (cache flush) and of the
+// question class (unicast response requested)
+const mdnsClassFlag = 1 << 15
+
+// mdnsLegacyTTL caps TTLs in answers to one-shot queries from ports other than 5353
+const mdnsLegacyTTL = 10
+
+// mdnsRecord is a cached record announced by a device on the network
+type mdnsRecord struct {
+	rr      dnslib.RR
+	expires time.Time
+}
+
+// mdnsBridge listens to multicast DNS, caches what devices announce for
+// answering unicast queries under the bridged zone and answers mDNS queries
+// for announced local records
+type mdnsBridge struct {
+	logger *telemetry.Logger
+	// zone is the unicast domain .local names are published under
+	zone       string
+	announce   []string
+	interfaces []*net.Interface
+	// records returns the current local records for announcing
+	records func() *recordSet
+	conn    *net.UDPConn
+
+	mu    sync.Mutex
+	cache map[recordKey][]mdnsRecord
+	// updated is closed and replaced whenever the cache changes
+	updated chan struct{}
+}
+
+func newMDNSBridge(cfg MDNSConfig, logger *telemetry.Logger, records func() *recordSet) (*mdnsBridge, error) {
+	b := &mdnsBridge{
+		logger:  logger,
+		records: records,
+		cache:   make(map[recordKey][]mdnsRecord),
+		updated: make(chan struct{}),
+	}
+	if cfg.Zone != "" {
+		b.zone = strings.ToLower(dnslib.Fqdn(cfg.Zone))
+	}
+	for _, domain := range cfg.Announce {
+		b.announce = append(b.announce, strings.ToLower(dnslib.Fqdn(domain)))
+	}
+	for _, name := range cfg.Interfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("mdns: %w", err)
+		}
+		b.interfaces = append(b.interfaces, ifi)
+	}
+	return b, nil
+}
+
+// listen joins the mDNS group on the configured interfaces
+func (b *mdnsBridge) listen() error {
+	var first *net.Interface
+	if len(b.interfaces) > 0 {
+		first = b.interfaces[0]
+	}
+	conn, err := net.ListenMulticastUDP("udp4", first, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("failed to listen for mDNS: %w", err)
+	}
+
+	pc := ipv4.NewPacketConn(conn)
+	for _, ifi := range b.interfaces[min(1, len(b.interfaces)):] {
+		if err := pc.JoinGroup(ifi, mdnsGroup); err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("failed to join mDNS group on %s: %w", ifi.Name, err)
+		}
+	}
+	// Our own announcements must not end up in the cache
+	if err := pc.SetMulticastLoopback(false); err != nil {
+		b.logger.Warn("Failed to disable mDNS multicast loopback:", err)
+	}
+	_ = pc.SetMulticastTTL(255)
+
+	b.conn = conn
+	return nil
+}
+
+// serve reads mDNS messages until close is called
+func (b *mdnsBridge) serve() error {
+	buf := make([]byte, dnslib.MaxMsgSize)
+	for {
+		n, src, err := b.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		m := new(dnslib.Msg)
+		if err := m.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		if m.Response {
+			b.store(m, time.Now())
+		} else if len(b.announce) > 0 {
+			b.answer(m, src)
+		}
+	}
+}
+
+// close says goodbye for announced records and stops listening
+func (b *mdnsBridge) close() error {
+	if b.conn == nil {
+		return nil
+	}
+	if len(b.announce) > 0 {
+		b.sendAnnouncement(true)
+	}
+	return b.conn.Close()
+}
+
+// store caches the records of an mDNS response. Records with the cache flush
+// bit replace the RRset; a TTL of zero withdraws a record (RFC 6762 section 10).
+func (b *mdnsBridge) store(m *dnslib.Msg, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	flushed := make(map[recordKey]bool)
+	changed := false
+	for _, rr := range append(m.Answer, m.Extra...) {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dnslib.TypeA, dnslib.TypeAAAA, dnslib.TypeSRV, dnslib.TypeTXT, dnslib.TypePTR:
+		default:
+			continue
+		}
+		hdr.Name = strings.ToLower(hdr.Name)
+		if !dnslib.IsSubDomain(mdnsDomain, hdr.Name) {
+			continue
+		}
+
+		key := recordKey{name: hdr.Name, rrtype: hdr.Rrtype}
+		if hdr.Class&mdnsClassFlag != 0 && !flushed[key] {
+			delete(b.cache, key)
+			flushed[key] = true
+		}
+		hdr.Class &^= mdnsClassFlag
+
+		var records []mdnsRecord
+		for _, cached := range b.cache[key] {
+			if !dnslib.IsDuplicate(cached.rr, rr) {
+				records = append(records, cached)
+			}
+		}
+		if hdr.Ttl > 0 {
+			records = append(records, mdnsRecord{rr: rr, expires: now.Add(time.Duration(hdr.Ttl) * time.Second)})
+		}
+		if len(records) == 0 {
+			delete(b.cache, key)
+		} else {
+			b.cache[key] = records
+		}
+		changed = true
+	}
+
+	if len(b.cache) > mdnsMaxRecords {
+		b.pruneLocked(now)
+	}
+	if changed {
+		close(b.updated)
+		b.updated = make(chan struct{})
+	}
+}
+
+// pruneLocked drops expired records; b.mu must be held
+func (b *mdnsBridge) pruneLocked(now time.Time) {
+	for key, records := range b.cache {
+		live := records[:0]
+		for _, record := range records {
+			if record.expires.After(now) {
+				live = append(live, record)
+			}
+		}
+		if len(live) == 0 {
+			delete(b.cache, key)
+		} else {
+			b.cache[key] = live
+		}
+	}
+}
+
+// inZone reports whether name is bridged from mDNS
+func (b *mdnsBridge) inZone(name string) bool {
+	name = strings.ToLower(dnslib.Fqdn(name))
+	return b.zone != "" && name != b.zone && dnslib.IsSubDomain(b.zone, name)
+}
+
+// resolve answers a unicast question under the bridged zone. Names not in the
+// cache are queried over mDNS first.
+func (b *mdnsBridge) resolve(r *dnslib.Msg, q dnslib.Question) *dnslib.Msg {
+	local := b.toLocal(q.Name)
+
+	answers, exists := b.lookup(local, q.Qtype, time.Now())
+	if !exists {
+		b.query(local, q.Qtype)
+		answers, exists = b.wait(local, q.Qtype)
+	}
+
+	m := newReply(r, dnslib.RcodeSuccess)
+	m.Authoritative = true
+	if !exists {
+		m.Rcode = dnslib.RcodeNameError
+		return m
+	}
+	// Addresses of service targets save the client a round trip
+	for _, rr := range answers {
+		if srv, ok := rr.(*dnslib.SRV); ok {
+			for _, qtype := range []uint16{dnslib.TypeA, dnslib.TypeAAAA} {
+				extra, _ := b.lookup(strings.ToLower(srv.Target), qtype, time.Now())
+				for _, rr := range extra {
+					m.Extra = append(m.Extra, b.fromLocalRR(rr))
+				}
+			}
+		}
+	}
+	for _, rr := range answers {
+		m.Answer = append(m.Answer, b.fromLocalRR(rr))
+	}
+	return m
+}
+
+// lookup returns the cached records of name and type with their remaining
+// TTL, and whether name has any records at all
+func (b *mdnsBridge) lookup(name string, qtype uint16, now time.Time) ([]dnslib.RR, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	exists := false
+	var answers []dnslib.RR
+	for _, rrtype := range []uint16{dnslib.TypeA, dnslib.TypeAAAA, dnslib.TypeSRV, dnslib.TypeTXT, dnslib.TypePTR} {
+		key := recordKey{name: name, rrtype: rrtype}
+		for _, record := range b.cache[key] {
+			if !record.expires.After(now) {
+				continue
+			}
+			exists = true
+			if key.rrtype == qtype || qtype == dnslib.TypeANY {
+				rr := dnslib.Copy(record.rr)
+				rr.Header().Ttl = uint32(record.expires.Sub(now) / time.Second)
+				answers = append(answers, rr)
+			}
+		}
+	}
+	return answers, exists
+}
+
+// wait gives devices mdnsQueryTimeout to answer a query for name
+func (b *mdnsBridge) wait(name string, qtype uint16) ([]dnslib.RR, bool) {
+	deadline := time.NewTimer(mdnsQueryTimeout)
+	defer deadline.Stop()
+	for {
+		b.mu.Lock()
+		updated := b.updated
+		b.mu.Unlock()
+
+		if answers, exists := b.lookup(name, qtype, time.Now()); len(answers) > 0 {
+			return answers, exists
+		}
+		select {
+		case <-updated:
+		case <-deadline.C:
+			return b.lookup(name, qtype, time.Now())
+		}
+	}
+}
+
+// query asks the network for name over mDNS
+func (b *mdnsBridge) query(name string, qtype uint16) {
+	m := new(dnslib.Msg)
+	m.Question = []dnslib.Question{{Name: name, Qtype: qtype, Qclass: dnslib.ClassINET}}
+	b.send(m, mdnsGroup)
+}
+
+// answer responds to an mDNS query for names of announced records
+func (b *mdnsBridge) answer(m *dnslib.Msg, src *net.UDPAddr) {
+	legacy := src.Port != mdnsGroup.Port
+	resp := new(dnslib.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	unicast := legacy
+
+	for _, q := range m.Question {
+		for _, rr := range b.announced(strings.ToLower(q.Name)) {
+			if rr.Header().Rrtype != q.Qtype && q.Qtype != dnslib.TypeANY {
+				continue
+			}
+			if legacy {
+				rr.Header().Ttl = min(rr.Header().Ttl, mdnsLegacyTTL)
+				rr.Header().Class &^= mdnsClassFlag
+			}
+			resp.Answer = append(resp.Answer, rr)
+		}
+		if q.Qclass&mdnsClassFlag != 0 {
+			unicast = true
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return
+	}
+
+	// One-shot resolvers expect a normal DNS reply to their own port
+	if legacy {
+		resp.Id = m.Id
+		resp.Question = m.Question
+	}
+	dst := mdnsGroup
+	if unicast {
+		dst = src
+	}
+	b.send(resp, dst)
+}
+
+// announced returns the records announced for an mDNS name, nil when name is
+// not under .local or has no local records
+func (b *mdnsBridge) announced(local string) []dnslib.RR {
+	if !dnslib.IsSubDomain(mdnsDomain, local) || local == mdnsDomain {
+		return nil
+	}
+	host := strings.TrimSuffix(local, mdnsDomain)
+	rs := b.records()
+	for _, domain := range b.announce {
+		records, ok := rs.exact[host+domain]
+		if !ok {
+			continue
+		}
+		var out []dnslib.RR
+		for _, rr := range records {
+			if rr.Header().Rrtype != dnslib.TypeA && rr.Header().Rrtype != dnslib.TypeAAAA {
+				continue
+			}
+			out = append(out, withMDNSOwner(rr, local))
+		}
+		return out
+	}
+	return nil
+}
+
+// announceRecords sends unsolicited responses for every announced record,
+// at startup and after the local records changed (RFC 6762 section 8.3)
+func (b *mdnsBridge) announceRecords() {
+	if b.conn != nil && len(b.announce) > 0 {
+		b.sendAnnouncement(false)
+	}
+}
+
+// sendAnnouncement multicasts all announced records; goodbye sends them with
+// a TTL of zero so caches drop them
+func (b *mdnsBridge) sendAnnouncement(goodbye bool) {
+	resp := new(dnslib.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+
+	for name := range b.records().exact {
+		for _, domain := range b.announce {
+			if name == domain || !dnslib.IsSubDomain(domain, name) {
+				continue
+			}
+			for _, rr := range b.announced(strings.TrimSuffix(name, domain) + mdnsDomain) {
+				if goodbye {
+					rr.Header().Ttl = 0
+				}
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	}
+	if len(resp.Answer) > 0 {
+		b.send(resp, mdnsGroup)
+	}
+}
+
+// send packs m and writes it to dst
+func (b *mdnsBridge) send(m *dnslib.Msg, dst *net.UDPAddr) {
+	packed, err := m.Pack()
+	if err != nil {
+		b.logger.Error("Failed to pack mDNS message:", err)
+		return
+	}
+	if _, err := b.conn.WriteToUDP(packed, dst); err != nil {
+		b.logger.Warn("Failed to send mDNS message to", dst, err)
+	}
+}
+
+// toLocal maps a name under the bridged zone to its .local name
+func (b *mdnsBridge) toLocal(name string) string {
+	name = strings.ToLower(dnslib.Fqdn(name))
+	return strings.TrimSuffix(name, b.zone) + mdnsDomain
+}
+
+// fromLocal maps a .local name into the bridged zone
+func (b *mdnsBridge) fromLocal(name string) string {
+	if !dnslib.IsSubDomain(mdnsDomain, strings.ToLower(name)) {
+		return name
+	}
+	return name[:len(name)-len(mdnsDomain)] + b.zone
+}
+
+// fromLocalRR renames a cached record, and the names it points to, into the bridged zone
+func (b *mdnsBridge) fromLocalRR(rr dnslib.RR) dnslib.RR {
+	rr.Header().Name = b.fromLocal(rr.Header().Name)
+	switch v := rr.(type) {
+	case *dnslib.SRV:
+		v.Target = b.fromLocal(v.Target)
+	case *dnslib.PTR:
+		v.Ptr = b.fromLocal(v.Ptr)
+	}
+	return rr
+}
+
+// withMDNSOwner copies a local address record for announcing as name, with
+// the cache flush bit set because we are the only owner of the name
+func withMDNSOwner(rr dnslib.RR, name string) dnslib.RR {
+	out := dnslib.Copy(rr)
+	out.Header().Name = name
+	out.Header().Ttl = mdnsHostTTL
+	out.Header().Class = dnslib.ClassINET | mdnsClassFlag
+	return out
+}
@@ -0,0 +1,29 @@
+package internal
+
+import "sync"
+
+// namedCounters is a set of counters keyed by name, e.g. per transport or per blocklist
+type namedCounters struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (c *namedCounters) inc(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[name]++
+}
+
+// snapshot returns a copy of the current counts
+func (c *namedCounters) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]uint64, len(c.counts))
+	for name, count := range c.counts {
+		out[name] = count
+	}
+	return out
+}
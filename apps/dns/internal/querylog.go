@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// How a query was answered, recorded in the query log
+const (
+	sourceLocal    = "local"
+	sourceCache    = "cache"
+	sourceUpstream = "upstream"
+	sourceBlocked  = "blocked"
+	sourceMDNS     = "mdns"
+)
+
+// queryLogEntry is one answered query
+type queryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	Group     string    `json:"group,omitempty"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode"`
+	Answers   []string  `json:"answers,omitempty"`
+	Source    string    `json:"source"`
+	// LatencyMs is the time spent resolving, in milliseconds
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// newQueryLogEntry summarizes a reply for the query log
+func newQueryLogEntry(start time.Time, client net.IP, transport string, group *clientGroup, r, m *dnslib.Msg, source string) queryLogEntry {
+	entry := queryLogEntry{
+		Time:      start,
+		Transport: transport,
+		Rcode:     dnslib.RcodeToString[m.Rcode],
+		Source:    source,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if client != nil {
+		entry.Client = client.String()
+	}
+	if group != nil {
+		entry.Group = group.name
+	}
+	if len(r.Question) > 0 {
+		entry.Name = strings.ToLower(r.Question[0].Name)
+		entry.Type = dnslib.TypeToString[r.Question[0].Qtype]
+	}
+	for _, rr := range m.Answer {
+		switch rr.Header().Rrtype {
+		case dnslib.TypeRRSIG, dnslib.TypeNSEC, dnslib.TypeNSEC3:
+			continue
+		}
+		// Drop the owner, TTL and class; "A 10.0.0.1" is what people look for
+		fields := strings.SplitN(rr.String(), "\t", 5)
+		entry.Answers = append(entry.Answers, strings.Join(fields[len(fields)-2:], " "))
+	}
+	return entry
+}
+
+// queryLog keeps the most recent entries in a ring buffer and optionally
+// appends every entry to a JSON lines file
+type queryLog struct {
+	mu      sync.Mutex
+	entries []queryLogEntry
+	next    int
+	full    bool
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newQueryLog(cfg QueryLogConfig) (*queryLog, error) {
+	l := &queryLog{entries: make([]queryLogEntry, cfg.Size)}
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open query log file: %w", err)
+		}
+		l.file = f
+		l.encoder = json.NewEncoder(f)
+	}
+	return l, nil
+}
+
+// add records an entry, overwriting the oldest one when the buffer is full
+func (l *queryLog) add(entry queryLogEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+
+	if l.encoder != nil {
+		return l.encoder.Encode(entry)
+	}
+	return nil
+}
+
+// queryLogFilter selects entries in search; zero fields match everything
+type queryLogFilter struct {
+	client *net.IPNet
+	// name is a glob such as "*.netflix.com" or a plain substring
+	name   string
+	source string
+	since  time.Time
+	until  time.Time
+	limit  int
+}
+
+func (f queryLogFilter) matches(entry queryLogEntry) bool {
+	if f.client != nil && !f.client.Contains(net.ParseIP(entry.Client)) {
+		return false
+	}
+	if f.source != "" && entry.Source != f.source {
+		return false
+	}
+	if !f.since.IsZero() && entry.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && entry.Time.After(f.until) {
+		return false
+	}
+	if f.name != "" {
+		name := strings.TrimSuffix(entry.Name, ".")
+		if strings.ContainsAny(f.name, "*?[") {
+			if ok, _ := path.Match(f.name, name); !ok {
+				return false
+			}
+		} else if !strings.Contains(name, f.name) {
+			return false
+		}
+	}
+	return true
+}
+
+// search returns matching entries, newest first
+func (l *queryLog) search(filter queryLogFilter) []queryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+
+	results := []queryLogEntry{}
+	for i := 1; i <= count && len(results) < filter.limit; i++ {
+		entry := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if filter.matches(entry) {
+			results = append(results, entry)
+		}
+	}
+	return results
+}
+
+// close flushes and closes the query log file
+func (l *queryLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
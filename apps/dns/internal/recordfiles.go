@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// sourceConfig attributes records to the YAML domains list
+const sourceConfig = "config"
+
+// loadRecordSet builds the local record set from all configured sources.
+// Precedence is: PTR overrides and YAML domains, then zone files, then
+// secondary zones, then hosts files, each in the order they are listed, then
+// DHCP leases. The first source to define a
+// name/type pair wins. PTR records are synthesized for remaining addresses,
+// then signed zones are signed over the final records.
+func (s *Server) loadRecordSet() (*recordSet, error) {
+	b := newRecordSetBuilder(s.logger)
+
+	b.addPTROverrides(s.cfg.Reverse.Overrides)
+
+	for _, domain := range s.cfg.Domains {
+		b.addDomain(domain, sourceConfig)
+	}
+
+	for _, zone := range s.cfg.ZoneFiles {
+		if err := b.loadZoneFile(zone); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, zone := range s.secondaries {
+		b.addSecondaryZone(zone)
+	}
+
+	for _, path := range s.cfg.HostsFiles {
+		if err := b.loadHostsFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.dhcp != nil {
+		b.addDHCPLeases(s.dhcp.activeLeases(), s.dhcp.domain)
+	}
+
+	if !s.cfg.Reverse.Disabled {
+		b.synthesizePTR(s.cfg.Reverse.Canonical)
+	}
+
+	b.signZones(s.signers, s.cfg.DNSSEC.SignatureValidity)
+
+	return b.build(), nil
+}
+
+// loadZoneFile parses a BIND-style zone file with the miekg/dns zone parser
+func (b *recordSetBuilder) loadZoneFile(zone ZoneFileConfig) error {
+	f, stamp, err := openStamped(zone.Path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	origin := ""
+	if zone.Origin != "" {
+		origin = dnslib.Fqdn(zone.Origin)
+	}
+
+	zp := dnslib.NewZoneParser(f, origin, zone.Path)
+	zp.SetIncludeAllowed(true)
+
+	count := 0
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		b.add(rr, zone.Path)
+		count++
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("failed to parse zone file %s: %w", zone.Path, err)
+	}
+
+	b.stamps[zone.Path] = stamp
+	b.logger.Info("Loaded zone file:", zone.Path, "records:", count)
+	return nil
+}
+
+// loadHostsFile parses an /etc/hosts style file ("IP name [aliases...]" per line)
+func (b *recordSetBuilder) loadHostsFile(path string) error {
+	f, stamp, err := openStamped(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			b.logger.Warn("Skipping hosts entry without names:", fmt.Sprintf("%s:%d", path, lineNo))
+			continue
+		}
+
+		// Drop IPv6 zone identifiers such as fe80::1%eth0
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			b.logger.Warn("Skipping hosts entry with invalid IP:", fmt.Sprintf("%s:%d", path, lineNo), fields[0])
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			if _, ok := dnslib.IsDomainName(name); !ok {
+				b.logger.Warn("Skipping invalid hosts name:", fmt.Sprintf("%s:%d", path, lineNo), name)
+				continue
+			}
+			b.addAddress(name, ip, path)
+			count++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read hosts file %s: %w", path, err)
+	}
+
+	b.stamps[path] = stamp
+	b.logger.Info("Loaded hosts file:", path, "records:", count)
+	return nil
+}
+
+// openStamped opens a file and records its modification time and size
+func openStamped(path string) (*os.File, fileStamp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fileStamp{}, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fileStamp{}, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return f, fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// filesChanged reports whether any source file differs from when rs was loaded
+func (rs *recordSet) filesChanged() bool {
+	for path, stamp := range rs.stamps {
+		info, err := os.Stat(path)
+		if err != nil {
+			return true
+		}
+		if !info.ModTime().Equal(stamp.modTime) || info.Size() != stamp.size {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadRecords rebuilds the record set and swaps it in. On failure the
+// previous record set keeps being served.
+func (s *Server) reloadRecords() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	rs, err := s.loadRecordSet()
+	if err != nil {
+		return err
+	}
+	s.records.Store(rs)
+	s.logger.Info("Local records loaded:", rs.count())
+	if s.mdns != nil {
+		s.mdns.announceRecords()
+	}
+	if s.transfers != nil {
+		s.transfers.update(rs, time.Now())
+	}
+	return nil
+}
+
+// watchRecordFiles polls zone and hosts files and reloads records when they
+// change or when signatures of signed zones are due for renewal
+func (s *Server) watchRecordFiles(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			rs := s.records.Load()
+			switch {
+			case rs.filesChanged():
+				s.logger.Info("Record source files changed, reloading")
+			case !rs.resignAt.IsZero() && time.Now().After(rs.resignAt):
+				s.logger.Info("Signatures due for renewal, re-signing zones")
+			default:
+				continue
+			}
+			if err := s.reloadRecords(); err != nil {
+				s.logger.Error("Failed to reload records, keeping previous set:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// localRecordTTL is the TTL used for records that do not carry their own (YAML and hosts entries)
+const localRecordTTL = 3600
+
+// maxCNAMEChain bounds how many local CNAMEs are followed for a single question
+const maxCNAMEChain = 8
+
+// recordKey identifies an RRset by owner name and type
+type recordKey struct {
+	name   string
+	rrtype uint16
+}
+
+// wildcardRecords holds the records of a wildcard owner name such as *.waguri.san
+type wildcardRecords struct {
+	domain  string
+	pattern *regexp.Regexp
+	records []dnslib.RR
+}
+
+// fileStamp is used to detect changes to record source files
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// recordSet is an immutable snapshot of all locally served records.
+// It is rebuilt from scratch on every reload and swapped in atomically.
+type recordSet struct {
+	exact     map[string][]dnslib.RR
+	wildcards []*wildcardRecords
+	stamps    map[string]fileStamp
+	// zones are the signed local zones, most specific first
+	zones []*signedZone
+	// resignAt is when signatures must be refreshed; zero without signed zones
+	resignAt time.Time
+}
+
+// recordSetBuilder merges records from several sources. Sources must be added in
+// precedence order: the first source to define an RRset owns it, and records for
+// the same name and type from later sources are dropped with a warning.
+type recordSetBuilder struct {
+	logger  *telemetry.Logger
+	records map[string][]dnslib.RR
+	owners  map[recordKey]string
+	stamps  map[string]fileStamp
+	// addresses keeps accepted A/AAAA records in insertion order for PTR synthesis
+	addresses []dnslib.RR
+	zones     []*signedZone
+	resignAt  time.Time
+}
+
+func newRecordSetBuilder(logger *telemetry.Logger) *recordSetBuilder {
+	return &recordSetBuilder{
+		logger:  logger,
+		records: make(map[string][]dnslib.RR),
+		owners:  make(map[recordKey]string),
+		stamps:  make(map[string]fileStamp),
+	}
+}
+
+// add inserts a record attributed to the given source (config, or a file path)
+func (b *recordSetBuilder) add(rr dnslib.RR, source string) {
+	hdr := rr.Header()
+	hdr.Name = strings.ToLower(dnslib.Fqdn(hdr.Name))
+	key := recordKey{name: hdr.Name, rrtype: hdr.Rrtype}
+
+	if owner, ok := b.owners[key]; ok && owner != source {
+		if !b.hasDuplicate(rr) {
+			b.logger.Warn("Record conflict:", rr.String(), "from", source, "ignored, already defined by", owner)
+		}
+		return
+	}
+
+	// A CNAME cannot coexist with other data for the same name
+	for _, existing := range b.records[hdr.Name] {
+		existingType := existing.Header().Rrtype
+		if existingType == hdr.Rrtype || (existingType != dnslib.TypeCNAME && hdr.Rrtype != dnslib.TypeCNAME) {
+			continue
+		}
+		if owner := b.owners[recordKey{name: hdr.Name, rrtype: existingType}]; owner != source {
+			b.logger.Warn("Record conflict:", rr.String(), "from", source, "ignored, CNAME clash with records from", owner)
+			return
+		}
+	}
+
+	if b.hasDuplicate(rr) {
+		return
+	}
+
+	b.owners[key] = source
+	b.records[hdr.Name] = append(b.records[hdr.Name], rr)
+	if hdr.Rrtype == dnslib.TypeA || hdr.Rrtype == dnslib.TypeAAAA {
+		b.addresses = append(b.addresses, rr)
+	}
+}
+
+// hasDuplicate reports whether an identical record is already present
+func (b *recordSetBuilder) hasDuplicate(rr dnslib.RR) bool {
+	for _, existing := range b.records[rr.Header().Name] {
+		if dnslib.IsDuplicate(existing, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addAddress adds an A or AAAA record for name depending on the IP family
+func (b *recordSetBuilder) addAddress(name string, ip net.IP, source string) {
+	hdr := dnslib.RR_Header{Name: dnslib.Fqdn(name), Class: dnslib.ClassINET, Ttl: localRecordTTL}
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = dnslib.TypeA
+		b.add(&dnslib.A{Hdr: hdr, A: ip4}, source)
+		return
+	}
+	hdr.Rrtype = dnslib.TypeAAAA
+	b.add(&dnslib.AAAA{Hdr: hdr, AAAA: ip}, source)
+}
+
+// addDomain adds a YAML domain entry as an A/AAAA or CNAME record
+func (b *recordSetBuilder) addDomain(domain DomainConfig, source string) {
+	if domain.CNAME == "" {
+		b.addAddress(domain.Name, net.ParseIP(domain.IP), source)
+		return
+	}
+	b.add(&dnslib.CNAME{
+		Hdr:    dnslib.RR_Header{Name: dnslib.Fqdn(domain.Name), Rrtype: dnslib.TypeCNAME, Class: dnslib.ClassINET, Ttl: localRecordTTL},
+		Target: strings.ToLower(dnslib.Fqdn(domain.CNAME)),
+	}, source)
+}
+
+// build compiles wildcard owner names and returns the finished record set
+func (b *recordSetBuilder) build() *recordSet {
+	rs := &recordSet{
+		exact:    make(map[string][]dnslib.RR),
+		stamps:   b.stamps,
+		zones:    b.zones,
+		resignAt: b.resignAt,
+	}
+
+	for name, records := range b.records {
+		if !strings.Contains(name, "*") {
+			rs.exact[name] = records
+			continue
+		}
+
+		// Convert wildcard pattern to regex
+		// *.waguri.san becomes ^[^.]+\.waguri\.san$
+		domain := strings.TrimSuffix(name, ".")
+		regexPattern := strings.ReplaceAll(domain, ".", "\\.")
+		regexPattern = strings.ReplaceAll(regexPattern, "*", "[^.]+")
+		regexPattern = "^" + regexPattern + "$"
+
+		compiled, err := regexp.Compile(regexPattern)
+		if err != nil {
+			b.logger.Error("Failed to compile wildcard pattern for", domain, err)
+			continue
+		}
+		rs.wildcards = append(rs.wildcards, &wildcardRecords{domain: domain, pattern: compiled, records: records})
+		b.logger.Info("Compiled wildcard pattern:", domain, "->", regexPattern)
+	}
+
+	// Try more specific patterns first so results do not depend on map order
+	sort.Slice(rs.wildcards, func(i, j int) bool {
+		if len(rs.wildcards[i].domain) != len(rs.wildcards[j].domain) {
+			return len(rs.wildcards[i].domain) > len(rs.wildcards[j].domain)
+		}
+		return rs.wildcards[i].domain < rs.wildcards[j].domain
+	})
+
+	return rs
+}
+
+// count returns the total number of records in the set
+func (rs *recordSet) count() int {
+	total := 0
+	for _, records := range rs.exact {
+		total += len(records)
+	}
+	for _, wc := range rs.wildcards {
+		total += len(wc.records)
+	}
+	return total
+}
+
+// zoneFor returns the signed zone name belongs to, or nil
+func (rs *recordSet) zoneFor(name string) *signedZone {
+	name = strings.ToLower(dnslib.Fqdn(name))
+	for _, zone := range rs.zones {
+		if dnslib.IsSubDomain(zone.name, name) {
+			return zone
+		}
+	}
+	return nil
+}
+
+// lookup returns all records owned by name, checking exact names first and then
+// wildcard patterns. Records synthesized from a wildcard are renamed to name.
+func (rs *recordSet) lookup(name string) ([]dnslib.RR, bool) {
+	fqdn := strings.ToLower(dnslib.Fqdn(name))
+	if records, ok := rs.exact[fqdn]; ok {
+		return records, true
+	}
+
+	// Signed zones follow RFC 4592 so answers agree with their denial proofs:
+	// only the wildcard at the closest encloser applies, at any depth
+	if zone := rs.zoneFor(fqdn); zone != nil {
+		wildcard := "*." + strings.TrimSuffix(zone.closestEncloser(fqdn), ".")
+		for _, wc := range rs.wildcards {
+			if wc.domain == wildcard {
+				return wc.synthesize(fqdn), true
+			}
+		}
+		return nil, false
+	}
+
+	domain := strings.TrimSuffix(fqdn, ".")
+	for _, wc := range rs.wildcards {
+		if wc.pattern.MatchString(domain) {
+			return wc.synthesize(fqdn), true
+		}
+	}
+
+	return nil, false
+}
+
+// synthesize returns copies of the wildcard's records owned by fqdn
+func (wc *wildcardRecords) synthesize(fqdn string) []dnslib.RR {
+	records := make([]dnslib.RR, 0, len(wc.records))
+	for _, rr := range wc.records {
+		synthesized := dnslib.Copy(rr)
+		synthesized.Header().Name = fqdn
+		records = append(records, synthesized)
+	}
+	return records
+}
+
+// recordLayers resolves names against several record sets in order; the first
+// set that owns a name answers for it. Client group overrides sit in front of
+// the global records this way.
+type recordLayers []*recordSet
+
+// lookup returns the records of the first layer that owns name
+func (l recordLayers) lookup(name string) ([]dnslib.RR, bool) {
+	for _, rs := range l {
+		if records, ok := rs.lookup(name); ok {
+			return records, true
+		}
+	}
+	return nil, false
+}
+
+// resolve answers a question from the layers, following local CNAME chains.
+// The boolean reports whether the name is served locally; an empty answer with
+// true means the name exists but has no data of the requested type. When the
+// chain ends in a CNAME whose target is not local, that target is returned so
+// the caller can resolve it upstream.
+func (l recordLayers) resolve(q dnslib.Question) ([]dnslib.RR, string, bool) {
+	var answer []dnslib.RR
+	name := q.Name
+
+	for depth := 0; depth < maxCNAMEChain; depth++ {
+		records, ok := l.lookup(name)
+		if !ok {
+			if depth == 0 {
+				return nil, "", false
+			}
+			return answer, name, true
+		}
+
+		var cname *dnslib.CNAME
+		for _, rr := range records {
+			rrtype := rr.Header().Rrtype
+			if rrtype == q.Qtype || q.Qtype == dnslib.TypeANY {
+				answer = append(answer, withOwner(rr, name))
+			} else if c, isCNAME := rr.(*dnslib.CNAME); isCNAME {
+				cname = c
+			}
+		}
+
+		if cname == nil || q.Qtype == dnslib.TypeCNAME || q.Qtype == dnslib.TypeANY {
+			return answer, "", true
+		}
+
+		answer = append(answer, withOwner(cname, name))
+		name = cname.Target
+	}
+
+	return answer, "", true
+}
+
+// signatures returns the local RRSIGs covering the RRsets in answer, so
+// presigned zone files can be served to clients that set the DO bit
+func (l recordLayers) signatures(answer []dnslib.RR) []dnslib.RR {
+	var sigs []dnslib.RR
+	seen := make(map[recordKey]bool)
+	for _, rr := range answer {
+		key := recordKey{name: strings.ToLower(rr.Header().Name), rrtype: rr.Header().Rrtype}
+		if seen[key] || key.rrtype == dnslib.TypeRRSIG {
+			continue
+		}
+		seen[key] = true
+
+		records, _ := l.lookup(rr.Header().Name)
+		for _, candidate := range records {
+			if sig, ok := candidate.(*dnslib.RRSIG); ok && sig.TypeCovered == key.rrtype {
+				sigs = append(sigs, withOwner(sig, rr.Header().Name))
+			}
+		}
+	}
+	return sigs
+}
+
+// withOwner returns rr with its owner name set to the queried spelling of name
+func withOwner(rr dnslib.RR, name string) dnslib.RR {
+	if rr.Header().Name == name {
+		return rr
+	}
+	out := dnslib.Copy(rr)
+	out.Header().Name = name
+	return out
+}
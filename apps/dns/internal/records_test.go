@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"testing"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+func TestLookupSignedWildcard(t *testing.T) {
+	rs := signTestZone(t, false).build()
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"y.w.example.", true},
+		// RFC 4592: the wildcard covers every label below its closest encloser
+		{"a.b.w.example.", true},
+		// v.w.example. exists, so its subdomains are not under the wildcard
+		{"x.v.w.example.", false},
+		{"x.example.", false},
+	}
+	for _, tt := range tests {
+		records, ok := rs.lookup(tt.name)
+		if ok != tt.want {
+			t.Errorf("lookup(%s) found = %v, want %v", tt.name, ok, tt.want)
+			continue
+		}
+		for _, rr := range records {
+			if rr.Header().Name != tt.name {
+				t.Errorf("lookup(%s) returned a record owned by %s", tt.name, rr.Header().Name)
+			}
+		}
+	}
+}
+
+func TestSignZonesRefusesPatternWildcards(t *testing.T) {
+	logger := telemetry.NewLogger("/dev/null", "test")
+	signers, err := loadZoneSigners(DNSSECConfig{Sign: []SignedZoneConfig{{Name: "example."}}}, logger)
+	if err != nil {
+		t.Fatalf("loadZoneSigners: %v", err)
+	}
+	b := newRecordSetBuilder(logger)
+	rr, err := dnslib.NewRR("web-*.example. 300 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatalf("NewRR: %v", err)
+	}
+	b.add(rr, "test")
+	b.signZones(signers, time.Hour)
+
+	if len(b.zones) != 0 {
+		t.Fatalf("zone with a pattern wildcard was signed")
+	}
+	if _, ok := b.build().lookup("web-1.example."); !ok {
+		t.Errorf("pattern wildcard no longer answers in the unsigned zone")
+	}
+}
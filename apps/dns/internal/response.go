@@ -0,0 +1,82 @@
+package internal
+
+import (
+	dnslib "github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP payload size we advertise, per the DNS flag day 2020 recommendation
+const ednsUDPSize = 1232
+
+// newReply creates an empty, non-authoritative reply to r with the given rcode
+func newReply(r *dnslib.Msg, rcode int) *dnslib.Msg {
+	m := new(dnslib.Msg)
+	m.SetRcode(r, rcode)
+	return m
+}
+
+// forwardedReply turns an upstream response into the reply for r. The upstream
+// rcode and all sections are kept; header fields are taken from the client's
+// query, and AA is cleared since the data is not ours.
+func forwardedReply(r *dnslib.Msg, resp *dnslib.Msg) *dnslib.Msg {
+	m := resp.Copy()
+	m.Id = r.Id
+	m.Response = true
+	m.Opcode = r.Opcode
+	m.Authoritative = false
+	m.CheckingDisabled = r.CheckingDisabled
+	m.Question = r.Question
+	return m
+}
+
+// finalizeResponse applies the header flags and EDNS0 handling shared by every
+// reply: RD mirrors the query, RA is always offered, the OPT record is rebuilt
+// for the client, and UDP replies are truncated to the client's buffer size.
+func finalizeResponse(r *dnslib.Msg, m *dnslib.Msg, transport string) {
+	m.Id = r.Id
+	m.Response = true
+	m.RecursionDesired = r.RecursionDesired
+	m.RecursionAvailable = true
+
+	// Take the upstream OPT out of the additional section, keep its options
+	var upstreamOpt *dnslib.OPT
+	var extra []dnslib.RR
+	for _, rr := range m.Extra {
+		if opt, ok := rr.(*dnslib.OPT); ok {
+			upstreamOpt = opt
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	m.Extra = extra
+
+	clientOpt := r.IsEdns0()
+	if clientOpt == nil {
+		// Extended rcodes cannot be expressed without EDNS
+		if m.Rcode > 0xF {
+			m.Rcode = dnslib.RcodeServerFailure
+		}
+	} else {
+		opt := &dnslib.OPT{Hdr: dnslib.RR_Header{Name: ".", Rrtype: dnslib.TypeOPT}}
+		opt.SetUDPSize(ednsUDPSize)
+		opt.SetDo(clientOpt.Do())
+		if upstreamOpt != nil {
+			for _, option := range upstreamOpt.Option {
+				// Client subnet and cookies are hop-by-hop and must not be relayed
+				switch option.Option() {
+				case dnslib.EDNS0SUBNET, dnslib.EDNS0COOKIE, dnslib.EDNS0TCPKEEPALIVE, dnslib.EDNS0PADDING:
+					continue
+				}
+				opt.Option = append(opt.Option, option)
+			}
+		}
+		m.Extra = append(m.Extra, opt)
+	}
+
+	if transport == transportUDP {
+		size := dnslib.MinMsgSize
+		if clientOpt != nil && int(clientOpt.UDPSize()) > size {
+			size = int(clientOpt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// sourceSynthesized attributes PTR records generated from local A/AAAA records
+const sourceSynthesized = "synthesized"
+
+// addPTROverrides adds the explicitly configured PTR records. They are added
+// before any other source so they always win over synthesized records.
+func (b *recordSetBuilder) addPTROverrides(overrides []PTROverride) {
+	for _, override := range overrides {
+		reverse, err := dnslib.ReverseAddr(override.IP)
+		if err != nil {
+			b.logger.Error("Skipping invalid PTR override for", override.IP, err)
+			continue
+		}
+		b.add(&dnslib.PTR{
+			Hdr: dnslib.RR_Header{Name: reverse, Rrtype: dnslib.TypePTR, Class: dnslib.ClassINET, Ttl: localRecordTTL},
+			Ptr: strings.ToLower(dnslib.Fqdn(override.Name)),
+		}, sourceConfig)
+	}
+}
+
+// synthesizePTR creates one PTR record per local address that has no PTR yet.
+// When several names share an address, strategy picks the canonical one.
+func (b *recordSetBuilder) synthesizePTR(strategy string) {
+	candidates := make(map[string]dnslib.RR)
+	var order []string
+
+	for _, rr := range b.addresses {
+		name := rr.Header().Name
+		if strings.Contains(name, "*") {
+			continue
+		}
+
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dnslib.A:
+			ip = v.A
+		case *dnslib.AAAA:
+			ip = v.AAAA
+		}
+		reverse, err := dnslib.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+
+		current, ok := candidates[reverse]
+		if !ok {
+			candidates[reverse] = rr
+			order = append(order, reverse)
+			continue
+		}
+		if strategy == canonicalShortest && dnslib.CountLabel(name) < dnslib.CountLabel(current.Header().Name) {
+			candidates[reverse] = rr
+		}
+	}
+
+	for _, reverse := range order {
+		rr := candidates[reverse]
+		if _, exists := b.owners[recordKey{name: reverse, rrtype: dnslib.TypePTR}]; exists {
+			continue
+		}
+		b.add(&dnslib.PTR{
+			Hdr: dnslib.RR_Header{Name: reverse, Rrtype: dnslib.TypePTR, Class: dnslib.ClassINET, Ttl: rr.Header().Ttl},
+			Ptr: rr.Header().Name,
+		}, sourceSynthesized)
+	}
+}
+
+// reverseNameToIP converts a full in-addr.arpa or ip6.arpa name back to an IP.
+// It returns nil for partial or malformed reverse names.
+func reverseNameToIP(name string) net.IP {
+	name = strings.ToLower(dnslib.Fqdn(name))
+
+	if strings.HasSuffix(name, ".in-addr.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(octet)
+		}
+		return ip
+	}
+
+	if strings.HasSuffix(name, ".ip6.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			pos := len(labels) - 1 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(nibble) << 4
+			} else {
+				ip[pos/2] |= byte(nibble)
+			}
+		}
+		return ip
+	}
+
+	return nil
+}
+
+// isPrivateReverse reports whether name is a reverse lookup for an address in
+// one of the configured private ranges
+func (s *Server) isPrivateReverse(name string) bool {
+	ip := reverseNameToIP(name)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.privateNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
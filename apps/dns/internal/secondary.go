@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// secondaryInitialRetry is how often a zone that was never loaded is retried
+const secondaryInitialRetry = 30 * time.Second
+
+// minSecondaryInterval bounds SOA refresh and retry timers from below
+const minSecondaryInterval = 10 * time.Second
+
+// secondaryZone is a zone pulled from a primary server and served read-only
+type secondaryZone struct {
+	name      string
+	primaries []string
+	key       tsigKey
+	secrets   map[string]string
+	logger    *telemetry.Logger
+	// onChange is called after the zone was transferred or expired
+	onChange func()
+	// refreshNow triggers an immediate serial check, e.g. on NOTIFY
+	refreshNow chan struct{}
+
+	mu      sync.Mutex
+	soa     *dnslib.SOA
+	records []dnslib.RR
+	// checked is when a primary last confirmed our serial
+	checked time.Time
+	expired bool
+}
+
+func newSecondaryZone(cfg SecondaryZone, secrets map[string]string, keys map[string]tsigKey, logger *telemetry.Logger, onChange func()) *secondaryZone {
+	z := &secondaryZone{
+		name:       dnslib.CanonicalName(cfg.Zone),
+		secrets:    secrets,
+		logger:     logger,
+		onChange:   onChange,
+		refreshNow: make(chan struct{}, 1),
+	}
+	if cfg.TSIGKey != "" {
+		z.key = keys[dnslib.CanonicalName(cfg.TSIGKey)]
+	}
+	for _, primary := range cfg.Primaries {
+		z.primaries = append(z.primaries, withDefaultPort(primary, "53"))
+	}
+	return z
+}
+
+// run keeps the zone up to date until stop is closed
+func (z *secondaryZone) run(stop <-chan struct{}) {
+	for {
+		timer := time.NewTimer(z.refresh(time.Now()))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-z.refreshNow:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// notify schedules a serial check without waiting for the refresh timer
+func (z *secondaryZone) notify() {
+	select {
+	case z.refreshNow <- struct{}{}:
+	default:
+	}
+}
+
+// refresh asks the primaries for their serial and transfers the zone when it
+// is newer. It returns when to check again: the SOA refresh interval after
+// success, the retry interval after failure. The zone expires when no primary
+// confirmed it for the SOA expire interval.
+func (z *secondaryZone) refresh(now time.Time) time.Duration {
+	z.mu.Lock()
+	soa, checked := z.soa, z.checked
+	z.mu.Unlock()
+
+	for _, primary := range z.primaries {
+		serial, err := z.primarySerial(primary)
+		if err != nil {
+			z.logger.Warn("Secondary zone", z.name, "- SOA query to", primary, "failed:", err)
+			continue
+		}
+		if soa != nil && !serialNewer(serial, soa.Serial) {
+			z.mu.Lock()
+			z.checked = now
+			expired := z.expired
+			z.expired = false
+			z.mu.Unlock()
+			if expired {
+				z.onChange()
+			}
+			return secondaryInterval(soa.Refresh)
+		}
+
+		newSOA, records, err := z.transfer(primary)
+		if err != nil {
+			z.logger.Warn("Secondary zone", z.name, "- transfer from", primary, "failed:", err)
+			continue
+		}
+		z.mu.Lock()
+		z.soa, z.records, z.checked, z.expired = newSOA, records, now, false
+		z.mu.Unlock()
+		z.logger.Info("Secondary zone", z.name, "transferred from", primary, "- serial", newSOA.Serial, "records:", len(records))
+		z.onChange()
+		return secondaryInterval(newSOA.Refresh)
+	}
+
+	if soa == nil {
+		return secondaryInitialRetry
+	}
+	if now.Sub(checked) > time.Duration(soa.Expire)*time.Second {
+		z.mu.Lock()
+		expired := z.expired
+		z.expired = true
+		z.mu.Unlock()
+		if !expired {
+			z.logger.Error("Secondary zone", z.name, "expired, no primary reachable since", checked.Format(time.RFC3339))
+			z.onChange()
+		}
+	}
+	return secondaryInterval(soa.Retry)
+}
+
+func secondaryInterval(seconds uint32) time.Duration {
+	return max(time.Duration(seconds)*time.Second, minSecondaryInterval)
+}
+
+// primarySerial queries the SOA serial of the zone at primary
+func (z *secondaryZone) primarySerial(primary string) (uint32, error) {
+	m := new(dnslib.Msg)
+	m.SetQuestion(z.name, dnslib.TypeSOA)
+	z.key.sign(m)
+
+	client := &dnslib.Client{Timeout: transferTimeout, TsigSecret: z.secrets}
+	resp, _, err := client.Exchange(m, primary)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode != dnslib.RcodeSuccess {
+		return 0, fmt.Errorf("primary answered %s", dnslib.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dnslib.SOA); ok && dnslib.CanonicalName(soa.Hdr.Name) == z.name {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no SOA in answer")
+}
+
+// transfer pulls the whole zone from primary over AXFR
+func (z *secondaryZone) transfer(primary string) (*dnslib.SOA, []dnslib.RR, error) {
+	m := new(dnslib.Msg)
+	m.SetAxfr(z.name)
+	z.key.sign(m)
+
+	tr := &dnslib.Transfer{
+		DialTimeout:  transferTimeout,
+		ReadTimeout:  transferTimeout,
+		WriteTimeout: transferTimeout,
+		TsigSecret:   z.secrets,
+	}
+	envelopes, err := tr.In(m, primary)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var soa *dnslib.SOA
+	var records []dnslib.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, nil, envelope.Error
+		}
+		for _, rr := range envelope.RR {
+			if s, ok := rr.(*dnslib.SOA); ok && dnslib.CanonicalName(s.Hdr.Name) == z.name {
+				// The zone starts and ends with its SOA
+				if soa == nil {
+					soa = s
+				}
+				continue
+			}
+			if !dnslib.IsSubDomain(z.name, dnslib.CanonicalName(rr.Header().Name)) {
+				continue
+			}
+			records = append(records, rr)
+		}
+	}
+	if soa == nil {
+		return nil, nil, fmt.Errorf("transfer contained no SOA")
+	}
+	return soa, records, nil
+}
+
+// snapshot returns the zone's SOA and records; ok is false until the zone was
+// loaded and after it expired
+func (z *secondaryZone) snapshot() (*dnslib.SOA, []dnslib.RR, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.soa, z.records, z.soa != nil && !z.expired
+}
+
+// fromPrimary reports whether ip belongs to one of the zone's primaries
+func (z *secondaryZone) fromPrimary(ip net.IP) bool {
+	for _, primary := range z.primaries {
+		host, _, _ := net.SplitHostPort(primary)
+		if addr := net.ParseIP(host); addr != nil {
+			if addr.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addSecondaryZone adds the records of a loaded secondary zone
+func (b *recordSetBuilder) addSecondaryZone(z *secondaryZone) {
+	soa, records, ok := z.snapshot()
+	if !ok {
+		return
+	}
+	source := "secondary zone " + strings.TrimSuffix(z.name, ".")
+	b.add(dnslib.Copy(soa), source)
+	for _, rr := range records {
+		b.add(dnslib.Copy(rr), source)
+	}
+	b.logger.Info("Loaded secondary zone:", z.name, "serial", soa.Serial, "records:", len(records))
+}
+
+// secondaryFor returns the most specific secondary zone containing name
+func (s *Server) secondaryFor(name string) *secondaryZone {
+	name = dnslib.CanonicalName(name)
+	var best *secondaryZone
+	for _, z := range s.secondaries {
+		if dnslib.IsSubDomain(z.name, name) && (best == nil || len(z.name) > len(best.name)) {
+			best = z
+		}
+	}
+	return best
+}
+
+// handleNotify acknowledges a NOTIFY from the primary of a secondary zone
+// and schedules a serial check (RFC 1996)
+func (s *Server) handleNotify(w dnslib.ResponseWriter, r *dnslib.Msg) {
+	reply := func(rcode int) {
+		m := newReply(r, rcode)
+		m.Authoritative = rcode == dnslib.RcodeSuccess
+		signReply(w, r, m)
+		_ = w.WriteMsg(m)
+	}
+
+	if len(r.Question) != 1 {
+		reply(dnslib.RcodeFormatError)
+		return
+	}
+	name := dnslib.CanonicalName(r.Question[0].Name)
+	var zone *secondaryZone
+	for _, z := range s.secondaries {
+		if z.name == name {
+			zone = z
+		}
+	}
+	if zone == nil {
+		reply(dnslib.RcodeNotAuth)
+		return
+	}
+	if !zone.fromPrimary(addrIP(w.RemoteAddr())) {
+		s.logger.Warn("Ignoring NOTIFY for", name, "from", w.RemoteAddr(), "- not a primary")
+		reply(dnslib.RcodeRefused)
+		return
+	}
+	if zone.key.name != "" {
+		tsig := r.IsTsig()
+		if tsig == nil || dnslib.CanonicalName(tsig.Hdr.Name) != zone.key.name || w.TsigStatus() != nil {
+			s.logger.Warn("Ignoring NOTIFY for", name, "from", w.RemoteAddr(), "- missing or invalid TSIG")
+			reply(dnslib.RcodeNotAuth)
+			return
+		}
+	}
+
+	s.logger.Info("NOTIFY for", name, "from", w.RemoteAddr())
+	zone.notify()
+	reply(dnslib.RcodeSuccess)
+}
@@ -2,9 +2,14 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"regexp"
+	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"waguri-centralized-control/packages/go-utils/telemetry"
 
 	dnslib "github.com/miekg/dns"
@@ -14,124 +19,488 @@ type Server struct {
 	cfg       *DNSConfig
 	logger    *telemetry.Logger
 	dnsServer *dnslib.Server
-	// Compiled regex patterns for wildcard domains
-	wildcardPatterns map[*regexp.Regexp]string
+	tcpServer *dnslib.Server
+	dotServer *dnslib.Server
+	dohServer *http.Server
+	certs     *certReloader
+	// Number of queries received per transport
+	transports namedCounters
+	// Local records from the YAML config, zone files, hosts files and DHCP leases
+	records  atomic.Pointer[recordSet]
+	reloadMu sync.Mutex
+	// Reverse lookups in these ranges are never forwarded upstream
+	privateNets []*net.IPNet
+	// Default upstream resolvers, tried in order
+	upstreams []upstream
+	// Conditional forwarding rules, longest suffix first
+	forwardRules []*forwardRule
+	blocker      *blocker
+	groups       []*clientGroup
+	queryLog     *queryLog
+	stats        *queryStats
+	limits       *limiter
+	// Identical upstream queries in flight share one exchange
+	inflight flightGroup
+	// Forwarded answers, nil when caching is disabled
+	cache     *answerCache
+	apiServer *http.Server
+	// DNSSEC validator for forwarded answers, nil when validation is disabled
+	validator *validator
+	// Keys of local zones that are signed online
+	signers []*zoneSigner
+	// DHCP server publishing lease hostnames, nil when disabled
+	dhcp *dhcpServer
+	// mDNS bridge for the configured zone and announced records, nil when disabled
+	mdns *mdnsBridge
+	// TSIG secrets by key name for listeners and transfer clients
+	tsigSecrets map[string]string
+	// Zones served to secondaries over AXFR/IXFR, nil when none are configured
+	transfers *zoneTransfers
+	// Zones pulled from primaries
+	secondaries []*secondaryZone
+	stop        chan struct{}
 }
 
 func NewServer(cfg *DNSConfig, logger *telemetry.Logger) *Server {
 	server := &Server{
-		cfg:              cfg,
-		logger:           logger,
-		wildcardPatterns: make(map[*regexp.Regexp]string),
+		cfg:    cfg,
+		logger: logger,
+		stats:  newQueryStats(),
+		limits: newLimiter(cfg.Limits),
+		stop:   make(chan struct{}),
 	}
 
-	// Compile wildcard patterns
-	server.compileWildcardPatterns()
+	for _, cidr := range cfg.Reverse.PrivateRanges {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			server.privateNets = append(server.privateNets, network)
+		}
+	}
+
+	server.upstreams = newUpstreamPool(cfg.Upstreams, logger)
+	logger.Info("Registered default upstreams:", server.upstreams)
+	server.forwardRules = compileForwardRules(cfg.ForwardRules, logger)
+	server.blocker = newBlocker(cfg.Blocking, logger)
+	server.groups = compileClientGroups(cfg, logger)
+	if cfg.DNSSEC.Validate {
+		server.validator = newValidator(server, cfg.DNSSEC)
+		logger.Info("DNSSEC validation enabled - trust anchors:", len(cfg.DNSSEC.TrustAnchors), "negative trust anchors:", cfg.DNSSEC.NegativeTrustAnchors)
+	}
+	if !cfg.Cache.Disabled {
+		server.cache = newAnswerCache(cfg.Cache)
+		logger.Info("Answer cache enabled - size:", cfg.Cache.Size, "serve stale:", cfg.Cache.ServeStale)
+	}
+
+	secrets, keys := tsigKeys(cfg.TSIGKeys)
+	server.tsigSecrets = secrets
+	if len(cfg.Transfer.Zones) > 0 {
+		server.transfers = newZoneTransfers(cfg.Transfer, secrets, keys, logger)
+		logger.Info("Zone transfers enabled - zones:", cfg.Transfer.Zones, "notify:", cfg.Transfer.Notify)
+	}
+	for _, zone := range cfg.SecondaryZones {
+		server.secondaries = append(server.secondaries, newSecondaryZone(zone, secrets, keys, logger, func() {
+			if err := server.reloadRecords(); err != nil {
+				server.logger.Error("Failed to publish secondary zone", zone.Zone, "- keeping previous records:", err)
+			}
+		}))
+	}
 
 	return server
 }
 
-// compileWildcardPatterns converts wildcard domain patterns to regex
-func (s *Server) compileWildcardPatterns() {
-	for domain, ip := range s.cfg.Domains {
-		if strings.Contains(domain, "*") {
-			// Convert wildcard pattern to regex
-			// *.waguri.san becomes ^[^.]+\.waguri\.san$
-			regexPattern := strings.ReplaceAll(domain, ".", "\\.")
-			regexPattern = strings.ReplaceAll(regexPattern, "*", "[^.]+")
-			regexPattern = "^" + regexPattern + "$"
-
-			if compiled, err := regexp.Compile(regexPattern); err == nil {
-				s.wildcardPatterns[compiled] = ip
-				s.logger.Info("Compiled wildcard pattern:", domain, "->", regexPattern, "resolves to", ip)
-			} else {
-				s.logger.Error("Failed to compile wildcard pattern for", domain, err)
-			}
-		}
+// isZoneMaintenance reports whether r is a NOTIFY or an AXFR/IXFR request
+func isZoneMaintenance(r *dnslib.Msg) bool {
+	if r.Opcode == dnslib.OpcodeNotify {
+		return true
+	}
+	if r.Opcode != dnslib.OpcodeQuery || len(r.Question) != 1 {
+		return false
 	}
+	qtype := r.Question[0].Qtype
+	return qtype == dnslib.TypeAXFR || qtype == dnslib.TypeIXFR
 }
 
-// findDomainMatch checks for exact match first, then wildcard patterns
-func (s *Server) findDomainMatch(domain string) (string, bool) {
-	// First try exact match
-	if ip, ok := s.cfg.Domains[domain]; ok {
-		return ip, true
+func (s *Server) handleDNS(w dnslib.ResponseWriter, r *dnslib.Msg, transport string) {
+	// Log the incoming query details
+	start := time.Now()
+	clientAddr := w.RemoteAddr()
+	client := s.clientIP(w, r)
+	// Access control and rate limits use the real source, never the spoofable ECS option
+	remote := addrIP(clientAddr)
+	s.transports.inc(transport)
+	s.logger.Info("Received DNS query from", clientAddr, "via", transport, "- ID:", r.Id, "Questions:", len(r.Question))
+
+	var m *dnslib.Msg
+	var group *clientGroup
+	source := sourceLocal
+	switch {
+	case !s.limits.clientAllowed(remote):
+		m = newReply(r, dnslib.RcodeRefused)
+	case !s.limits.takeClient(remote):
+		// Dropping over UDP costs the flooding client a timeout; streams get an answer
+		if transport == transportUDP {
+			return
+		}
+		m = newReply(r, dnslib.RcodeRefused)
+	case transport == transportHTTPS && isZoneMaintenance(r):
+		// DoH neither verifies TSIG nor streams multi-message replies, so
+		// transfers and NOTIFY are only served over plain DNS
+		s.logger.Warn("Refusing zone transfer or NOTIFY over DoH from", clientAddr)
+		m = newReply(r, dnslib.RcodeRefused)
+	case r.Opcode == dnslib.OpcodeNotify:
+		s.handleNotify(w, r)
+		return
+	case r.Opcode != dnslib.OpcodeQuery:
+		m = newReply(r, dnslib.RcodeNotImplemented)
+	case len(r.Question) != 1:
+		// RFC 9619: QDCOUNT must be exactly one
+		s.logger.Error("Rejecting query with", len(r.Question), "questions from", clientAddr)
+		m = newReply(r, dnslib.RcodeFormatError)
+	case r.Question[0].Qtype == dnslib.TypeAXFR || r.Question[0].Qtype == dnslib.TypeIXFR:
+		s.serveTransfer(w, r, transport)
+		return
+	default:
+		group = s.matchClientGroup(client)
+		if group != nil {
+			s.logger.Info("Client", clientAddr, "matched client group", group.name)
+		}
+		m, source = s.resolveQuestion(r, r.Question[0], group)
 	}
 
-	// Then try wildcard patterns
-	for pattern, ip := range s.wildcardPatterns {
-		if pattern.MatchString(domain) {
-			return ip, true
+	finalizeResponse(r, m, transport)
+	if transport == transportUDP {
+		switch s.limits.limitResponse(remote, m) {
+		case rrlDrop:
+			return
+		case rrlSlip:
+			m = truncatedReply(r, m)
+			finalizeResponse(r, m, transport)
 		}
 	}
 
-	return "", false
+	entry := newQueryLogEntry(start, client, transport, group, r, m, source)
+	s.stats.record(entry)
+	if err := s.queryLog.add(entry); err != nil {
+		s.logger.Error("Failed to write query log:", err)
+	}
+
+	// Log the response being sent
+	s.logger.Info("Sending response to", clientAddr, "via", transport, "- ID:", m.Id, "Answers:", len(m.Answer), "Rcode:", dnslib.RcodeToString[m.Rcode])
+
+	// Log each answer record
+	for _, ans := range m.Answer {
+		s.logger.Info("Response record:", ans.String())
+	}
+
+	_ = w.WriteMsg(m)
 }
 
-func (s *Server) handleDNS(w dnslib.ResponseWriter, r *dnslib.Msg) {
-	m := new(dnslib.Msg)
-	m.SetReply(r)
-	m.Authoritative = true
+// resolveQuestion produces the reply for a single question: blocked, local or
+// forwarded. It also returns how the question was answered for the query log.
+func (s *Server) resolveQuestion(r *dnslib.Msg, q dnslib.Question, group *clientGroup) (*dnslib.Msg, string) {
+	s.logger.Info("Query:", q.Name, "Type:", dnslib.TypeToString[q.Qtype], "Class:", dnslib.ClassToString[q.Qclass])
 
-	// Log the incoming query details
-	clientAddr := w.RemoteAddr()
-	s.logger.Info("Received DNS query from", clientAddr, "- ID:", r.Id, "Questions:", len(r.Question))
+	// Blocklists are checked before anything else
+	if list, blocked := s.blocker.check(q.Name, group.blocklistEnabled()); blocked {
+		m := newReply(r, dnslib.RcodeSuccess)
+		s.blocker.blockedResponse(m, q)
+		s.logger.Info("Blocked query:", q.Name, "by list", list)
+		return m, sourceBlocked
+	}
 
-	for _, q := range r.Question {
-		s.logger.Info("Query:", q.Name, "Type:", dnslib.TypeToString[q.Qtype], "Class:", dnslib.ClassToString[q.Qclass])
+	// Transferred zones answer with the serial secondaries see, which is
+	// managed here when the local records define no SOA
+	if soa := s.transfers.soa(q.Name); soa != nil && q.Qtype == dnslib.TypeSOA {
+		m := newReply(r, dnslib.RcodeSuccess)
+		m.Authoritative = true
+		m.Answer = []dnslib.RR{soa}
+		return m, sourceLocal
+	}
 
-		name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	// Lookup using both exact and wildcard matching, group overrides first
+	records := s.recordsFor(group)
+	zone := s.records.Load().zoneFor(q.Name)
+	if answers, target, ok := records.resolve(q); ok {
+		m := newReply(r, dnslib.RcodeSuccess)
+		m.Authoritative = true
+		m.Answer = answers
+		if dnssecOK(r) {
+			m.Answer = append(m.Answer, records.signatures(answers)...)
+		}
+		if zone != nil && len(answers) == 0 {
+			m.Ns = zone.negative(q.Name, false, dnssecOK(r))
+		} else if zone != nil && dnssecOK(r) {
+			m.Ns = zone.wildcardProof(q.Name)
+		}
+		s.logger.Info("Local resolution:", q.Name, "- Answers:", len(answers))
 
-		// Lookup using both exact and wildcard matching
-		ip, ok := s.findDomainMatch(name)
-		if ok {
-			rr, err := dnslib.NewRR(fmt.Sprintf("%s A %s", q.Name, ip))
+		// A local CNAME pointing outside our records, e.g. a SafeSearch override
+		if target != "" {
+			chase := dnslib.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}
+			pool, _ := s.poolFor(target, group)
+			resp, _, err := s.resolveUpstream(questionMsg(r, chase), pool)
 			if err != nil {
-				s.logger.Error("Failed to create DNS record for", q.Name, err)
+				s.logger.Error("Upstream query failed for CNAME target", target, err)
 				m.Rcode = dnslib.RcodeServerFailure
-				continue
+				return m, sourceLocal
 			}
-			m.Answer = append(m.Answer, rr)
-			s.logger.Info("Local resolution:", q.Name, "->", ip)
-			continue
+			m.Rcode = resp.Rcode
+			m.Answer = append(m.Answer, resp.Answer...)
+			m.Ns = resp.Ns
+			m.Extra = resp.Extra
+			s.logger.Info("Resolved CNAME target", target, "- Answers:", len(resp.Answer))
 		}
+		return m, sourceLocal
+	}
 
-		// Forward unknown query to upstream
-		upstream := "1.1.1.1:53"
-		s.logger.Info("Forwarding query for", q.Name, "to upstream", upstream)
-		resp, err := dnslib.Exchange(r, upstream)
-		if err != nil {
-			s.logger.Error("Upstream query failed for", q.Name, err)
-			m.Rcode = dnslib.RcodeServerFailure
-			continue
+	// We are authoritative for signed zones, so missing names are not forwarded
+	if zone != nil {
+		nxdomain := !zone.names[strings.ToLower(dnslib.Fqdn(q.Name))]
+		m := newReply(r, dnslib.RcodeSuccess)
+		if nxdomain {
+			m.Rcode = dnslib.RcodeNameError
 		}
-		m.Answer = append(m.Answer, resp.Answer...)
-		s.logger.Info("Upstream response for", q.Name, "- Answers:", len(resp.Answer))
+		m.Authoritative = true
+		m.Ns = zone.negative(q.Name, nxdomain, dnssecOK(r))
+		s.logger.Info("No record in signed zone", zone.name, "for", q.Name, "- answering", dnslib.RcodeToString[m.Rcode])
+		return m, sourceLocal
 	}
 
-	// Log the response being sent
-	s.logger.Info("Sending response to", clientAddr, "- ID:", m.Id, "Answers:", len(m.Answer), "Rcode:", dnslib.RcodeToString[m.Rcode])
+	// Secondary zones are complete, names missing from them do not exist
+	if zone := s.secondaryFor(q.Name); zone != nil {
+		soa, _, ok := zone.snapshot()
+		if !ok {
+			s.logger.Error("Secondary zone", zone.name, "is not loaded or expired - answering SERVFAIL for", q.Name)
+			return newReply(r, dnslib.RcodeServerFailure), sourceLocal
+		}
+		m := newReply(r, dnslib.RcodeNameError)
+		m.Authoritative = true
+		negative := dnslib.Copy(soa)
+		negative.Header().Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+		m.Ns = []dnslib.RR{negative}
+		s.logger.Info("No record in secondary zone", zone.name, "for", q.Name, "- answering NXDOMAIN")
+		return m, sourceLocal
+	}
 
-	// Log each answer record
-	for _, ans := range m.Answer {
-		s.logger.Info("Response record:", ans.String())
+	// Names in the bridged zone are answered from what devices announce over mDNS
+	if s.mdns != nil && s.mdns.inZone(q.Name) {
+		m := s.mdns.resolve(r, q)
+		s.logger.Info("mDNS resolution:", q.Name, "- Answers:", len(m.Answer), "Rcode:", dnslib.RcodeToString[m.Rcode])
+		return m, sourceMDNS
 	}
 
-	_ = w.WriteMsg(m)
+	// Conditional forwarding rules take precedence over the private range check,
+	// so reverse zones can be delegated to e.g. the router
+	pool, rule := s.poolFor(q.Name, group)
+	if rule != nil {
+		s.logger.Info("Forward rule", rule.suffix, "matched", q.Name, "- upstreams:", pool)
+	} else if q.Qtype == dnslib.TypePTR && s.isPrivateReverse(q.Name) {
+		// Unknown private addresses must not leak to the upstream resolver
+		s.logger.Info("No local PTR for private address:", q.Name, "- answering NXDOMAIN")
+		m := newReply(r, dnslib.RcodeNameError)
+		m.Authoritative = true
+		return m, sourceLocal
+	}
+
+	// Forward unknown query to upstream. Clients setting CD do their own validation.
+	validate := s.validator != nil && !r.CheckingDisabled && !s.validator.isNegative(q.Name)
+	query := questionMsg(r, q)
+	if validate {
+		prepareQuery(query)
+	}
+
+	s.logger.Info("Forwarding query for", q.Name, "to upstreams")
+	resp, source, err := s.resolveUpstream(query, pool)
+	if err != nil {
+		s.logger.Error("Upstream query failed for", q.Name, err)
+		return newReply(r, dnslib.RcodeServerFailure), source
+	}
+
+	if validate {
+		state, reason := s.validator.validateResponse(context.Background(), q, resp)
+		s.logger.Info("DNSSEC validation for", q.Name, "-", state)
+		if state == stateBogus {
+			s.logger.Warn("DNSSEC validation failed for", q.Name, "-", reason)
+			return bogusReply(r, reason), source
+		}
+		resp.AuthenticatedData = state == stateSecure
+		if !dnssecOK(r) {
+			stripDNSSEC(resp, q.Qtype)
+		}
+	}
+	return forwardedReply(r, resp), source
 }
 
 func (s *Server) Start() error {
-	s.dnsServer = &dnslib.Server{Addr: s.cfg.Listen, Net: "udp"}
-	dnslib.HandleFunc(".", s.handleDNS)
+	if len(s.cfg.DNSSEC.Sign) > 0 {
+		signers, err := loadZoneSigners(s.cfg.DNSSEC, s.logger)
+		if err != nil {
+			return fmt.Errorf("failed to load DNSSEC signing keys: %w", err)
+		}
+		s.signers = signers
+	}
 
-	s.logger.Info("Starting DNS server on", s.cfg.Listen)
-	return s.dnsServer.ListenAndServe()
+	queryLog, err := newQueryLog(s.cfg.QueryLog)
+	if err != nil {
+		return err
+	}
+	s.queryLog = queryLog
+
+	if s.cfg.DHCP.Interface != "" {
+		dhcp, err := newDHCPServer(s.cfg.DHCP, s.logger, func() {
+			if err := s.reloadRecords(); err != nil {
+				s.logger.Error("Failed to publish DHCP leases, keeping previous records:", err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		s.dhcp = dhcp
+	}
+
+	if err := s.reloadRecords(); err != nil {
+		return fmt.Errorf("failed to load local records: %w", err)
+	}
+	if len(s.cfg.ZoneFiles) > 0 || len(s.cfg.HostsFiles) > 0 || len(s.signers) > 0 {
+		go s.watchRecordFiles(s.cfg.ReloadInterval)
+	}
+
+	if len(s.cfg.Blocking.Lists) > 0 || len(s.cfg.Blocking.Allowlist) > 0 {
+		s.blocker.refresh()
+		go s.blocker.run(s.stop)
+	}
+
+	errChan := make(chan error, 7)
+
+	if s.cfg.MDNS.Zone != "" || len(s.cfg.MDNS.Announce) > 0 {
+		mdns, err := newMDNSBridge(s.cfg.MDNS, s.logger, s.records.Load)
+		if err != nil {
+			return err
+		}
+		if err := mdns.listen(); err != nil {
+			return err
+		}
+		s.mdns = mdns
+		s.logger.Info("Starting mDNS bridge - zone:", s.cfg.MDNS.Zone, "announcing:", s.cfg.MDNS.Announce)
+		go func() { errChan <- s.mdns.serve() }()
+		s.mdns.announceRecords()
+	}
+
+	if s.dhcp != nil {
+		if err := s.dhcp.listen(); err != nil {
+			return err
+		}
+		s.logger.Info("Starting DHCP server on", s.cfg.DHCP.Interface, "for", s.cfg.DHCP.Subnet, "domain", s.cfg.DHCP.Domain)
+		go func() { errChan <- s.dhcp.serve() }()
+		go s.dhcp.run(s.stop)
+	}
+
+	for _, zone := range s.secondaries {
+		go zone.run(s.stop)
+	}
+
+	if s.cfg.API.Listen != "" {
+		s.apiServer = s.newAPIServer()
+		s.logger.Info("Starting API server on", s.cfg.API.Listen)
+		go func() {
+			err := s.apiServer.ListenAndServe()
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			errChan <- err
+		}()
+	}
+
+	if s.cfg.DoT.Listen != "" {
+		dotServer, err := s.newDoTServer()
+		if err != nil {
+			return fmt.Errorf("failed to configure DoT listener: %w", err)
+		}
+		s.dotServer = dotServer
+		s.logger.Info("Starting DoT server on", s.cfg.DoT.Listen)
+		go func() { errChan <- s.dotServer.ListenAndServe() }()
+	}
+
+	if s.cfg.DoH.Listen != "" {
+		dohServer, err := s.newDoHServer()
+		if err != nil {
+			return fmt.Errorf("failed to configure DoH listener: %w", err)
+		}
+		s.dohServer = dohServer
+		s.logger.Info("Starting DoH server on", s.cfg.DoH.Listen, "path", s.cfg.DoH.Path)
+		go func() {
+			var err error
+			if s.cfg.DoH.Plaintext {
+				err = s.dohServer.ListenAndServe()
+			} else {
+				err = s.dohServer.ListenAndServeTLS("", "")
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			errChan <- err
+		}()
+	}
+
+	s.dnsServer = &dnslib.Server{Addr: s.cfg.Listen, Net: "udp", Handler: s.handlerFor(transportUDP), TsigSecret: s.tsigSecrets}
+	s.logger.Info("Starting DNS server on", s.cfg.Listen, "(udp and tcp)")
+	go func() { errChan <- s.dnsServer.ListenAndServe() }()
+
+	// TCP on the same address serves truncated answers and rate limited clients
+	s.tcpServer = &dnslib.Server{Addr: s.cfg.Listen, Net: "tcp", Handler: s.handlerFor(transportTCP), TsigSecret: s.tsigSecrets}
+	go func() { errChan <- s.tcpServer.ListenAndServe() }()
+
+	return <-errChan
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
+	close(s.stop)
+	s.logger.Info("Queries served by transport:", s.transports.snapshot())
+	s.logger.Info("Queries blocked by list:", s.blocker.hits.snapshot())
+	s.logger.Info("Queries limited:", s.limits.hits.snapshot())
+
+	if s.mdns != nil {
+		s.logger.Info("Shutting down mDNS bridge...")
+		if err := s.mdns.close(); err != nil {
+			return err
+		}
+	}
+	if s.dhcp != nil {
+		s.logger.Info("Shutting down DHCP server...")
+		if err := s.dhcp.close(); err != nil {
+			return err
+		}
+	}
+	if s.apiServer != nil {
+		s.logger.Info("Shutting down API server...")
+		if err := s.apiServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if s.dohServer != nil {
+		s.logger.Info("Shutting down DoH server...")
+		if err := s.dohServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if s.dotServer != nil {
+		s.logger.Info("Shutting down DoT server...")
+		if err := s.dotServer.ShutdownContext(ctx); err != nil {
+			return err
+		}
+	}
+	if s.tcpServer != nil {
+		if err := s.tcpServer.ShutdownContext(ctx); err != nil {
+			return err
+		}
+	}
 	if s.dnsServer != nil {
 		s.logger.Info("Shutting down DNS server...")
-		return s.dnsServer.ShutdownContext(ctx)
+		if err := s.dnsServer.ShutdownContext(ctx); err != nil {
+			return err
+		}
+	}
+	if s.queryLog != nil {
+		return s.queryLog.close()
 	}
 	return nil
 }
@@ -0,0 +1,545 @@
+package internal
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// dnskeyTTL is the TTL of DNSKEY and synthesized SOA records
+const dnskeyTTL = 3600
+
+// signatureInceptionSkew backdates signatures to tolerate clock differences
+const signatureInceptionSkew = time.Hour
+
+// DNSKEY flags of zone-signing and key-signing keys
+const (
+	flagsZSK = 256
+	flagsKSK = 257
+)
+
+// signingKey is a DNSKEY together with its private key
+type signingKey struct {
+	key    *dnslib.DNSKEY
+	signer crypto.Signer
+}
+
+// sign creates an RRSIG over rrset that is valid for the given duration
+func (k signingKey) sign(rrset []dnslib.RR, now time.Time, validity time.Duration) (*dnslib.RRSIG, error) {
+	sig := &dnslib.RRSIG{
+		Hdr:        dnslib.RR_Header{Ttl: rrset[0].Header().Ttl},
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(now.Add(-signatureInceptionSkew).Unix()),
+		Expiration: uint32(now.Add(validity).Unix()),
+	}
+	if err := sig.Sign(k.signer, rrset); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// zoneSigner holds the keys of a local zone that is signed online
+type zoneSigner struct {
+	name  string
+	nsec3 bool
+	ksk   signingKey
+	zsk   signingKey
+}
+
+// loadZoneSigners loads or generates the keys of every configured signed zone.
+// The result is ordered most specific zone first.
+func loadZoneSigners(cfg DNSSECConfig, logger *telemetry.Logger) ([]*zoneSigner, error) {
+	var signers []*zoneSigner
+	for _, zone := range cfg.Sign {
+		z := &zoneSigner{name: strings.ToLower(dnslib.Fqdn(zone.Name)), nsec3: zone.NSEC3}
+		algorithm := dnslib.ECDSAP256SHA256
+		if zone.Algorithm == signingEd25519 {
+			algorithm = dnslib.ED25519
+		}
+
+		var err error
+		if z.ksk, err = loadSigningKey(z.name, algorithm, flagsKSK, zone.KeyDir, logger); err != nil {
+			return nil, err
+		}
+		if z.zsk, err = loadSigningKey(z.name, algorithm, flagsZSK, zone.KeyDir, logger); err != nil {
+			return nil, err
+		}
+
+		logger.Info("Signing zone", z.name, "- KSK:", z.ksk.key.KeyTag(), "ZSK:", z.zsk.key.KeyTag(), "DS:", z.ksk.key.ToDS(dnslib.SHA256).String())
+		signers = append(signers, z)
+	}
+
+	sort.SliceStable(signers, func(i, j int) bool {
+		return dnslib.CountLabel(signers[i].name) > dnslib.CountLabel(signers[j].name)
+	})
+	return signers, nil
+}
+
+// loadSigningKey returns the first key of zone with the given flags found in
+// dir. When there is none, a new key is generated and saved to dir.
+func loadSigningKey(zone string, algorithm uint8, flags uint16, dir string, logger *telemetry.Logger) (signingKey, error) {
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("K%s+%03d+*.key", zone, algorithm)))
+		if err != nil {
+			return signingKey{}, fmt.Errorf("failed to list keys of %s: %w", zone, err)
+		}
+		for _, path := range paths {
+			key, err := readSigningKey(path)
+			if err != nil {
+				return signingKey{}, err
+			}
+			if key.key.Flags == flags && strings.EqualFold(key.key.Hdr.Name, zone) {
+				return key, nil
+			}
+		}
+	}
+
+	key := &dnslib.DNSKEY{
+		Hdr:       dnslib.RR_Header{Name: zone, Rrtype: dnslib.TypeDNSKEY, Class: dnslib.ClassINET, Ttl: dnskeyTTL},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("failed to generate key for %s: %w", zone, err)
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("generated key for %s cannot sign", zone)
+	}
+	generated := signingKey{key: key, signer: signer}
+
+	if dir == "" {
+		logger.Warn("No key_dir for zone", zone, "- using an ephemeral key, its DS changes on restart")
+		return generated, nil
+	}
+	if err := writeSigningKey(dir, generated); err != nil {
+		return signingKey{}, err
+	}
+	logger.Info("Generated DNSSEC key for zone", zone, "- flags:", flags, "tag:", key.KeyTag())
+	return generated, nil
+}
+
+// readSigningKey reads a BIND-style .key file and its .private companion
+func readSigningKey(path string) (signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("failed to read key %s: %w", path, err)
+	}
+	rr, err := dnslib.NewRR(string(data))
+	if err != nil {
+		return signingKey{}, fmt.Errorf("failed to parse key %s: %w", path, err)
+	}
+	key, ok := rr.(*dnslib.DNSKEY)
+	if !ok {
+		return signingKey{}, fmt.Errorf("key file %s does not contain a DNSKEY", path)
+	}
+	key.Hdr.Ttl = dnskeyTTL
+
+	privatePath := strings.TrimSuffix(path, ".key") + ".private"
+	f, err := os.Open(privatePath)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("failed to open private key %s: %w", privatePath, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	private, err := key.ReadPrivateKey(f, privatePath)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("failed to parse private key %s: %w", privatePath, err)
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("private key %s cannot sign", privatePath)
+	}
+	return signingKey{key: key, signer: signer}, nil
+}
+
+// writeSigningKey saves a generated key in BIND's K<zone>+<alg>+<tag> format
+func writeSigningKey(dir string, k signingKey) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create key directory %s: %w", dir, err)
+	}
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", k.key.Hdr.Name, k.key.Algorithm, k.key.KeyTag()))
+	if err := os.WriteFile(base+".key", []byte(k.key.String()+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write key %s: %w", base+".key", err)
+	}
+	if err := os.WriteFile(base+".private", []byte(k.key.PrivateKeyString(k.signer)), 0o600); err != nil {
+		return fmt.Errorf("failed to write private key %s: %w", base+".private", err)
+	}
+	return nil
+}
+
+// denialRecord is one link of an NSEC or NSEC3 chain with its signature
+type denialRecord struct {
+	// owner is the owner name (NSEC) or the hashed label (NSEC3) used for ordering
+	owner string
+	rrs   []dnslib.RR
+}
+
+// signedZone holds what is needed to answer negatively for a signed zone: the
+// SOA and the sorted NSEC or NSEC3 chain
+type signedZone struct {
+	name  string
+	nsec3 bool
+	// soa is the SOA record followed by its RRSIG
+	soa []dnslib.RR
+	// names holds every owner name in the zone, including empty non-terminals
+	names map[string]bool
+	chain []denialRecord
+}
+
+// signZones signs every configured zone afresh and builds its denial chain
+func (b *recordSetBuilder) signZones(signers []*zoneSigner, validity time.Duration) {
+	if len(signers) == 0 {
+		return
+	}
+
+	now := time.Now()
+	claimed := make(map[string]bool)
+	for _, z := range signers {
+		if name := b.patternWildcard(z, claimed); name != "" {
+			b.logger.Error("Not signing zone", z.name, "- wildcard", name, "is not a leading * label and cannot be proven by NSEC/NSEC3 (RFC 4592)")
+			continue
+		}
+		b.zones = append(b.zones, b.signZone(z, claimed, now, validity))
+	}
+	b.resignAt = now.Add(validity / 2)
+}
+
+// patternWildcard returns a name of the zone whose wildcard is not a whole
+// leading label, e.g. web-*.waguri.san, or "" if there is none. Such patterns
+// match names the denial chain says do not exist.
+func (b *recordSetBuilder) patternWildcard(z *zoneSigner, claimed map[string]bool) string {
+	for name := range b.records {
+		if claimed[name] || !dnslib.IsSubDomain(z.name, name) || !strings.Contains(name, "*") {
+			continue
+		}
+		if !strings.HasPrefix(name, "*.") || strings.Contains(name[2:], "*") {
+			return name
+		}
+	}
+	return ""
+}
+
+// signZone signs the records under z that are not part of a more specific zone
+func (b *recordSetBuilder) signZone(z *zoneSigner, claimed map[string]bool, now time.Time, validity time.Duration) *signedZone {
+	zone := &signedZone{name: z.name, nsec3: z.nsec3, names: make(map[string]bool)}
+
+	// DNSSEC records from presigned zone files are replaced by our own
+	for name, records := range b.records {
+		if claimed[name] || !dnslib.IsSubDomain(z.name, name) {
+			continue
+		}
+		var kept []dnslib.RR
+		for _, rr := range records {
+			switch rr.Header().Rrtype {
+			case dnslib.TypeRRSIG, dnslib.TypeNSEC, dnslib.TypeNSEC3, dnslib.TypeNSEC3PARAM, dnslib.TypeDNSKEY, dnslib.TypeDS:
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		if len(kept) == 0 {
+			delete(b.records, name)
+			continue
+		}
+		b.records[name] = kept
+		zone.names[name] = true
+	}
+
+	apex := z.name
+	if !hasRRType(b.records[apex], dnslib.TypeSOA) {
+		b.records[apex] = append(b.records[apex], &dnslib.SOA{
+			Hdr:     dnslib.RR_Header{Name: apex, Rrtype: dnslib.TypeSOA, Class: dnslib.ClassINET, Ttl: dnskeyTTL},
+			Ns:      "ns." + apex,
+			Mbox:    "hostmaster." + apex,
+			Serial:  uint32(now.Unix()),
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  300,
+		})
+	}
+	b.records[apex] = append(b.records[apex], dnslib.Copy(z.ksk.key), dnslib.Copy(z.zsk.key))
+	if z.nsec3 {
+		b.records[apex] = append(b.records[apex], &dnslib.NSEC3PARAM{
+			Hdr:  dnslib.RR_Header{Name: apex, Rrtype: dnslib.TypeNSEC3PARAM, Class: dnslib.ClassINET},
+			Hash: dnslib.SHA1,
+		})
+	}
+	zone.names[apex] = true
+
+	names := make([]string, 0, len(zone.names))
+	for name := range zone.names {
+		names = append(names, name)
+		claimed[name] = true
+	}
+
+	// Empty non-terminals exist too, e.g. lab.waguri.san for nas.lab.waguri.san
+	for _, name := range names {
+		for parent := name; parent != apex; {
+			i, end := dnslib.NextLabel(parent, 0)
+			if end {
+				break
+			}
+			parent = parent[i:]
+			zone.names[parent] = true
+		}
+	}
+
+	for _, name := range names {
+		b.signName(z, name, now, validity)
+	}
+
+	negativeTTL := uint32(dnskeyTTL)
+	for _, rr := range b.records[apex] {
+		if soa, ok := rr.(*dnslib.SOA); ok {
+			negativeTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	if z.nsec3 {
+		b.buildNSEC3Chain(z, zone, negativeTTL, now, validity)
+	} else {
+		b.buildNSECChain(z, zone, names, negativeTTL, now, validity)
+	}
+
+	for _, rr := range b.records[apex] {
+		if rr.Header().Rrtype == dnslib.TypeSOA {
+			zone.soa = append(zone.soa, rr)
+		}
+		if sig, ok := rr.(*dnslib.RRSIG); ok && sig.TypeCovered == dnslib.TypeSOA {
+			zone.soa = append(zone.soa, rr)
+		}
+	}
+
+	b.logger.Info("Signed zone", z.name, "- names:", len(names), "denial records:", len(zone.chain))
+	return zone
+}
+
+// signName adds RRSIGs for every RRset owned by name
+func (b *recordSetBuilder) signName(z *zoneSigner, name string, now time.Time, validity time.Duration) {
+	sets := make(map[uint16][]dnslib.RR)
+	var order []uint16
+	for _, rr := range b.records[name] {
+		rrtype := rr.Header().Rrtype
+		if _, ok := sets[rrtype]; !ok {
+			order = append(order, rrtype)
+		}
+		sets[rrtype] = append(sets[rrtype], rr)
+	}
+
+	for _, rrtype := range order {
+		sig, err := b.signRRset(z, sets[rrtype], now, validity)
+		if err != nil {
+			b.logger.Error("Failed to sign", name, dnslib.TypeToString[rrtype], err)
+			continue
+		}
+		b.records[name] = append(b.records[name], sig)
+	}
+}
+
+// signRRset signs rrset with the KSK for DNSKEY sets and the ZSK otherwise
+func (b *recordSetBuilder) signRRset(z *zoneSigner, rrset []dnslib.RR, now time.Time, validity time.Duration) (*dnslib.RRSIG, error) {
+	// All records of an RRset must share one TTL (RFC 2181 section 5.2)
+	for _, rr := range rrset[1:] {
+		rr.Header().Ttl = rrset[0].Header().Ttl
+	}
+	key := z.zsk
+	if rrset[0].Header().Rrtype == dnslib.TypeDNSKEY {
+		key = z.ksk
+	}
+	return key.sign(rrset, now, validity)
+}
+
+// buildNSECChain links the zone's names in canonical order (RFC 4034 section 4)
+func (b *recordSetBuilder) buildNSECChain(z *zoneSigner, zone *signedZone, names []string, ttl uint32, now time.Time, validity time.Duration) {
+	sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+
+	for i, name := range names {
+		nsec := &dnslib.NSEC{
+			Hdr:        dnslib.RR_Header{Name: name, Rrtype: dnslib.TypeNSEC, Class: dnslib.ClassINET, Ttl: ttl},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: typeBitmap(b.records[name], dnslib.TypeNSEC),
+		}
+		rrs := []dnslib.RR{nsec}
+		if sig, err := b.signRRset(z, []dnslib.RR{nsec}, now, validity); err == nil {
+			rrs = append(rrs, sig)
+		} else {
+			b.logger.Error("Failed to sign NSEC for", name, err)
+		}
+		b.records[name] = append(b.records[name], rrs...)
+		zone.chain = append(zone.chain, denialRecord{owner: name, rrs: rrs})
+	}
+}
+
+// buildNSEC3Chain links the hashed names of the zone, including empty
+// non-terminals, using no salt and no extra iterations (RFC 9276)
+func (b *recordSetBuilder) buildNSEC3Chain(z *zoneSigner, zone *signedZone, ttl uint32, now time.Time, validity time.Duration) {
+	hashes := make(map[string]string, len(zone.names))
+	for name := range zone.names {
+		hashes[nsec3Hash(name)] = name
+	}
+	sorted := make([]string, 0, len(hashes))
+	for hash := range hashes {
+		sorted = append(sorted, hash)
+	}
+	sort.Strings(sorted)
+
+	for i, hash := range sorted {
+		name := hashes[hash]
+		var bitmap []uint16
+		if len(b.records[name]) > 0 {
+			bitmap = typeBitmap(b.records[name])
+		}
+		nsec3 := &dnslib.NSEC3{
+			Hdr:        dnslib.RR_Header{Name: hash + "." + z.name, Rrtype: dnslib.TypeNSEC3, Class: dnslib.ClassINET, Ttl: ttl},
+			Hash:       dnslib.SHA1,
+			HashLength: 20,
+			NextDomain: strings.ToUpper(sorted[(i+1)%len(sorted)]),
+			TypeBitMap: bitmap,
+		}
+		rrs := []dnslib.RR{nsec3}
+		if sig, err := b.signRRset(z, []dnslib.RR{nsec3}, now, validity); err == nil {
+			rrs = append(rrs, sig)
+		} else {
+			b.logger.Error("Failed to sign NSEC3 for", name, err)
+		}
+		zone.chain = append(zone.chain, denialRecord{owner: hash, rrs: rrs})
+	}
+}
+
+// typeBitmap lists the types present at a name plus RRSIG and the extra types
+func typeBitmap(records []dnslib.RR, extra ...uint16) []uint16 {
+	seen := map[uint16]bool{dnslib.TypeRRSIG: true}
+	for _, t := range extra {
+		seen[t] = true
+	}
+	for _, rr := range records {
+		seen[rr.Header().Rrtype] = true
+	}
+	bitmap := make([]uint16, 0, len(seen))
+	for t := range seen {
+		bitmap = append(bitmap, t)
+	}
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	return bitmap
+}
+
+// hasRRType reports whether records contain a record of the given type
+func hasRRType(records []dnslib.RR, rrtype uint16) bool {
+	for _, rr := range records {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Hash returns the lowercase hashed owner label of name
+func nsec3Hash(name string) string {
+	return strings.ToLower(dnslib.HashName(name, dnslib.SHA1, 0, ""))
+}
+
+// negative returns the authority section for a name that does not exist
+// (nxdomain) or has no data of the queried type, with proofs when dnssecOK
+func (z *signedZone) negative(qname string, nxdomain, dnssecOK bool) []dnslib.RR {
+	if !dnssecOK {
+		return z.soa[:1]
+	}
+
+	qname = strings.ToLower(dnslib.Fqdn(qname))
+	var proofs [][]dnslib.RR
+	switch {
+	case !nxdomain && z.names[qname]:
+		proofs = append(proofs, z.cover(qname))
+	case z.nsec3:
+		encloser := z.closestEncloser(qname)
+		proofs = append(proofs, z.cover(encloser), z.cover(nextCloser(qname, encloser)), z.cover("*."+encloser))
+	default:
+		proofs = append(proofs, z.cover(qname), z.cover("*."+z.closestEncloser(qname)))
+	}
+
+	out := append([]dnslib.RR{}, z.soa...)
+	return appendProofs(out, proofs...)
+}
+
+// wildcardProof proves that qname itself does not exist when its answer was
+// synthesized from a wildcard (RFC 4035 section 3.1.3.3)
+func (z *signedZone) wildcardProof(qname string) []dnslib.RR {
+	qname = strings.ToLower(dnslib.Fqdn(qname))
+	if z.names[qname] {
+		return nil
+	}
+	if z.nsec3 {
+		return appendProofs(nil, z.cover(nextCloser(qname, z.closestEncloser(qname))))
+	}
+	return appendProofs(nil, z.cover(qname))
+}
+
+// cover returns the chain record that matches or covers name
+func (z *signedZone) cover(name string) []dnslib.RR {
+	key := strings.ToLower(name)
+	less := func(a, b string) bool { return canonicalCompare(a, b) < 0 }
+	if z.nsec3 {
+		key = nsec3Hash(name)
+		less = func(a, b string) bool { return a < b }
+	}
+
+	// The last record not greater than key covers it; the chain wraps around
+	i := sort.Search(len(z.chain), func(i int) bool { return less(key, z.chain[i].owner) })
+	if i == 0 {
+		i = len(z.chain)
+	}
+	return z.chain[i-1].rrs
+}
+
+// closestEncloser returns the longest existing ancestor of name
+func (z *signedZone) closestEncloser(name string) string {
+	for name != z.name {
+		i, end := dnslib.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[i:]
+		if z.names[name] {
+			return name
+		}
+	}
+	return z.name
+}
+
+// nextCloser returns the ancestor of name that is one label below encloser
+func nextCloser(name, encloser string) string {
+	labels := dnslib.SplitDomainName(name)
+	n := dnslib.CountLabel(encloser) + 1
+	if n > len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// appendProofs adds chain records to out, skipping ones already present
+func appendProofs(out []dnslib.RR, proofs ...[]dnslib.RR) []dnslib.RR {
+	for _, proof := range proofs {
+		duplicate := false
+		for _, rr := range out {
+			if len(proof) > 0 && rr == proof[0] {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			out = append(out, proof...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsRetention is the longest window the statistics can report on
+const statsRetention = 24 * time.Hour
+
+// statsBucketKeys caps the distinct names and clients a bucket counts; once
+// full, further keys are folded into statsOtherKey so a flood of random names
+// cannot grow memory without bound
+const statsBucketKeys = 1000
+
+// statsOtherKey counts the keys beyond statsBucketKeys; it is neither a valid
+// domain name nor an address
+const statsOtherKey = "(other)"
+
+// statsBucket aggregates the queries of one minute
+type statsBucket struct {
+	minute       int64
+	total        uint64
+	blocked      uint64
+	names        map[string]uint64
+	clients      map[string]uint64
+	blockedNames map[string]uint64
+	types        map[string]uint64
+	sources      map[string]uint64
+}
+
+func (b *statsBucket) reset(minute int64) {
+	*b = statsBucket{
+		minute:       minute,
+		names:        make(map[string]uint64),
+		clients:      make(map[string]uint64),
+		blockedNames: make(map[string]uint64),
+		types:        make(map[string]uint64),
+		sources:      make(map[string]uint64),
+	}
+}
+
+// queryStats keeps per-minute aggregates for statsRetention in a ring of buckets.
+// Only the bucket of the latest minute is written to, so older buckets can be
+// read without the lock once copied out of the ring
+type queryStats struct {
+	mu      sync.Mutex
+	buckets []statsBucket
+	latest  int64
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{buckets: make([]statsBucket, int(statsRetention/time.Minute))}
+}
+
+// bucket returns the bucket for minute, recycling it if it holds older data
+func (st *queryStats) bucket(minute int64) *statsBucket {
+	b := &st.buckets[minute%int64(len(st.buckets))]
+	if b.minute != minute || b.names == nil {
+		b.reset(minute)
+	}
+	return b
+}
+
+// record counts one answered query
+func (st *queryStats) record(entry queryLogEntry) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// A query that started before the minute turned over counts in the new
+	// minute, keeping earlier buckets immutable
+	st.latest = max(st.latest, entry.Time.Unix()/60)
+	b := st.bucket(st.latest)
+	b.total++
+	countKey(b.names, entry.Name)
+	countKey(b.clients, entry.Client)
+	b.types[entry.Type]++
+	b.sources[entry.Source]++
+	if entry.Source == sourceBlocked {
+		b.blocked++
+		countKey(b.blockedNames, entry.Name)
+	}
+}
+
+// countKey increments key in counts, or statsOtherKey once counts is full
+func countKey(counts map[string]uint64, key string) {
+	if _, ok := counts[key]; !ok && len(counts) >= statsBucketKeys {
+		key = statsOtherKey
+	}
+	counts[key]++
+}
+
+// statsCount is one row of a top list
+type statsCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// statsVolume is the query volume of one minute
+type statsVolume struct {
+	Time    time.Time `json:"time"`
+	Queries uint64    `json:"queries"`
+	Blocked uint64    `json:"blocked"`
+}
+
+// statsReport is the dashboard view of a time window
+type statsReport struct {
+	Window     string            `json:"window"`
+	Queries    uint64            `json:"queries"`
+	Blocked    uint64            `json:"blocked"`
+	TopNames   []statsCount      `json:"top_names"`
+	TopClients []statsCount      `json:"top_clients"`
+	TopBlocked []statsCount      `json:"top_blocked"`
+	Types      map[string]uint64 `json:"types"`
+	Sources    map[string]uint64 `json:"sources"`
+	Volume     []statsVolume     `json:"volume"`
+	// Counters since startup
+	Transports map[string]uint64 `json:"transports"`
+	Blocklists map[string]uint64 `json:"blocklists"`
+	Limits     map[string]uint64 `json:"limits"`
+}
+
+// report aggregates the minutes in window ending now, with top lists of size top
+func (st *queryStats) report(now time.Time, window time.Duration, top int) statsReport {
+	current := now.Unix() / 60
+	minutes := int64(window / time.Minute)
+	buckets := st.snapshot(current-minutes+1, current)
+
+	report := statsReport{
+		Window:  window.String(),
+		Types:   make(map[string]uint64),
+		Sources: make(map[string]uint64),
+		Volume:  []statsVolume{},
+	}
+	names := make(map[string]uint64)
+	clients := make(map[string]uint64)
+	blocked := make(map[string]uint64)
+
+	for i, b := range buckets {
+		volume := statsVolume{Time: time.Unix((current-minutes+1+int64(i))*60, 0).UTC()}
+		if b.names != nil {
+			volume.Queries, volume.Blocked = b.total, b.blocked
+			report.Queries += b.total
+			report.Blocked += b.blocked
+			mergeCounts(names, b.names)
+			mergeCounts(clients, b.clients)
+			mergeCounts(blocked, b.blockedNames)
+			mergeCounts(report.Types, b.types)
+			mergeCounts(report.Sources, b.sources)
+		}
+		report.Volume = append(report.Volume, volume)
+	}
+
+	report.TopNames = topCounts(names, top)
+	report.TopClients = topCounts(clients, top)
+	report.TopBlocked = topCounts(blocked, top)
+	return report
+}
+
+// snapshot copies the buckets of minutes from..to out of the ring, a zero
+// bucket standing for a minute without data. Earlier buckets are immutable and
+// shared; only the one still being written to has its maps cloned
+func (st *queryStats) snapshot(from, to int64) []statsBucket {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	out := make([]statsBucket, 0, max(to-from+1, 0))
+	for minute := from; minute <= to; minute++ {
+		b := st.buckets[minute%int64(len(st.buckets))]
+		switch {
+		case b.minute != minute || b.names == nil:
+			b = statsBucket{}
+		case minute == st.latest:
+			b.names = maps.Clone(b.names)
+			b.clients = maps.Clone(b.clients)
+			b.blockedNames = maps.Clone(b.blockedNames)
+			b.types = maps.Clone(b.types)
+			b.sources = maps.Clone(b.sources)
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func mergeCounts(dst, src map[string]uint64) {
+	for key, count := range src {
+		dst[key] += count
+	}
+}
+
+// topCounts returns the n largest counts, ties broken by key
+func topCounts(counts map[string]uint64, n int) []statsCount {
+	out := make([]statsCount, 0, len(counts))
+	for key, count := range counts {
+		out = append(out, statsCount{Key: key, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
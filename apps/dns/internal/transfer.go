@@ -0,0 +1,435 @@
+package internal
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// tsigAlgorithms maps configured algorithm names to their TSIG identifiers
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dnslib.HmacSHA1,
+	"hmac-sha224": dnslib.HmacSHA224,
+	"hmac-sha256": dnslib.HmacSHA256,
+	"hmac-sha384": dnslib.HmacSHA384,
+	"hmac-sha512": dnslib.HmacSHA512,
+}
+
+// transferEnvelopeSize is how many records go into one transfer message
+const transferEnvelopeSize = 100
+
+// maxJournalEntries bounds the zone history kept for IXFR
+const maxJournalEntries = 32
+
+// transferTimeout bounds NOTIFY exchanges and inbound transfers
+const transferTimeout = 10 * time.Second
+
+// tsigFudge is the allowed clock skew of signed messages
+const tsigFudge = 300
+
+// tsigKey is a configured TSIG key with its canonical name
+type tsigKey struct {
+	name      string
+	algorithm string
+}
+
+// tsigKeys returns the secrets by key name for dnslib servers and clients, and the keys by name
+func tsigKeys(cfg []TSIGKeyConfig) (map[string]string, map[string]tsigKey) {
+	secrets := make(map[string]string)
+	keys := make(map[string]tsigKey)
+	for _, key := range cfg {
+		name := dnslib.CanonicalName(key.Name)
+		secrets[name] = key.Secret
+		keys[name] = tsigKey{name: name, algorithm: tsigAlgorithms[key.Algorithm]}
+	}
+	return secrets, keys
+}
+
+// sign adds a TSIG record for key to m; the signature is computed when m is sent
+func (k tsigKey) sign(m *dnslib.Msg) {
+	if k.name != "" {
+		m.SetTsig(k.name, k.algorithm, tsigFudge, time.Now().Unix())
+	}
+}
+
+// journalEntry is the difference between two versions of a zone
+type journalEntry struct {
+	from    *dnslib.SOA
+	to      *dnslib.SOA
+	deleted []dnslib.RR
+	added   []dnslib.RR
+}
+
+// zoneVersion is a snapshot of a transferable zone
+type zoneVersion struct {
+	soa     *dnslib.SOA
+	records []dnslib.RR
+	// content identifies the records for change detection
+	content []string
+}
+
+// transferZone tracks the versions of one zone served to secondaries
+type transferZone struct {
+	name    string
+	current *zoneVersion
+	journal []journalEntry
+}
+
+// zoneTransfers serves local zones over AXFR/IXFR and notifies secondaries of changes
+type zoneTransfers struct {
+	cfg     TransferConfig
+	logger  *telemetry.Logger
+	allowed []*net.IPNet
+	key     tsigKey
+	secrets map[string]string
+
+	mu    sync.Mutex
+	zones map[string]*transferZone
+}
+
+func newZoneTransfers(cfg TransferConfig, secrets map[string]string, keys map[string]tsigKey, logger *telemetry.Logger) *zoneTransfers {
+	t := &zoneTransfers{
+		cfg:     cfg,
+		logger:  logger,
+		secrets: secrets,
+		zones:   make(map[string]*transferZone),
+	}
+	if cfg.TSIGKey != "" {
+		t.key = keys[dnslib.CanonicalName(cfg.TSIGKey)]
+	}
+	for _, cidr := range cfg.AllowedClients {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			t.allowed = append(t.allowed, network)
+		}
+	}
+	for _, zone := range cfg.Zones {
+		name := dnslib.CanonicalName(zone)
+		t.zones[name] = &transferZone{name: name}
+	}
+	return t
+}
+
+// update snapshots every zone from a freshly loaded record set. Zones whose
+// content changed get a new serial, a journal entry and a NOTIFY.
+func (t *zoneTransfers) update(rs *recordSet, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, zone := range t.zones {
+		next := snapshotZone(rs, zone.name)
+		prev := zone.current
+		if prev != nil && equalStrings(prev.content, next.content) && (next.soa == nil || next.soa.Serial == prev.soa.Serial) {
+			continue
+		}
+
+		if next.soa == nil {
+			// No SOA in the local records, manage the serial ourselves
+			serial := uint32(now.Unix())
+			if prev != nil && !serialNewer(serial, prev.soa.Serial) {
+				serial = prev.soa.Serial + 1
+			}
+			next.soa = defaultSOA(zone.name, serial)
+		}
+
+		if prev != nil {
+			if !serialNewer(next.soa.Serial, prev.soa.Serial) {
+				t.logger.Warn("Zone", zone.name, "changed without a serial increase, secondaries keep serial", prev.soa.Serial)
+				zone.journal = nil
+			} else {
+				deleted, added := diffRecords(prev, next)
+				zone.journal = append(zone.journal, journalEntry{from: prev.soa, to: next.soa, deleted: deleted, added: added})
+				if len(zone.journal) > maxJournalEntries {
+					zone.journal = zone.journal[len(zone.journal)-maxJournalEntries:]
+				}
+			}
+		}
+		zone.current = next
+		t.logger.Info("Zone", zone.name, "serial", next.soa.Serial, "- records:", len(next.records))
+		go t.notify(zone.name, next.soa)
+	}
+}
+
+// snapshotZone collects the records of rs under zone, sorted and without the SOA
+func snapshotZone(rs *recordSet, zone string) *zoneVersion {
+	v := &zoneVersion{}
+	add := func(rr dnslib.RR) {
+		if soa, ok := rr.(*dnslib.SOA); ok && rr.Header().Name == zone {
+			v.soa = soa
+			return
+		}
+		v.records = append(v.records, rr)
+	}
+	for name, records := range rs.exact {
+		if dnslib.IsSubDomain(zone, name) {
+			for _, rr := range records {
+				add(rr)
+			}
+		}
+	}
+	for _, wc := range rs.wildcards {
+		if dnslib.IsSubDomain(zone, dnslib.Fqdn(wc.domain)) {
+			for _, rr := range wc.records {
+				add(rr)
+			}
+		}
+	}
+
+	sort.Slice(v.records, func(i, j int) bool {
+		return v.records[i].String() < v.records[j].String()
+	})
+	for _, rr := range v.records {
+		v.content = append(v.content, rr.String())
+	}
+	return v
+}
+
+// defaultSOA is the SOA of zones whose records do not define one
+func defaultSOA(zone string, serial uint32) *dnslib.SOA {
+	return &dnslib.SOA{
+		Hdr:     dnslib.RR_Header{Name: zone, Rrtype: dnslib.TypeSOA, Class: dnslib.ClassINET, Ttl: localRecordTTL},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  300,
+	}
+}
+
+// diffRecords returns the records removed and added between two versions
+func diffRecords(prev, next *zoneVersion) ([]dnslib.RR, []dnslib.RR) {
+	before := make(map[string]bool, len(prev.content))
+	for _, s := range prev.content {
+		before[s] = true
+	}
+	after := make(map[string]bool, len(next.content))
+	for _, s := range next.content {
+		after[s] = true
+	}
+
+	var deleted, added []dnslib.RR
+	for i, s := range prev.content {
+		if !after[s] {
+			deleted = append(deleted, prev.records[i])
+		}
+	}
+	for i, s := range next.content {
+		if !before[s] {
+			added = append(added, next.records[i])
+		}
+	}
+	return deleted, added
+}
+
+// serialNewer compares SOA serials with RFC 1982 arithmetic
+func serialNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// zoneFor returns the served zone that is exactly name
+func (t *zoneTransfers) zoneFor(name string) *transferZone {
+	if t == nil {
+		return nil
+	}
+	return t.zones[dnslib.CanonicalName(name)]
+}
+
+// soa returns the current SOA of the served zone that is exactly name, if any
+func (t *zoneTransfers) soa(name string) *dnslib.SOA {
+	zone := t.zoneFor(name)
+	if zone == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if zone.current == nil {
+		return nil
+	}
+	return dnslib.Copy(zone.current.soa).(*dnslib.SOA)
+}
+
+// authorize checks the transfer access list and TSIG. It returns the rcode
+// to refuse the request with, or RcodeSuccess.
+func (t *zoneTransfers) authorize(w dnslib.ResponseWriter, r *dnslib.Msg) int {
+	ip := addrIP(w.RemoteAddr())
+	allowed := false
+	for _, network := range t.allowed {
+		if ip != nil && network.Contains(ip) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return dnslib.RcodeRefused
+	}
+	if t.key.name == "" {
+		return dnslib.RcodeSuccess
+	}
+	tsig := r.IsTsig()
+	if tsig == nil || dnslib.CanonicalName(tsig.Hdr.Name) != t.key.name {
+		return dnslib.RcodeRefused
+	}
+	if w.TsigStatus() != nil {
+		return dnslib.RcodeNotAuth
+	}
+	return dnslib.RcodeSuccess
+}
+
+// records returns the answer records of an AXFR, or of an IXFR from serial
+// (RFC 1995). Without a journal path from serial, IXFR falls back to the full
+// zone. It returns nil before the zone was first loaded.
+func (t *zoneTransfers) records(zone *transferZone, qtype uint16, serial *uint32) []dnslib.RR {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current := zone.current
+	if current == nil {
+		return nil
+	}
+	if qtype == dnslib.TypeIXFR && serial != nil {
+		if !serialNewer(current.soa.Serial, *serial) {
+			return []dnslib.RR{current.soa}
+		}
+		if rrs, ok := journalFrom(zone.journal, *serial); ok {
+			return append(append([]dnslib.RR{current.soa}, rrs...), current.soa)
+		}
+	}
+
+	rrs := make([]dnslib.RR, 0, len(current.records)+2)
+	rrs = append(rrs, current.soa)
+	rrs = append(rrs, current.records...)
+	return append(rrs, current.soa)
+}
+
+// journalFrom concatenates the journal entries leading from serial to the
+// current version in IXFR format
+func journalFrom(journal []journalEntry, serial uint32) ([]dnslib.RR, bool) {
+	for i, entry := range journal {
+		if entry.from.Serial != serial {
+			continue
+		}
+		var rrs []dnslib.RR
+		for _, e := range journal[i:] {
+			rrs = append(rrs, e.from)
+			rrs = append(rrs, e.deleted...)
+			rrs = append(rrs, e.to)
+			rrs = append(rrs, e.added...)
+		}
+		return rrs, true
+	}
+	return nil, false
+}
+
+// serveTransfer answers an AXFR or IXFR request for a served zone
+func (s *Server) serveTransfer(w dnslib.ResponseWriter, r *dnslib.Msg, transport string) {
+	q := r.Question[0]
+	zone := s.transfers.zoneFor(q.Name)
+	refuse := func(rcode int) {
+		s.logger.Warn("Refused", dnslib.TypeToString[q.Qtype], "of", q.Name, "from", w.RemoteAddr(), "-", dnslib.RcodeToString[rcode])
+		m := newReply(r, rcode)
+		signReply(w, r, m)
+		_ = w.WriteMsg(m)
+	}
+	if zone == nil {
+		refuse(dnslib.RcodeNotAuth)
+		return
+	}
+	if rcode := s.transfers.authorize(w, r); rcode != dnslib.RcodeSuccess {
+		refuse(rcode)
+		return
+	}
+
+	var serial *uint32
+	if q.Qtype == dnslib.TypeIXFR {
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dnslib.SOA); ok {
+				serial = &soa.Serial
+			}
+		}
+	}
+	rrs := s.transfers.records(zone, q.Qtype, serial)
+	if rrs == nil {
+		refuse(dnslib.RcodeServerFailure)
+		return
+	}
+
+	// Over UDP only an up-to-date IXFR fits; others retry over TCP (RFC 1995 section 2)
+	if transport == transportUDP {
+		m := newReply(r, dnslib.RcodeSuccess)
+		m.Authoritative = true
+		if len(rrs) == 1 {
+			m.Answer = rrs
+		} else if q.Qtype == dnslib.TypeIXFR {
+			m.Answer = rrs[:1]
+		} else {
+			m.Truncated = true
+		}
+		signReply(w, r, m)
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	s.logger.Info("Serving", dnslib.TypeToString[q.Qtype], "of", zone.name, "to", w.RemoteAddr(), "- records:", len(rrs))
+	ch := make(chan *dnslib.Envelope, (len(rrs)+transferEnvelopeSize-1)/transferEnvelopeSize)
+	for len(rrs) > 0 {
+		n := min(len(rrs), transferEnvelopeSize)
+		ch <- &dnslib.Envelope{RR: rrs[:n]}
+		rrs = rrs[n:]
+	}
+	close(ch)
+	if err := new(dnslib.Transfer).Out(w, r, ch); err != nil {
+		s.logger.Error("Zone transfer of", zone.name, "to", w.RemoteAddr(), "failed:", err)
+	}
+	_ = w.Close()
+}
+
+// signReply signs m with the TSIG key of a verified request r
+func signReply(w dnslib.ResponseWriter, r *dnslib.Msg, m *dnslib.Msg) {
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+}
+
+// notify tells the configured secondaries that zone has a new serial
+func (t *zoneTransfers) notify(zone string, soa *dnslib.SOA) {
+	for _, target := range t.cfg.Notify {
+		m := new(dnslib.Msg)
+		m.SetNotify(zone)
+		m.Answer = []dnslib.RR{soa}
+		t.key.sign(m)
+
+		client := &dnslib.Client{Timeout: transferTimeout, TsigSecret: t.secrets}
+		addr := withDefaultPort(target, "53")
+		if _, _, err := client.Exchange(m, addr); err != nil {
+			t.logger.Warn("NOTIFY for", zone, "to", addr, "failed:", err)
+			continue
+		}
+		t.logger.Info("Sent NOTIFY for", zone, "serial", soa.Serial, "to", addr)
+	}
+}
+
+// withDefaultPort appends port to addresses given without one
+func withDefaultPort(addr string, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
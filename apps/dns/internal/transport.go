@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// Transports a query can arrive on, used to tag logs and counters
+const (
+	transportUDP   = "udp"
+	transportTCP   = "tcp"
+	transportTLS   = "tls"
+	transportHTTPS = "https"
+)
+
+// errDoHTsig is the TSIG status of every DoH request: the HTTP handler does
+// not verify TSIG, so a signed request must never count as authenticated
+var errDoHTsig = errors.New("TSIG is not verified over DoH")
+
+// dohContentType is the RFC 8484 wire-format media type
+const dohContentType = "application/dns-message"
+
+// maxDoHMessageSize bounds POST bodies to the largest possible DNS message
+const maxDoHMessageSize = dnslib.MaxMsgSize
+
+// handlerFor binds handleDNS to a transport so each listener tags its queries
+func (s *Server) handlerFor(transport string) dnslib.Handler {
+	return dnslib.HandlerFunc(func(w dnslib.ResponseWriter, r *dnslib.Msg) {
+		s.handleDNS(w, r, transport)
+	})
+}
+
+// certReloader serves a certificate from disk and reloads it when the files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	stamps  [2]fileStamp
+	checked time.Time
+}
+
+// certCheckInterval limits how often certificate files are stat'ed during handshakes
+const certCheckInterval = 10 * time.Second
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the key pair from disk
+func (c *certReloader) load() error {
+	stamps, err := statFiles(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.stamps = stamps
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if stamps, err := statFiles(c.certFile, c.keyFile); err == nil && stamps != c.stamps {
+			// Keep serving the previous certificate if the new one is incomplete
+			_ = c.load()
+		}
+	}
+	return c.cert, nil
+}
+
+// statFiles returns the change stamps of the certificate and key files
+func statFiles(certFile, keyFile string) ([2]fileStamp, error) {
+	var stamps [2]fileStamp
+	for i, path := range []string{certFile, keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return stamps, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+// tlsConfig builds the server TLS configuration shared by DoT and DoH
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.certs == nil {
+		certs, err := newCertReloader(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = certs
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.certs.GetCertificate,
+	}, nil
+}
+
+// newDoTServer creates the DNS-over-TLS listener
+func (s *Server) newDoTServer() (*dnslib.Server, error) {
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &dnslib.Server{
+		Addr:       s.cfg.DoT.Listen,
+		Net:        "tcp-tls",
+		TLSConfig:  tlsConfig,
+		Handler:    s.handlerFor(transportTLS),
+		TsigSecret: s.tsigSecrets,
+	}, nil
+}
+
+// newDoHServer creates the DNS-over-HTTPS listener
+func (s *Server) newDoHServer() (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.cfg.DoH.Path, s.handleDoH)
+
+	server := &http.Server{
+		Addr:              s.cfg.DoH.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if !s.cfg.DoH.Plaintext {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		server.TLSConfig = tlsConfig
+	}
+	return server, nil
+}
+
+// handleDoH serves RFC 8484 GET (?dns=) and POST (application/dns-message) requests
+func (s *Server) handleDoH(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns query parameter", http.StatusBadRequest)
+			return
+		}
+		wire, err = base64.RawURLEncoding.DecodeString(param)
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(r.Body, maxDoHMessageSize+1))
+		if err == nil && len(wire) > maxDoHMessageSize {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid dns message encoding", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dnslib.Msg)
+	if err := req.Unpack(wire); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohResponseWriter{remote: httpRemoteAddr(r), local: httpLocalAddr(r)}
+	s.handleDNS(dw, req, transportHTTPS)
+	if dw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	packed, err := dw.msg.Pack()
+	if err != nil {
+		s.logger.Error("Failed to pack DoH response:", err)
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL(dw.msg)), 10))
+	if _, err := w.Write(packed); err != nil {
+		s.logger.Error("Error writing DoH response:", err)
+	}
+}
+
+// minTTL returns the smallest TTL in the answer and authority sections
+func minTTL(m *dnslib.Msg) uint32 {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dnslib.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl
+}
+
+// httpRemoteAddr converts the request's remote address into a net.Addr
+func httpRemoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// httpLocalAddr returns the local address the request arrived on
+func httpLocalAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// dohResponseWriter captures the reply of handleDNS for a DoH request
+type dohResponseWriter struct {
+	remote net.Addr
+	local  net.Addr
+	msg    *dnslib.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dnslib.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dnslib.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return errDoHTsig }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,346 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	dnslib "github.com/miekg/dns"
+)
+
+// upstream forwards a query to an external resolver
+type upstream interface {
+	Exchange(ctx context.Context, m *dnslib.Msg) (*dnslib.Msg, error)
+	String() string
+}
+
+// dohIdleTimeout is how long idle DoH connections are kept for reuse
+const dohIdleTimeout = 90 * time.Second
+
+// errUpstreamClosed is returned to in-flight DoT queries when their connection drops
+var errUpstreamClosed = errors.New("upstream connection closed")
+
+// newUpstream parses an upstream address and returns the matching transport
+func newUpstream(cfg UpstreamConfig) (upstream, error) {
+	address := cfg.Address
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream address '%s': %w", cfg.Address, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream address '%s' has no host", cfg.Address)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return &plainUpstream{
+			address:  cfg.Address,
+			dialAddr: dialAddress(u, cfg.Bootstrap, "53"),
+			net:      u.Scheme,
+			timeout:  cfg.Timeout,
+		}, nil
+	case "tls":
+		return &dotUpstream{
+			address:  cfg.Address,
+			dialAddr: dialAddress(u, cfg.Bootstrap, "853"),
+			timeout:  cfg.Timeout,
+			tlsConfig: &tls.Config{
+				ServerName: u.Hostname(),
+				MinVersion: tls.VersionTLS12,
+			},
+		}, nil
+	case "https":
+		return newDoHUpstream(cfg, u), nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme '%s' in '%s'", u.Scheme, cfg.Address)
+	}
+}
+
+// dialAddress returns the address to connect to, substituting the bootstrap IP
+// for the host name when one is configured
+func dialAddress(u *url.URL, bootstrap, defaultPort string) string {
+	host := u.Hostname()
+	if bootstrap != "" {
+		host = bootstrap
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// plainUpstream speaks classic DNS over UDP (with TCP fallback on truncation) or TCP
+type plainUpstream struct {
+	address  string
+	dialAddr string
+	net      string
+	timeout  time.Duration
+}
+
+func (u *plainUpstream) String() string { return u.address }
+
+func (u *plainUpstream) Exchange(ctx context.Context, m *dnslib.Msg) (*dnslib.Msg, error) {
+	client := &dnslib.Client{Net: u.net, Timeout: u.timeout}
+	resp, _, err := client.ExchangeContext(ctx, m, u.dialAddr)
+	if err == nil && resp.Truncated && u.net == "udp" {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, u.dialAddr)
+	}
+	return resp, err
+}
+
+// dotUpstream speaks DNS-over-TLS over a single persistent connection. Queries
+// are pipelined: each one gets a connection-unique message ID and responses are
+// matched back to their callers as they arrive, in any order.
+type dotUpstream struct {
+	address   string
+	dialAddr  string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+func (u *dotUpstream) String() string { return u.address }
+
+func (u *dotUpstream) Exchange(ctx context.Context, m *dnslib.Msg) (*dnslib.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	// A reused connection may have been closed by the server while idle,
+	// so retry once on a fresh connection
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := u.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := conn.exchange(ctx, m)
+		if err != nil && reused && attempt == 0 && ctx.Err() == nil {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// connection returns the live connection, dialing a new one if needed
+func (u *dotUpstream) connection(ctx context.Context) (*dotConn, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil && !u.conn.isClosed() {
+		return u.conn, true, nil
+	}
+
+	dialer := &tls.Dialer{Config: u.tlsConfig}
+	raw, err := dialer.DialContext(ctx, "tcp", u.dialAddr)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to %s: %w", u.address, err)
+	}
+
+	u.conn = &dotConn{
+		conn:    &dnslib.Conn{Conn: raw},
+		pending: make(map[uint16]chan *dnslib.Msg),
+	}
+	go u.conn.readLoop()
+	return u.conn, false, nil
+}
+
+// dotConn is a single pipelined DoT connection
+type dotConn struct {
+	conn    *dnslib.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dnslib.Msg
+	nextID  uint16
+	closed  bool
+}
+
+func (c *dotConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// register reserves a message ID not currently in flight on this connection
+func (c *dotConn) register() (uint16, chan *dnslib.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, nil, errUpstreamClosed
+	}
+	for {
+		c.nextID++
+		if _, busy := c.pending[c.nextID]; !busy {
+			break
+		}
+	}
+	ch := make(chan *dnslib.Msg, 1)
+	c.pending[c.nextID] = ch
+	return c.nextID, ch, nil
+}
+
+func (c *dotConn) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *dotConn) exchange(ctx context.Context, m *dnslib.Msg) (*dnslib.Msg, error) {
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	query := m.Copy()
+	query.Id = id
+
+	c.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetWriteDeadline(deadline)
+	}
+	err = c.conn.WriteMsg(query)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errUpstreamClosed
+		}
+		resp.Id = m.Id
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop delivers responses to their waiting callers until the connection fails
+func (c *dotConn) readLoop() {
+	for {
+		resp, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close()
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Id]
+		delete(c.pending, resp.Id)
+		c.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// close shuts the connection and fails every in-flight query
+func (c *dotConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	_ = c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// dohUpstream speaks DNS-over-HTTPS (RFC 8484 POST) over a keepalive HTTP/2 client
+type dohUpstream struct {
+	address string
+	url     string
+	client  *http.Client
+}
+
+func newDoHUpstream(cfg UpstreamConfig, u *url.URL) *dohUpstream {
+	dialAddr := dialAddress(u, cfg.Bootstrap, "443")
+	dialer := &net.Dialer{Timeout: cfg.Timeout, KeepAlive: 30 * time.Second}
+
+	transport := &http.Transport{
+		// Always connect to the bootstrap address; TLS still verifies u.Hostname()
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, dialAddr)
+		},
+		TLSClientConfig:     &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     dohIdleTimeout,
+		TLSHandshakeTimeout: cfg.Timeout,
+		HTTP2: &http.HTTP2Config{
+			SendPingTimeout: 30 * time.Second,
+			PingTimeout:     cfg.Timeout,
+		},
+	}
+
+	return &dohUpstream{
+		address: cfg.Address,
+		url:     u.String(),
+		client:  &http.Client{Transport: transport, Timeout: cfg.Timeout},
+	}
+}
+
+func (u *dohUpstream) String() string { return u.address }
+
+func (u *dohUpstream) Exchange(ctx context.Context, m *dnslib.Msg) (*dnslib.Msg, error) {
+	// RFC 8484 recommends ID 0 so responses are cache friendly
+	query := m.Copy()
+	query.Id = 0
+	wire, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH upstream %s returned HTTP %d", u.address, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHMessageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dnslib.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, fmt.Errorf("invalid DoH response from %s: %w", u.address, err)
+	}
+	reply.Id = m.Id
+	return reply, nil
+}
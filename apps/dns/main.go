@@ -33,6 +33,7 @@ func main() {
 	// Log startup information
 	logger.Info("DNS server starting on", cfg.Listen)
 	logger.Info("Configured domains:", len(cfg.Domains))
+	logger.Info("Configured zone files:", len(cfg.ZoneFiles), "hosts files:", len(cfg.HostsFiles))
 
 	// Create DNS server
 	server := internal.NewServer(cfg, logger)
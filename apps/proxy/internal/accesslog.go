@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Access log formats; any other format is a text/template over accessLogEntry
+const (
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// apacheTimeFormat is the timestamp of the Common Log Format
+const apacheTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogKey carries the request's *accessLogEntry in its context so the
+// upstream transport can record the target it chose
+type accessLogKey struct{}
+
+// accessLogEntry is one request in the access log
+type accessLogEntry struct {
+	Time          time.Time `json:"time"`
+	RemoteAddr    string    `json:"remote_addr"`
+	User          string    `json:"user,omitempty"`
+	Method        string    `json:"method"`
+	Host          string    `json:"host"`
+	URI           string    `json:"uri"`
+	Proto         string    `json:"proto"`
+	Status        int       `json:"status"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Referer       string    `json:"referer,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+	Route         string    `json:"route,omitempty"`
+	// Upstream is the target that answered, or the last one tried
+	Upstream string `json:"upstream,omitempty"`
+	// UpstreamMs is the time until the upstream's response headers arrived,
+	// retries included; DurationMs covers the whole request
+	UpstreamMs    float64 `json:"upstream_ms,omitempty"`
+	DurationMs    float64 `json:"duration_ms"`
+	TLSVersion    string  `json:"tls_version,omitempty"`
+	TLSCipher     string  `json:"tls_cipher,omitempty"`
+	TLSServerName string  `json:"tls_server_name,omitempty"`
+	RequestID     string  `json:"request_id,omitempty"`
+	Cache         string  `json:"cache,omitempty"`
+}
+
+// newAccessLogEntry records the request side of r
+func newAccessLogEntry(r *http.Request, start time.Time) *accessLogEntry {
+	entry := &accessLogEntry{
+		Time:       start,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Host:       r.Host,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		RequestID:  r.Header.Get("X-Request-ID"),
+	}
+	if ip := remoteIP(r); ip != nil {
+		entry.RemoteAddr = ip.String()
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		entry.User = user
+	}
+	if r.TLS != nil {
+		entry.TLSVersion = tls.VersionName(r.TLS.Version)
+		entry.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+		entry.TLSServerName = r.TLS.ServerName
+	}
+	return entry
+}
+
+// recordUpstream notes the upstream target and latency in the request's entry
+func recordUpstream(ctx context.Context, target string, latency time.Duration) {
+	if entry, ok := ctx.Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.Upstream = target
+		entry.UpstreamMs = milliseconds(latency)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// accessLog writes one line per request to its own sink, apart from the
+// telemetry logs
+type accessLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	tmpl   *template.Template
+}
+
+func newAccessLog(cfg AccessLogConfig) (*accessLog, error) {
+	l := &accessLog{format: cfg.Format}
+	switch cfg.Output {
+	case "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		f, err := os.OpenFile(cfg.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log file: %w", err)
+		}
+		l.out = f
+	}
+	switch cfg.Format {
+	case accessLogCommon, accessLogCombined, accessLogJSON:
+	default:
+		tmpl, err := parseAccessLogTemplate(cfg.Format)
+		if err != nil {
+			return nil, err
+		}
+		l.tmpl = tmpl
+	}
+	return l, nil
+}
+
+func parseAccessLogTemplate(format string) (*template.Template, error) {
+	tmpl, err := template.New("access_log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// write formats entry and appends it to the log
+func (l *accessLog) write(entry *accessLogEntry) error {
+	var line bytes.Buffer
+	switch l.format {
+	case accessLogJSON:
+		if err := json.NewEncoder(&line).Encode(entry); err != nil {
+			return err
+		}
+	case accessLogCommon, accessLogCombined:
+		fmt.Fprintf(&line, "%s - %s [%s] \"%s %s %s\" %d %s",
+			entry.RemoteAddr, orDash(entry.User), entry.Time.Format(apacheTimeFormat),
+			entry.Method, entry.URI, entry.Proto, entry.Status, bytesOrDash(entry.BytesSent))
+		if l.format == accessLogCombined {
+			fmt.Fprintf(&line, " %q %q", orDash(entry.Referer), orDash(entry.UserAgent))
+		}
+		line.WriteByte('\n')
+	default:
+		if err := l.tmpl.Execute(&line, entry); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(line.Bytes(), []byte("\n")) {
+			line.WriteByte('\n')
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.out.Write(line.Bytes())
+	return err
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// bytesOrDash formats a body size like Apache's %b
+func bytesOrDash(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// countingBody counts the request body bytes read by the handler
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// countingConn counts the bytes of a hijacked WebSocket connection
+type countingConn struct {
+	net.Conn
+	rw *responseWriter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.rw.bytesReceived.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.rw.bytesSent.Add(int64(n))
+	return n, err
+}
+
+// Hijack hands the connection to the WebSocket proxy, counting its traffic
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.statusCode = http.StatusSwitchingProtocols
+	counted := &countingConn{Conn: conn, rw: rw}
+	if brw.Reader.Buffered() == 0 {
+		brw = bufio.NewReadWriter(bufio.NewReader(counted), bufio.NewWriter(counted))
+	}
+	return counted, brw, nil
+}
@@ -0,0 +1,387 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheStatusHeader reports how the cache answered a request
+const cacheStatusHeader = "X-Cache"
+
+// Values of the X-Cache header
+const (
+	cacheHit = "HIT"
+	// cacheRevalidated is a stale entry the upstream confirmed with 304
+	cacheRevalidated = "REVALIDATED"
+	cacheMiss        = "MISS"
+	// cacheBypass is a request the cache may not answer, e.g. with credentials
+	cacheBypass = "BYPASS"
+)
+
+// cacheableStatus are the response codes stored when the response allows it
+var cacheableStatus = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMovedPermanently,
+	http.StatusNotFound,
+	http.StatusGone,
+}
+
+// cacheControl parses a Cache-Control header into directives and their values
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// cachingTransport answers requests of a route from the response cache
+// following the shared cache rules of RFC 9111, and fills it from the
+// upstream transport
+type cachingTransport struct {
+	next  http.RoundTripper
+	store *responseStore
+	// maxObject is the largest body stored, in bytes
+	maxObject int64
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheableRequest(req) {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil {
+			resp.Header.Set(cacheStatusHeader, cacheBypass)
+		}
+		return resp, err
+	}
+
+	base := req.Host + " " + req.URL.RequestURI()
+	key := varyKey(base, t.store.varyNames(base), req)
+	now := time.Now()
+	entry := t.store.get(key)
+	requestCC := cacheControl(req.Header)
+	_, noCache := requestCC["no-cache"]
+	if maxAge, ok := requestCC["max-age"]; ok && maxAge == "0" {
+		noCache = true
+	}
+
+	if entry != nil && !noCache && entry.fresh(now) {
+		return entry.response(req, now, cacheHit), nil
+	}
+
+	if entry != nil && entry.hasValidator() {
+		// Ask the upstream whether the stored response is still current
+		cond := req.Clone(req.Context())
+		for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+			cond.Header.Del(name)
+		}
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			cond.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			cond.Header.Set("If-Modified-Since", modified)
+		}
+		resp, err := t.next.RoundTrip(cond)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			refreshed := entry.refreshed(resp.Header, time.Now())
+			t.store.put(refreshed)
+			return refreshed.response(req, time.Now(), cacheRevalidated), nil
+		}
+		return t.fill(req, base, resp), nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.fill(req, base, resp), nil
+}
+
+// fill marks resp as a miss and stores it once its body was read, if the
+// response may be cached
+func (t *cachingTransport) fill(req *http.Request, base string, resp *http.Response) *http.Response {
+	resp.Header.Set(cacheStatusHeader, cacheMiss)
+	if !storableResponse(req, resp) || resp.ContentLength > t.maxObject {
+		return resp
+	}
+
+	vary := varyHeaderNames(resp.Header)
+	entry := &cachedResponse{
+		Key:    varyKey(base, vary, req),
+		Base:   base,
+		Vary:   vary,
+		Status: resp.StatusCode,
+		Header: resp.Header.Clone(),
+		Stored: time.Now(),
+	}
+	entry.Header.Del(cacheStatusHeader)
+	resp.Body = &cacheFillReader{ReadCloser: resp.Body, entry: entry, store: t.store, limit: t.maxObject}
+	return resp
+}
+
+// cacheFillReader copies a response body into its cache entry and stores the
+// entry when the body was read completely
+type cacheFillReader struct {
+	io.ReadCloser
+	entry *cachedResponse
+	store *responseStore
+	limit int64
+	buf   bytes.Buffer
+	// skip is set once the body turned out too large
+	skip bool
+	done bool
+}
+
+func (r *cacheFillReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.skip {
+		if int64(r.buf.Len()+n) > r.limit {
+			r.skip = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !r.skip && !r.done {
+		r.done = true
+		r.entry.Body = r.buf.Bytes()
+		r.entry.Header.Set("Content-Length", strconv.Itoa(len(r.entry.Body)))
+		r.store.put(r.entry)
+	}
+	return n, err
+}
+
+// cacheableRequest reports whether the cache may answer req. Requests with
+// credentials or ranges and those forbidding storage always go upstream.
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+	_, noStore := cacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// storableResponse reports whether a shared cache may store resp
+func storableResponse(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || !slices.Contains(cacheableStatus, resp.StatusCode) {
+		return false
+	}
+	cc := cacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+	// Responses setting cookies belong to one client
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	_, maxAge := cc["max-age"]
+	_, sMaxAge := cc["s-maxage"]
+	return maxAge || sMaxAge || resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// varyHeaderNames returns the canonical header names listed in Vary
+func varyHeaderNames(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// varyKey extends base with the request's values of the Vary headers
+func varyKey(base string, vary []string, req *http.Request) string {
+	if len(vary) == 0 {
+		return base
+	}
+	var b strings.Builder
+	b.WriteString(base)
+	for _, name := range vary {
+		b.WriteString("\x00" + name + "=" + strings.Join(req.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// lifetime returns how long the response is fresh after it was stored.
+// Responses with no-cache are stored but always revalidated.
+func (c *cachedResponse) lifetime() time.Duration {
+	cc := cacheControl(c.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if expires := c.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(c.Header.Get("Date"))
+		if err != nil {
+			date = c.Stored
+		}
+		return expiresAt.Sub(date)
+	}
+	return 0
+}
+
+// age is how old the response is at now, including the age it arrived with
+func (c *cachedResponse) age(now time.Time) time.Duration {
+	initial, _ := strconv.Atoi(c.Header.Get("Age"))
+	return time.Duration(initial)*time.Second + now.Sub(c.Stored)
+}
+
+func (c *cachedResponse) fresh(now time.Time) bool {
+	return c.age(now) < c.lifetime()
+}
+
+func (c *cachedResponse) hasValidator() bool {
+	return c.Header.Get("ETag") != "" || c.Header.Get("Last-Modified") != ""
+}
+
+// refreshed returns a copy of the entry updated with the headers of a 304
+// response (RFC 9111 section 4.3.4)
+func (c *cachedResponse) refreshed(header http.Header, now time.Time) *cachedResponse {
+	updated := *c
+	updated.Header = c.Header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.Header.Del("Age")
+	updated.Header.Del(cacheStatusHeader)
+	updated.Stored = now
+	return &updated
+}
+
+// notModified reports whether the client's conditional headers match the entry
+func (c *cachedResponse) notModified(req *http.Request) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(c.Header.Get("ETag"), "W/")
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || (etag != "" && candidate == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(c.Header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// response builds the answer to req from the entry
+func (c *cachedResponse) response(req *http.Request, now time.Time, status string) *http.Response {
+	header := c.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(c.age(now).Seconds())))
+	header.Set(cacheStatusHeader, status)
+
+	resp := &http.Response{
+		Status:        strconv.Itoa(c.Status) + " " + http.StatusText(c.Status),
+		StatusCode:    c.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+	if c.Status == http.StatusOK && c.notModified(req) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 " + http.StatusText(http.StatusNotModified)
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		header.Del("Content-Length")
+	}
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+// cachePurgeRequest is the body of a POST to /api/cache/purge. An empty host
+// matches all routes, an empty prefix all paths.
+type cachePurgeRequest struct {
+	Host   string `json:"host"`
+	Prefix string `json:"prefix"`
+}
+
+// serveCachePurgeAPI removes cached responses whose URI starts with a prefix
+func (s *Server) serveCachePurgeAPI(w http.ResponseWriter, r *http.Request) {
+	logger := s.requestLogger(r)
+	logger.Info(fmt.Sprintf("Serving cache purge API request - method=%s host=%s path=%s remote_addr=%s",
+		r.Method, r.Host, r.URL.Path, r.RemoteAddr))
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !containsIP(s.adminNets, remoteIP(r)) {
+		logger.Error(fmt.Sprintf("Cache purge refused - remote_addr=%s", r.RemoteAddr))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var req cachePurgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	purged := 0
+	if s.cache != nil {
+		purged = s.cache.purge(func(base string) bool {
+			return baseHasPrefix(base, req.Host, req.Prefix)
+		})
+	}
+	logger.Info(fmt.Sprintf("Cache purged - host=%s prefix=%s purged=%d remote_addr=%s",
+		req.Host, req.Prefix, purged, r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"purged": purged}); err != nil {
+		logger.Error("Error encoding cache purge response:", err)
+	}
+}
@@ -0,0 +1,495 @@
+package internal
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+)
+
+// cacheFileExt marks entry files in the disk tier directory
+const cacheFileExt = ".cache"
+
+// cachedResponse is a stored upstream response
+type cachedResponse struct {
+	// Key is the base key (host and URI) plus the values of the Vary headers
+	Key    string
+	Base   string
+	Vary   []string
+	Status int
+	Header http.Header
+	Body   []byte
+	// Stored is when the response was received or last revalidated
+	Stored time.Time
+}
+
+// size approximates the memory the entry takes
+func (c *cachedResponse) size() int64 {
+	n := len(c.Key) + len(c.Base) + len(c.Body)
+	for name, values := range c.Header {
+		n += len(name)
+		for _, v := range values {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+// cacheFileHeader is the first line of an entry file, read to rebuild the
+// disk index on startup without decoding the whole entry
+type cacheFileHeader struct {
+	Key  string   `json:"key"`
+	Base string   `json:"base"`
+	Vary []string `json:"vary,omitempty"`
+}
+
+// cacheItem is an entry in one of the LRU tiers. Memory items hold the
+// response, disk items the file name; a disk item keeps its response until the
+// writer has written the file.
+type cacheItem struct {
+	key  string
+	base string
+	size int64
+	resp *cachedResponse
+	file string
+}
+
+// cacheBase tracks the entries of a base key in both tiers, so its Vary names
+// are forgotten together with its last entry
+type cacheBase struct {
+	vary    []string
+	entries int
+}
+
+// responseStore keeps cached responses in a memory tier and an optional disk
+// tier, both bounded in bytes with least recently used eviction. Entries
+// evicted from memory move to disk; disk hits move back to memory. The lock
+// only guards the indexes: files are written by a background writer and read
+// or removed after the lock is released.
+type responseStore struct {
+	cfg    ResponseCacheConfig
+	logger *telemetry.Logger
+
+	mu       sync.Mutex
+	mem      map[string]*list.Element
+	memLRU   *list.List
+	memSize  int64
+	disk     map[string]*list.Element
+	diskLRU  *list.List
+	diskSize int64
+	// bases holds the Vary header names of each base key with entries
+	bases map[string]*cacheBase
+	// writes are the disk items waiting for the writer
+	writes []*cacheItem
+	wake   chan struct{}
+	// stale are the files of dropped disk items, removed by unlock
+	stale []string
+}
+
+func newResponseStore(cfg ResponseCacheConfig, logger *telemetry.Logger) (*responseStore, error) {
+	s := &responseStore{
+		cfg:     cfg,
+		logger:  logger,
+		mem:     make(map[string]*list.Element),
+		memLRU:  list.New(),
+		disk:    make(map[string]*list.Element),
+		diskLRU: list.New(),
+		bases:   make(map[string]*cacheBase),
+		wake:    make(chan struct{}, 1),
+	}
+	if cfg.DiskDir != "" {
+		if err := os.MkdirAll(cfg.DiskDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		if err := s.loadDisk(); err != nil {
+			return nil, err
+		}
+		go s.writeLoop()
+	}
+	return s, nil
+}
+
+// unlock releases the lock, then removes the files dropped while it was held
+func (s *responseStore) unlock() {
+	stale := s.stale
+	s.stale = nil
+	s.mu.Unlock()
+	for _, file := range stale {
+		_ = os.Remove(file)
+	}
+}
+
+func (s *responseStore) memLimit() int64 {
+	return int64(s.cfg.MemorySizeMB) << 20
+}
+
+func (s *responseStore) diskLimit() int64 {
+	if s.cfg.DiskDir == "" {
+		return 0
+	}
+	return int64(s.cfg.DiskSizeMB) << 20
+}
+
+// loadDisk indexes the entry files left by a previous run, oldest first
+func (s *responseStore) loadDisk() error {
+	files, err := filepath.Glob(filepath.Join(s.cfg.DiskDir, "*"+cacheFileExt))
+	if err != nil {
+		return err
+	}
+	type diskFile struct {
+		header  cacheFileHeader
+		file    string
+		size    int64
+		modTime time.Time
+	}
+	var found []diskFile
+	for _, file := range files {
+		header, info, err := readCacheFileHeader(file)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Removing unreadable cache file - file=%s error=%v", file, err))
+			_ = os.Remove(file)
+			continue
+		}
+		found = append(found, diskFile{header: header, file: file, size: info.Size(), modTime: info.ModTime()})
+	}
+	// Most recently written files end up at the front of the LRU
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.Before(found[j].modTime)
+	})
+	s.mu.Lock()
+	defer s.unlock()
+	for _, f := range found {
+		// A newer file for the same key supersedes the older one
+		if el, ok := s.disk[f.header.Key]; ok {
+			s.dropDiskLocked(el)
+		}
+		s.disk[f.header.Key] = s.diskLRU.PushFront(&cacheItem{key: f.header.Key, base: f.header.Base, size: f.size, file: f.file})
+		s.diskSize += f.size
+		s.refLocked(f.header.Base, f.header.Vary)
+	}
+	s.evictDiskLocked()
+	s.logger.Info(fmt.Sprintf("Loaded response cache from disk - dir=%s entries=%d size_bytes=%d", s.cfg.DiskDir, len(s.disk), s.diskSize))
+	return nil
+}
+
+func readCacheFileHeader(file string) (cacheFileHeader, os.FileInfo, error) {
+	var header cacheFileHeader
+	f, err := os.Open(file)
+	if err != nil {
+		return header, nil, err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return header, nil, err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return header, nil, err
+	}
+	return header, info, json.Unmarshal(line, &header)
+}
+
+// varyNames returns the Vary header names known for base
+func (s *responseStore) varyNames(base string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.bases[base]; ok {
+		return b.vary
+	}
+	return nil
+}
+
+// refLocked counts an entry of base, taking vary as its Vary names when it is
+// the first one
+func (s *responseStore) refLocked(base string, vary []string) {
+	b, ok := s.bases[base]
+	if !ok {
+		b = &cacheBase{vary: vary}
+		s.bases[base] = b
+	}
+	b.entries++
+}
+
+// unrefLocked uncounts an entry of base and forgets base with its last entry
+func (s *responseStore) unrefLocked(base string) {
+	if b, ok := s.bases[base]; ok {
+		if b.entries--; b.entries <= 0 {
+			delete(s.bases, base)
+		}
+	}
+}
+
+// get returns the entry for key, moving disk entries back to memory
+func (s *responseStore) get(key string) *cachedResponse {
+	s.mu.Lock()
+	if el, ok := s.mem[key]; ok {
+		s.memLRU.MoveToFront(el)
+		resp := el.Value.(*cacheItem).resp
+		s.unlock()
+		return resp
+	}
+	el, ok := s.disk[key]
+	if !ok {
+		s.unlock()
+		return nil
+	}
+	item := el.Value.(*cacheItem)
+	s.removeDiskLocked(el)
+	if resp := item.resp; resp != nil {
+		// Not written yet; the writer drops the file once it sees the item is gone
+		s.putMemLocked(resp)
+		s.unlock()
+		return resp
+	}
+	s.unlock()
+
+	resp, err := readCacheFile(item.file)
+	_ = os.Remove(item.file)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Dropping unreadable cache file - file=%s error=%v", item.file, err))
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.unlock()
+	// Keep a response stored while the file was being read
+	if _, ok := s.mem[key]; !ok && s.disk[key] == nil {
+		s.putMemLocked(resp)
+	}
+	return resp
+}
+
+// put stores resp, replacing an entry with the same key
+func (s *responseStore) put(resp *cachedResponse) {
+	s.mu.Lock()
+	defer s.unlock()
+
+	s.removeLocked(resp.Key)
+	s.putMemLocked(resp)
+	// The latest response decides which headers the base varies on
+	if b, ok := s.bases[resp.Base]; ok {
+		b.vary = resp.Vary
+	}
+}
+
+// purge removes the entries whose base key matches and returns how many
+func (s *responseStore) purge(match func(base string) bool) int {
+	s.mu.Lock()
+	defer s.unlock()
+
+	var keys []string
+	for key, el := range s.mem {
+		if match(el.Value.(*cacheItem).base) {
+			keys = append(keys, key)
+		}
+	}
+	for key, el := range s.disk {
+		if match(el.Value.(*cacheItem).base) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		s.removeLocked(key)
+	}
+	return len(keys)
+}
+
+func (s *responseStore) putMemLocked(resp *cachedResponse) {
+	item := &cacheItem{key: resp.Key, base: resp.Base, size: resp.size(), resp: resp}
+	s.mem[resp.Key] = s.memLRU.PushFront(item)
+	s.memSize += item.size
+	s.refLocked(resp.Base, resp.Vary)
+
+	for s.memSize > s.memLimit() {
+		el := s.memLRU.Back()
+		evicted := el.Value.(*cacheItem)
+		s.memLRU.Remove(el)
+		delete(s.mem, evicted.key)
+		s.memSize -= evicted.size
+		s.demoteLocked(evicted.resp)
+		s.unrefLocked(evicted.base)
+	}
+}
+
+// demoteLocked moves an entry evicted from memory to the disk tier and queues
+// its file for the writer
+func (s *responseStore) demoteLocked(resp *cachedResponse) {
+	if s.diskLimit() == 0 {
+		return
+	}
+	item := &cacheItem{key: resp.Key, base: resp.Base, size: resp.size(), resp: resp}
+	s.disk[resp.Key] = s.diskLRU.PushFront(item)
+	s.diskSize += item.size
+	s.refLocked(resp.Base, resp.Vary)
+	s.writes = append(s.writes, item)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	s.evictDiskLocked()
+}
+
+// writeLoop writes the files of demoted entries
+func (s *responseStore) writeLoop() {
+	for range s.wake {
+		s.mu.Lock()
+		writes := s.writes
+		s.writes = nil
+		s.mu.Unlock()
+		for _, item := range writes {
+			s.write(item)
+		}
+	}
+}
+
+// write writes the file of item unless it left the disk tier in the meantime
+func (s *responseStore) write(item *cacheItem) {
+	s.mu.Lock()
+	if !s.onDiskLocked(item) {
+		s.mu.Unlock()
+		return
+	}
+	resp := item.resp
+	s.mu.Unlock()
+
+	file, size, err := writeCacheFile(s.cfg.DiskDir, resp)
+
+	s.mu.Lock()
+	defer s.unlock()
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to write cache file - key=%s error=%v", resp.Key, err))
+		if s.onDiskLocked(item) {
+			s.removeDiskLocked(s.disk[item.key])
+		}
+		return
+	}
+	if !s.onDiskLocked(item) {
+		s.stale = append(s.stale, file)
+		return
+	}
+	item.file = file
+	item.resp = nil
+	s.diskSize += size - item.size
+	item.size = size
+	s.evictDiskLocked()
+}
+
+// onDiskLocked reports whether item is still the disk tier's entry for its key
+func (s *responseStore) onDiskLocked(item *cacheItem) bool {
+	el, ok := s.disk[item.key]
+	return ok && el.Value.(*cacheItem) == item
+}
+
+func (s *responseStore) evictDiskLocked() {
+	for s.diskSize > s.diskLimit() && s.diskLRU.Len() > 0 {
+		s.dropDiskLocked(s.diskLRU.Back())
+	}
+}
+
+func (s *responseStore) removeDiskLocked(el *list.Element) {
+	item := el.Value.(*cacheItem)
+	s.diskLRU.Remove(el)
+	delete(s.disk, item.key)
+	s.diskSize -= item.size
+	s.unrefLocked(item.base)
+}
+
+// dropDiskLocked removes a disk item and marks its file, if written, for removal
+func (s *responseStore) dropDiskLocked(el *list.Element) {
+	item := el.Value.(*cacheItem)
+	s.removeDiskLocked(el)
+	if item.resp == nil {
+		s.stale = append(s.stale, item.file)
+	}
+}
+
+func (s *responseStore) removeLocked(key string) {
+	if el, ok := s.mem[key]; ok {
+		item := el.Value.(*cacheItem)
+		s.memLRU.Remove(el)
+		delete(s.mem, key)
+		s.memSize -= item.size
+		s.unrefLocked(item.base)
+	}
+	if el, ok := s.disk[key]; ok {
+		s.dropDiskLocked(el)
+	}
+}
+
+// cacheFileName returns a new random file name; the key is stored in the
+// file, and distinct names keep a rewrite from clobbering a file being read
+func cacheFileName() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:]) + cacheFileExt
+}
+
+// writeCacheFile writes resp to a new file in dir as a JSON header line
+// followed by the gob encoded entry and returns the file and its size
+func writeCacheFile(dir string, resp *cachedResponse) (string, int64, error) {
+	tmp, err := os.CreateTemp(dir, ".entry-*")
+	if err != nil {
+		return "", 0, err
+	}
+	header, err := json.Marshal(cacheFileHeader{Key: resp.Key, Base: resp.Base, Vary: resp.Vary})
+	if err == nil {
+		_, err = tmp.Write(append(header, '\n'))
+	}
+	if err == nil {
+		err = gob.NewEncoder(tmp).Encode(resp)
+	}
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		if info, err = tmp.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	file := filepath.Join(dir, cacheFileName())
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return file, size, nil
+}
+
+func readCacheFile(file string) (*cachedResponse, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	r := bufio.NewReader(f)
+	if _, err := r.ReadBytes('\n'); err != nil {
+		return nil, err
+	}
+	resp := &cachedResponse{}
+	if err := gob.NewDecoder(r).Decode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// baseHasPrefix reports whether the base key is on host with a URI starting with prefix
+func baseHasPrefix(base, host, prefix string) bool {
+	baseHost, uri, _ := strings.Cut(base, " ")
+	return (host == "" || baseHost == host) && strings.HasPrefix(uri, prefix)
+}
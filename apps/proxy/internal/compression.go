@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content encodings the proxy compresses with, in order of preference
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// brotliLevel trades ratio for speed, as responses are compressed on the fly
+const brotliLevel = 4
+
+var gzipWriters = sync.Pool{New: func() any {
+	return gzip.NewWriter(io.Discard)
+}}
+
+var brotliWriters = sync.Pool{New: func() any {
+	return brotli.NewWriterLevel(io.Discard, brotliLevel)
+}}
+
+// negotiateEncoding picks the first of the route's encodings the client
+// accepts with a non-zero quality, or "" for none
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	accepted := make(map[string]bool)
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				accepted[name] = false
+				continue
+			}
+		}
+		if name == "*" {
+			wildcard = true
+			continue
+		}
+		accepted[name] = true
+	}
+	for _, encoding := range encodings {
+		if ok, listed := accepted[encoding]; ok || (!listed && wildcard) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressibleType reports whether a Content-Type matches one of the route's
+// types ("text/*" matches all text types). Event streams are never compressed
+// so events reach the client as they are sent.
+func compressibleType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses a proxied response when its headers allow it.
+// Bodies of unknown length are buffered up to the minimum size before
+// deciding, unless a flush comes first: the body is then streamed and sent as
+// is. Event streams are never buffered as they are not compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg      CompressionConfig
+	encoding string
+	head     bool
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	encoder     io.WriteCloser
+}
+
+// newCompressWriter wraps w for r, or returns nil when the client accepts
+// none of the route's encodings
+func newCompressWriter(w http.ResponseWriter, r *http.Request, cfg CompressionConfig) *compressWriter {
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+	if encoding == "" {
+		return nil
+	}
+	return &compressWriter{ResponseWriter: w, cfg: cfg, encoding: encoding, head: r.Method == http.MethodHead}
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if code < 200 {
+		// Informational responses like 103 Early Hints pass through
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+
+	h := cw.Header()
+	if cw.head || code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent ||
+		(h.Get("Content-Encoding") != "" && h.Get("Content-Encoding") != "identity") ||
+		strings.Contains(h.Get("Cache-Control"), "no-transform") ||
+		!compressibleType(h.Get("Content-Type"), cw.cfg.Types) {
+		cw.passthrough()
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		if length < cw.cfg.MinSize {
+			cw.passthrough()
+		} else {
+			cw.compress()
+		}
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.cfg.MinSize {
+		cw.compress()
+		if err := cw.writeBuffered(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends what was written so far; ReverseProxy flushes streamed responses
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.passthrough()
+		if err := cw.writeBuffered(); err != nil {
+			return
+		}
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the response: a body that stayed below the minimum size is
+// sent uncompressed, a compressed one is terminated
+func (cw *compressWriter) close() error {
+	if cw.wroteHeader && !cw.decided {
+		cw.passthrough()
+		if err := cw.writeBuffered(); err != nil {
+			return err
+		}
+	}
+	if cw.encoder == nil {
+		return nil
+	}
+	err := cw.encoder.Close()
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		encoder.Reset(io.Discard)
+		gzipWriters.Put(encoder)
+	case *brotli.Writer:
+		encoder.Reset(io.Discard)
+		brotliWriters.Put(encoder)
+	}
+	cw.encoder = nil
+	return err
+}
+
+// passthrough sends the headers and leaves the body uncompressed
+func (cw *compressWriter) passthrough() {
+	cw.decided = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// compress sends the headers for a compressed body and starts the encoder
+func (cw *compressWriter) compress() {
+	cw.decided = true
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	// The compressed body is a different representation
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	switch cw.encoding {
+	case encodingBrotli:
+		encoder := brotliWriters.Get().(*brotli.Writer)
+		encoder.Reset(cw.ResponseWriter)
+		cw.encoder = encoder
+	default:
+		encoder := gzipWriters.Get().(*gzip.Writer)
+		encoder.Reset(cw.ResponseWriter)
+		cw.encoder = encoder
+	}
+}
+
+// writeBuffered writes the body held back while deciding
+func (cw *compressWriter) writeBuffered() error {
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
@@ -2,7 +2,9 @@ package internal
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
+	"time"
 	"waguri-centralized-control/packages/go-utils/config"
 )
 
@@ -10,6 +12,31 @@ type ProxyConfig struct {
 	config.Config `yaml:",inline"`
 	Routes        []RoutesConfig `yaml:"routes"`
 	Menu          string         `yaml:"menu"`
+	// AdminClients may toggle maintenance mode through /api/maintenance and
+	// purge the cache through /api/cache/purge (IPs or CIDRs); defaults to localhost
+	AdminClients []string            `yaml:"admin_clients"`
+	Cache        ResponseCacheConfig `yaml:"cache"`
+	AccessLog    AccessLogConfig     `yaml:"access_log"`
+}
+
+// AccessLogConfig writes one line per request to a sink separate from the
+// telemetry logs
+type AccessLogConfig struct {
+	// Output is stdout, stderr or a file path; empty disables the access log
+	Output string `yaml:"output"`
+	// Format is common, combined, json or a text/template over the entry
+	// fields, e.g. "{{.Host}} {{.Status}} {{.Upstream}} {{.UpstreamMs}}"
+	Format string `yaml:"format"`
+}
+
+// ResponseCacheConfig sizes the response cache shared by routes with caching enabled
+type ResponseCacheConfig struct {
+	MemorySizeMB int `yaml:"memory_size_mb"`
+	// DiskDir holds entries evicted from memory; empty keeps the cache in memory only
+	DiskDir    string `yaml:"disk_dir"`
+	DiskSizeMB int    `yaml:"disk_size_mb"`
+	// MaxObjectSizeMB is the largest response body stored
+	MaxObjectSizeMB int `yaml:"max_object_size_mb"`
 }
 
 type RoutesConfig struct {
@@ -19,8 +46,78 @@ type RoutesConfig struct {
 	Description string `yaml:"description" validate:"required"`
 	Icon        string `yaml:"icon" validate:"required"`
 	Category    string `yaml:"category" validate:"required"`
+	// Fallbacks are further upstreams serving the same app (scheme://host:port),
+	// tried in order when the target fails
+	Fallbacks []string       `yaml:"fallbacks"`
+	Timeouts  TimeoutsConfig `yaml:"timeouts"`
+	// Retries is how often an idempotent request without a body is retried
+	// against the next upstream when connecting fails
+	Retries        *int                 `yaml:"retries"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Maintenance    MaintenanceConfig    `yaml:"maintenance"`
+	Compression    CompressionConfig    `yaml:"compression"`
+	Cache          RouteCacheConfig     `yaml:"cache"`
+}
+
+// RouteCacheConfig stores the route's responses as allowed by their
+// Cache-Control, Expires and validator headers
+type RouteCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// CompressionConfig compresses proxied responses the upstream sent uncompressed
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Encodings in order of preference: "br" and/or "gzip"
+	Encodings []string `yaml:"encodings"`
+	// Types are the compressed media types; "text/*" matches all text types
+	Types []string `yaml:"types"`
+	// MinSize is the smallest body in bytes worth compressing
+	MinSize int `yaml:"min_size"`
+}
+
+// MaintenanceConfig serves a maintenance page instead of proxying the route
+type MaintenanceConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Message string `yaml:"message"`
+	// Until is the expected end of the maintenance, shown on the page
+	Until time.Time `yaml:"until"`
+	// BypassIPs still reach the upstream (IPs or CIDRs)
+	BypassIPs []string `yaml:"bypass_ips"`
+	// BypassToken lets browsers through that carry it in the bypass cookie,
+	// set by visiting any page with ?maintenance_bypass=<token>
+	BypassToken string `yaml:"bypass_token"`
+}
+
+// TimeoutsConfig bounds the phases of an upstream request
+type TimeoutsConfig struct {
+	Dial           time.Duration `yaml:"dial"`
+	TLSHandshake   time.Duration `yaml:"tls_handshake"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	// Idle is how long unused upstream connections are kept open
+	Idle time.Duration `yaml:"idle"`
+}
+
+// CircuitBreakerConfig fails requests fast while an upstream keeps failing
+type CircuitBreakerConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// Failures is how many consecutive failures open the circuit
+	Failures int `yaml:"failures"`
+	// Cooldown is how long the circuit stays open before a trial request
+	Cooldown time.Duration `yaml:"cooldown"`
 }
 
+// Defaults for upstream requests of proxied routes
+const (
+	defaultDialTimeout           = 5 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 60 * time.Second
+	defaultIdleTimeout           = 90 * time.Second
+	defaultRetries               = 2
+	defaultBreakerFailures       = 5
+	defaultBreakerCooldown       = 30 * time.Second
+)
+
 // IsRedirect checks if this route should trigger a redirect instead of proxy
 func (r *RoutesConfig) IsRedirect() bool {
 	return strings.HasPrefix(r.Target, "rhttp://") || strings.HasPrefix(r.Target, "rhttps://")
@@ -44,6 +141,23 @@ func LoadProxyConfig(path string) (*ProxyConfig, error) {
 		return nil, err
 	}
 
+	applyRouteDefaults(cfg.Routes)
+	if cfg.AdminClients == nil {
+		cfg.AdminClients = defaultAdminClients
+	}
+	if cfg.AccessLog.Format == "" {
+		cfg.AccessLog.Format = accessLogCombined
+	}
+	if cfg.Cache.MemorySizeMB == 0 {
+		cfg.Cache.MemorySizeMB = defaultCacheMemorySizeMB
+	}
+	if cfg.Cache.DiskSizeMB == 0 {
+		cfg.Cache.DiskSizeMB = defaultCacheDiskSizeMB
+	}
+	if cfg.Cache.MaxObjectSizeMB == 0 {
+		cfg.Cache.MaxObjectSizeMB = defaultCacheMaxObjectSizeMB
+	}
+
 	// Validate that all routes have required fields
 	if err := validateProxyConfig(cfg); err != nil {
 		return nil, fmt.Errorf("configuration validation failed: %w", err)
@@ -52,6 +166,71 @@ func LoadProxyConfig(path string) (*ProxyConfig, error) {
 	return cfg, nil
 }
 
+// defaultCompressionEncodings prefers brotli for its better ratio on text
+var defaultCompressionEncodings = []string{encodingBrotli, encodingGzip}
+
+// defaultCompressionTypes are text formats that compress well
+var defaultCompressionTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// defaultCompressionMinSize skips bodies that would barely shrink
+const defaultCompressionMinSize = 1024
+
+// Response cache sizes used when the cache section leaves them unset
+const (
+	defaultCacheMemorySizeMB    = 64
+	defaultCacheDiskSizeMB      = 1024
+	defaultCacheMaxObjectSizeMB = 8
+)
+
+// defaultAdminClients may use the admin API when admin_clients is not set
+var defaultAdminClients = []string{"127.0.0.0/8", "::1/128"}
+
+// applyRouteDefaults fills in unset timeouts, retries and circuit breaker settings
+func applyRouteDefaults(routes []RoutesConfig) {
+	for i := range routes {
+		route := &routes[i]
+		if route.Timeouts.Dial == 0 {
+			route.Timeouts.Dial = defaultDialTimeout
+		}
+		if route.Timeouts.TLSHandshake == 0 {
+			route.Timeouts.TLSHandshake = defaultTLSHandshakeTimeout
+		}
+		if route.Timeouts.ResponseHeader == 0 {
+			route.Timeouts.ResponseHeader = defaultResponseHeaderTimeout
+		}
+		if route.Timeouts.Idle == 0 {
+			route.Timeouts.Idle = defaultIdleTimeout
+		}
+		if route.Retries == nil {
+			retries := defaultRetries
+			route.Retries = &retries
+		}
+		if route.CircuitBreaker.Failures == 0 {
+			route.CircuitBreaker.Failures = defaultBreakerFailures
+		}
+		if route.CircuitBreaker.Cooldown == 0 {
+			route.CircuitBreaker.Cooldown = defaultBreakerCooldown
+		}
+		if route.Compression.Encodings == nil {
+			route.Compression.Encodings = defaultCompressionEncodings
+		}
+		if route.Compression.Types == nil {
+			route.Compression.Types = defaultCompressionTypes
+		}
+		if route.Compression.MinSize == 0 {
+			route.Compression.MinSize = defaultCompressionMinSize
+		}
+	}
+}
+
 // validateProxyConfig ensures all routes have required fields
 func validateProxyConfig(cfg *ProxyConfig) error {
 	for i, route := range cfg.Routes {
@@ -73,6 +252,50 @@ func validateProxyConfig(cfg *ProxyConfig) error {
 		if route.Category == "" {
 			return fmt.Errorf("route %d (%s): category is required", i, route.Host)
 		}
+		for _, fallback := range route.Fallbacks {
+			u, err := url.Parse(fallback)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("route %d (%s): invalid fallback '%s'", i, route.Host, fallback)
+			}
+		}
+		t := route.Timeouts
+		if t.Dial < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.Idle < 0 {
+			return fmt.Errorf("route %d (%s): timeouts must not be negative", i, route.Host)
+		}
+		if *route.Retries < 0 {
+			return fmt.Errorf("route %d (%s): retries must not be negative", i, route.Host)
+		}
+		if route.CircuitBreaker.Failures < 0 || route.CircuitBreaker.Cooldown < 0 {
+			return fmt.Errorf("route %d (%s): circuit_breaker failures and cooldown must be positive", i, route.Host)
+		}
+		for _, encoding := range route.Compression.Encodings {
+			if encoding != encodingBrotli && encoding != encodingGzip {
+				return fmt.Errorf("route %d (%s): unsupported compression encoding '%s'", i, route.Host, encoding)
+			}
+		}
+		if route.Compression.MinSize < 0 {
+			return fmt.Errorf("route %d (%s): compression min_size must not be negative", i, route.Host)
+		}
+		for _, ip := range route.Maintenance.BypassIPs {
+			if parseIPNet(ip) == nil {
+				return fmt.Errorf("route %d (%s): invalid maintenance bypass IP '%s'", i, route.Host, ip)
+			}
+		}
+	}
+	for _, ip := range cfg.AdminClients {
+		if parseIPNet(ip) == nil {
+			return fmt.Errorf("invalid admin client '%s'", ip)
+		}
+	}
+	switch cfg.AccessLog.Format {
+	case accessLogCommon, accessLogCombined, accessLogJSON:
+	default:
+		if _, err := parseAccessLogTemplate(cfg.AccessLog.Format); err != nil {
+			return err
+		}
+	}
+	if cfg.Cache.MemorySizeMB < 0 || cfg.Cache.DiskSizeMB < 0 || cfg.Cache.MaxObjectSizeMB < 0 {
+		return fmt.Errorf("cache sizes must not be negative")
 	}
 	return nil
 }
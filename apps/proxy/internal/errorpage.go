@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//go:embed errorpage.html
+var errorPageHTML string
+
+// errorPageTemplate renders error pages in the style of the menu
+var errorPageTemplate = template.Must(template.New("error").Parse(errorPageHTML))
+
+// Error classes shown on error pages and in JSON errors
+const (
+	errorClassConnectionRefused = "connection_refused"
+	errorClassTimeout           = "timeout"
+	errorClassTLS               = "tls"
+	errorClassDNS               = "dns"
+	errorClassCircuitOpen       = "circuit_open"
+	errorClassUpstream          = "upstream_error"
+	errorClassNotFound          = "not_found"
+	errorClassInternal          = "internal_error"
+)
+
+// errorPage describes an error answered to the client
+type errorPage struct {
+	Status int
+	Title  string
+	// Service is the name of the failed route, empty for proxy errors
+	Service    string
+	Host       string
+	Class      string
+	Message    string
+	RetryAfter int
+	MenuURL    string
+	// Maintenance pages announce planned downtime instead of a failure
+	Maintenance bool
+	// Until is the expected end of the maintenance
+	Until time.Time
+}
+
+// classifyUpstreamError maps an upstream error to an error class and a
+// message for the user
+func classifyUpstreamError(err error) (string, string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return errorClassCircuitOpen, "The service failed repeatedly and requests are paused for a moment while it recovers."
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorClassConnectionRefused, "The service refused the connection. It may be stopped or restarting."
+	case errors.As(err, &dnsErr):
+		return errorClassDNS, "The address of the service could not be resolved."
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr), strings.Contains(err.Error(), "tls:"):
+		return errorClassTLS, "A secure connection to the service could not be established."
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorClassTimeout, "The service did not answer in time. It may be overloaded or hanging."
+	}
+	return errorClassUpstream, "The service could not be reached."
+}
+
+// wantsJSON reports whether the client asked for JSON rather than a page
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeErrorPage answers with an HTML error page, or a JSON error when the
+// client accepts JSON
+func (s *Server) writeErrorPage(w http.ResponseWriter, r *http.Request, page errorPage) {
+	logger := s.requestLogger(r)
+	page.Title = http.StatusText(page.Status)
+	page.Host = r.Host
+	page.MenuURL = "http://" + s.cfg.Menu
+	if page.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(page.RetryAfter))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(page.Status)
+		body := map[string]any{
+			"status":  page.Status,
+			"error":   page.Class,
+			"message": page.Message,
+		}
+		if page.Service != "" {
+			body["service"] = page.Service
+		}
+		if page.RetryAfter > 0 {
+			body["retry_after"] = page.RetryAfter
+		}
+		if !page.Until.IsZero() {
+			body["until"] = page.Until.Format(time.RFC3339)
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			logger.Error("Error writing JSON error response:", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(page.Status)
+	if err := errorPageTemplate.Execute(w, page); err != nil {
+		logger.Error(fmt.Sprintf("Error rendering error page - status=%d error=%v", page.Status, err))
+	}
+}
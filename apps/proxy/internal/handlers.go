@@ -1,13 +1,16 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,7 +18,8 @@ import (
 
 // serveMenu handles the menu page requests
 func (s *Server) serveMenu(w http.ResponseWriter, r *http.Request) {
-	s.logger.Info(fmt.Sprintf("Serving menu request - method=%s host=%s path=%s remote_addr=%s user_agent=%s",
+	logger := s.requestLogger(r)
+	logger.Info(fmt.Sprintf("Serving menu request - method=%s host=%s path=%s remote_addr=%s user_agent=%s",
 		r.Method, r.Host, r.URL.Path, r.RemoteAddr, r.Header.Get("User-Agent")))
 
 	// Handle API endpoint for services data
@@ -23,39 +27,48 @@ func (s *Server) serveMenu(w http.ResponseWriter, r *http.Request) {
 		s.serveServicesAPI(w, r)
 		return
 	}
+	if r.URL.Path == "/api/maintenance" {
+		s.serveMaintenanceAPI(w, r)
+		return
+	}
+	if r.URL.Path == "/api/cache/purge" {
+		s.serveCachePurgeAPI(w, r)
+		return
+	}
 
 	// Serve the HTML menu
 	menuPath := filepath.Join(".", "menu.html")
 	if _, err := os.Stat(menuPath); os.IsNotExist(err) {
-		s.logger.Error(fmt.Sprintf("Menu file not found - path=%s error=%v", menuPath, err))
-		http.Error(w, "Menu file not found", http.StatusNotFound)
+		logger.Error(fmt.Sprintf("Menu file not found - path=%s error=%v", menuPath, err))
+		s.writeErrorPage(w, r, errorPage{Status: http.StatusNotFound, Class: errorClassNotFound, Message: "The menu file was not found on the proxy."})
 		return
 	}
 
 	// Read the HTML content
 	tmplContent, err := os.ReadFile(menuPath)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("Error reading menu file - path=%s error=%v", menuPath, err))
-		http.Error(w, "Error reading menu file", http.StatusInternalServerError)
+		logger.Error(fmt.Sprintf("Error reading menu file - path=%s error=%v", menuPath, err))
+		s.writeErrorPage(w, r, errorPage{Status: http.StatusInternalServerError, Class: errorClassInternal, Message: "The menu file could not be read."})
 		return
 	}
 
 	// Serve the static HTML (services will be loaded via API)
 	w.Header().Set("Content-Type", "text/html")
 	if _, err := w.Write(tmplContent); err != nil {
-		s.logger.Error("Error writing menu response:", err)
+		logger.Error("Error writing menu response:", err)
 	}
 }
 
 // serveServicesAPI handles the API endpoint for services data
 func (s *Server) serveServicesAPI(w http.ResponseWriter, r *http.Request) {
-	s.logger.Info(fmt.Sprintf("Serving services API request - method=%s host=%s path=%s remote_addr=%s",
+	logger := s.requestLogger(r)
+	logger.Info(fmt.Sprintf("Serving services API request - method=%s host=%s path=%s remote_addr=%s",
 		r.Method, r.Host, r.URL.Path, r.RemoteAddr))
 
 	services := s.generateServicesData()
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(services); err != nil {
-		s.logger.Error("Error encoding services response:", err)
+		logger.Error("Error encoding services response:", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
@@ -68,11 +81,12 @@ func isWebSocketRequest(r *http.Request) bool {
 
 // handleWebSocketProxy handles WebSocket connection proxying
 func (s *Server) handleWebSocketProxy(w http.ResponseWriter, r *http.Request, targetURL string) {
+	logger := s.requestLogger(r)
 	// Parse target URL
 	target, err := url.Parse(targetURL)
 	if err != nil {
-		s.logger.Error("Invalid target URL for WebSocket proxy:", err)
-		http.Error(w, "Invalid target URL", http.StatusInternalServerError)
+		logger.Error("Invalid target URL for WebSocket proxy:", err)
+		s.writeErrorPage(w, r, errorPage{Status: http.StatusInternalServerError, Class: errorClassInternal, Message: "The route of this service is misconfigured."})
 		return
 	}
 
@@ -93,9 +107,12 @@ func (s *Server) handleWebSocketProxy(w http.ResponseWriter, r *http.Request, ta
 		},
 	}
 
-	clientConn, err := upgrader.Upgrade(w, r, nil)
+	// The upgrader writes its own response, so the request ID is passed along
+	responseHeader := http.Header{}
+	responseHeader.Set(requestIDHeader, r.Header.Get(requestIDHeader))
+	clientConn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		s.logger.Error("Failed to upgrade client connection to WebSocket:", err)
+		logger.Error("Failed to upgrade client connection to WebSocket:", err)
 		return
 	}
 	defer func() { _ = clientConn.Close() }()
@@ -115,9 +132,11 @@ func (s *Server) handleWebSocketProxy(w http.ResponseWriter, r *http.Request, ta
 	}
 
 	// Connect to the target WebSocket server
+	dialStart := time.Now()
 	targetConn, _, err := websocket.DefaultDialer.Dial(wsURL, headers)
+	recordUpstream(r.Context(), target.Host, time.Since(dialStart))
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("Failed to connect to target WebSocket - url=%s error=%v", wsURL, err))
+		logger.Error(fmt.Sprintf("Failed to connect to target WebSocket - url=%s error=%v", wsURL, err))
 		_ = clientConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Failed to connect to target"))
 		return
 	}
@@ -168,17 +187,31 @@ func (s *Server) handleWebSocketProxy(w http.ResponseWriter, r *http.Request, ta
 func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
+	// Capture status and traffic of every request for the access log
+	rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	w = rw
+	r = s.withRequestID(w, r)
+	logger := s.requestLogger(r)
+	if s.accessLog != nil {
+		entry := newAccessLogEntry(r, startTime)
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingBody{ReadCloser: r.Body, n: &rw.bytesReceived}
+		}
+		defer s.writeAccessLog(entry, rw, r)
+	}
+
 	// Log all incoming requests
-	s.logger.Info(fmt.Sprintf("Incoming request - method=%s host=%s path=%s remote_addr=%s user_agent=%s content_length=%d websocket=%t",
+	logger.Info(fmt.Sprintf("Incoming request - method=%s host=%s path=%s remote_addr=%s user_agent=%s content_length=%d websocket=%t",
 		r.Method, r.Host, r.URL.Path, r.RemoteAddr, r.Header.Get("User-Agent"), r.ContentLength, isWebSocketRequest(r)))
 
 	// Check if this is the menu host OR if accessing via IP (no Host header or IP format)
 	if r.Host == s.cfg.Menu || isDirectIPAccess(r.Host) {
-		s.logger.Info(fmt.Sprintf("Routing to menu handler - host=%s is_menu_host=%t is_direct_ip=%t",
+		logger.Info(fmt.Sprintf("Routing to menu handler - host=%s is_menu_host=%t is_direct_ip=%t",
 			r.Host, r.Host == s.cfg.Menu, isDirectIPAccess(r.Host)))
 		s.serveMenu(w, r)
 		duration := time.Since(startTime)
-		s.logger.Info(fmt.Sprintf("Menu request completed - duration_ms=%d host=%s path=%s",
+		logger.Info(fmt.Sprintf("Menu request completed - duration_ms=%d host=%s path=%s",
 			duration.Milliseconds(), r.Host, r.URL.Path))
 		return
 	}
@@ -187,7 +220,7 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	if redirectURL, ok := s.redirectMap[r.Host]; ok {
 		s.handleRedirect(w, r, redirectURL)
 		duration := time.Since(startTime)
-		s.logger.Info(fmt.Sprintf("Redirect completed - duration_ms=%d host=%s path=%s",
+		logger.Info(fmt.Sprintf("Redirect completed - duration_ms=%d host=%s path=%s",
 			duration.Milliseconds(), r.Host, r.URL.Path))
 		return
 	}
@@ -195,11 +228,11 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	// Check for proxy routes
 	proxy, ok := s.proxyMap[r.Host]
 	if !ok {
-		s.logger.Info(fmt.Sprintf("No proxy route found, falling back to menu - host=%s available_routes=%d",
+		logger.Info(fmt.Sprintf("No proxy route found, falling back to menu - host=%s available_routes=%d",
 			r.Host, len(s.proxyMap)))
 		s.serveMenu(w, r)
 		duration := time.Since(startTime)
-		s.logger.Info(fmt.Sprintf("Fallback to menu completed - duration_ms=%d host=%s path=%s",
+		logger.Info(fmt.Sprintf("Fallback to menu completed - duration_ms=%d host=%s path=%s",
 			duration.Milliseconds(), r.Host, r.URL.Path))
 		return
 	}
@@ -215,10 +248,18 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 
 	// Safety check: if route is actually a redirect, handle it as redirect
 	if routeConfig != nil && routeConfig.IsRedirect() {
-		s.logger.Error(fmt.Sprintf("Route marked as proxy but is redirect - host=%s target=%s", r.Host, routeConfig.Target))
+		logger.Error(fmt.Sprintf("Route marked as proxy but is redirect - host=%s target=%s", r.Host, routeConfig.Target))
 		s.handleRedirect(w, r, routeConfig.GetRedirectURL())
 		duration := time.Since(startTime)
-		s.logger.Info(fmt.Sprintf("Redirect completed (fallback) - duration_ms=%d host=%s path=%s",
+		logger.Info(fmt.Sprintf("Redirect completed (fallback) - duration_ms=%d host=%s path=%s",
+			duration.Milliseconds(), r.Host, r.URL.Path))
+		return
+	}
+
+	// Routes in maintenance answer with a maintenance page unless bypassed
+	if s.handleMaintenance(w, r) {
+		duration := time.Since(startTime)
+		logger.Info(fmt.Sprintf("Maintenance request completed - duration_ms=%d host=%s path=%s",
 			duration.Milliseconds(), r.Host, r.URL.Path))
 		return
 	}
@@ -232,46 +273,120 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	if isWebSocketRequest(r) {
 		s.handleWebSocketProxy(w, r, targetURL)
 		duration := time.Since(startTime)
-		s.logger.Info(fmt.Sprintf("WebSocket proxy completed - duration_ms=%d host=%s path=%s",
+		logger.Info(fmt.Sprintf("WebSocket proxy completed - duration_ms=%d host=%s path=%s",
 			duration.Milliseconds(), r.Host, r.URL.Path))
 		return
 	}
 
-	s.logger.Info(fmt.Sprintf("Proxying HTTP request to upstream - method=%s source_host=%s target_url=%s path=%s remote_addr=%s query=%s",
+	logger.Info(fmt.Sprintf("Proxying HTTP request to upstream - method=%s source_host=%s target_url=%s path=%s remote_addr=%s query=%s",
 		r.Method, r.Host, targetURL, r.URL.Path, r.RemoteAddr, r.URL.RawQuery))
 
-	// Create a custom response writer to capture status code
-	wrappedWriter := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	// Compress responses the upstream sent uncompressed, if the route wants it
+	var compressor *compressWriter
+	if routeConfig != nil && routeConfig.Compression.Enabled {
+		compressor = newCompressWriter(w, r, routeConfig.Compression)
+	}
+	var downstream http.ResponseWriter = w
+	if compressor != nil {
+		downstream = compressor
+	}
 
-	proxy.ServeHTTP(wrappedWriter, r)
+	proxy.ServeHTTP(downstream, r)
+	if compressor != nil {
+		if err := compressor.close(); err != nil {
+			logger.Error(fmt.Sprintf("Error finishing compressed response - host=%s path=%s error=%v", r.Host, r.URL.Path, err))
+		}
+	}
 
 	duration := time.Since(startTime)
-	s.logger.Info(fmt.Sprintf("HTTP proxy request completed - method=%s source_host=%s target_url=%s path=%s status_code=%d duration_ms=%d remote_addr=%s",
-		r.Method, r.Host, targetURL, r.URL.Path, wrappedWriter.statusCode, duration.Milliseconds(), r.RemoteAddr))
+	logger.Info(fmt.Sprintf("HTTP proxy request completed - method=%s source_host=%s target_url=%s path=%s status_code=%d duration_ms=%d remote_addr=%s",
+		r.Method, r.Host, targetURL, r.URL.Path, rw.statusCode, duration.Milliseconds(), r.RemoteAddr))
+}
+
+// writeAccessLog completes entry with the response and appends it to the access log
+func (s *Server) writeAccessLog(entry *accessLogEntry, rw *responseWriter, r *http.Request) {
+	entry.Status = rw.statusCode
+	entry.BytesSent = rw.bytesSent.Load()
+	entry.BytesReceived = rw.bytesReceived.Load()
+	entry.DurationMs = milliseconds(time.Since(entry.Time))
+	entry.Cache = rw.Header().Get(cacheStatusHeader)
+	for _, route := range s.cfg.Routes {
+		if route.Host == r.Host {
+			entry.Route = route.Name
+			break
+		}
+	}
+	if err := s.accessLog.write(entry); err != nil {
+		s.requestLogger(r).Error(fmt.Sprintf("Failed to write access log - host=%s path=%s error=%v", r.Host, r.URL.Path, err))
+	}
+}
+
+// handleProxyError answers requests the upstreams of a route failed with an
+// error page. An open circuit fails fast with 503 and Retry-After instead of
+// waiting for timeouts.
+func (s *Server) handleProxyError(w http.ResponseWriter, r *http.Request, upstream *routeUpstream, err error) {
+	logger := s.requestLogger(r)
+	class, message := classifyUpstreamError(err)
+	page := errorPage{Status: http.StatusBadGateway, Service: upstream.name, Class: class, Message: message}
+	switch class {
+	case errorClassCircuitOpen:
+		page.Status = http.StatusServiceUnavailable
+		page.RetryAfter = int(math.Ceil(upstream.retryAfter(time.Now()).Seconds()))
+		logger.Error(fmt.Sprintf("Circuit open, failing fast - host=%s path=%s retry_after_s=%d",
+			r.Host, r.URL.Path, page.RetryAfter))
+	case errorClassTimeout:
+		page.Status = http.StatusGatewayTimeout
+	}
+	if class != errorClassCircuitOpen {
+		logger.Error(fmt.Sprintf("Upstream request failed - host=%s path=%s status_code=%d error_class=%s error=%v",
+			r.Host, r.URL.Path, page.Status, class, err))
+	}
+	s.writeErrorPage(w, r, page)
 }
 
 // handleRedirect handles HTTP redirects
 func (s *Server) handleRedirect(w http.ResponseWriter, r *http.Request, redirectURL string) {
+	logger := s.requestLogger(r)
 	// Construct the full redirect URL including path and query parameters
 	fullRedirectURL := redirectURL + r.URL.Path
 	if r.URL.RawQuery != "" {
 		fullRedirectURL += "?" + r.URL.RawQuery
 	}
 
-	s.logger.Info(fmt.Sprintf("Redirecting request - source_host=%s source_path=%s redirect_url=%s remote_addr=%s method=%s",
+	logger.Info(fmt.Sprintf("Redirecting request - source_host=%s source_path=%s redirect_url=%s remote_addr=%s method=%s",
 		r.Host, r.URL.Path, fullRedirectURL, r.RemoteAddr, r.Method))
 
 	// Send a 302 (Found) redirect
 	http.Redirect(w, r, fullRedirectURL, http.StatusFound)
 }
 
-// responseWriter wraps http.ResponseWriter to capture status code
+// responseWriter wraps http.ResponseWriter to capture status code and the
+// bytes sent and received
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode    int
+	wroteHeader   bool
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
+	// Informational responses like 103 Early Hints precede the final status
+	if code >= 200 && !rw.wroteHeader {
+		rw.statusCode = code
+		rw.wroteHeader = true
+	}
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytesSent.Add(int64(n))
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush streamed responses through the wrapper
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
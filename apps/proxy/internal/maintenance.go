@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// statusMaintenance is reported by /api/services for routes in maintenance
+const statusMaintenance = "maintenance"
+
+// maintenanceBypassCookie carries the bypass token of a route
+const maintenanceBypassCookie = "waguri_maintenance_bypass"
+
+// maintenanceBypassParam sets the bypass cookie when it matches the token
+const maintenanceBypassParam = "maintenance_bypass"
+
+// maintenanceState is the maintenance mode of a route, toggled at runtime
+// through /api/maintenance
+type maintenanceState struct {
+	Host    string     `json:"host"`
+	Name    string     `json:"name"`
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// maintenanceRoutes holds the maintenance state and bypass rules of proxy routes
+type maintenanceRoutes struct {
+	mu     sync.RWMutex
+	states map[string]maintenanceState
+	bypass map[string][]*net.IPNet
+	tokens map[string]string
+}
+
+func newMaintenanceRoutes(routes []RoutesConfig) *maintenanceRoutes {
+	m := &maintenanceRoutes{
+		states: make(map[string]maintenanceState),
+		bypass: make(map[string][]*net.IPNet),
+		tokens: make(map[string]string),
+	}
+	for _, route := range routes {
+		if route.IsRedirect() {
+			continue
+		}
+		state := maintenanceState{
+			Host:    route.Host,
+			Name:    route.Name,
+			Enabled: route.Maintenance.Enabled,
+			Message: route.Maintenance.Message,
+		}
+		if !route.Maintenance.Until.IsZero() {
+			until := route.Maintenance.Until
+			state.Until = &until
+		}
+		m.states[route.Host] = state
+		for _, ip := range route.Maintenance.BypassIPs {
+			m.bypass[route.Host] = append(m.bypass[route.Host], parseIPNet(ip))
+		}
+		m.tokens[route.Host] = route.Maintenance.BypassToken
+	}
+	return m
+}
+
+// state returns the maintenance state of the route for host
+func (m *maintenanceRoutes) state(host string) (maintenanceState, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state, ok := m.states[host]
+	return state, ok
+}
+
+// list returns the maintenance state of all proxy routes in config order
+func (m *maintenanceRoutes) list(routes []RoutesConfig) []maintenanceState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	states := []maintenanceState{}
+	for _, route := range routes {
+		if state, ok := m.states[route.Host]; ok {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// set replaces the maintenance mode of the route for host
+func (m *maintenanceRoutes) set(host string, enabled bool, message string, until *time.Time) (maintenanceState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[host]
+	if !ok {
+		return state, false
+	}
+	state.Enabled = enabled
+	state.Message = message
+	state.Until = until
+	m.states[host] = state
+	return state, true
+}
+
+// bypassed reports whether r may reach the upstream despite maintenance
+func (m *maintenanceRoutes) bypassed(r *http.Request) bool {
+	if containsIP(m.bypass[r.Host], remoteIP(r)) {
+		return true
+	}
+	token := m.tokens[r.Host]
+	if token == "" {
+		return false
+	}
+	cookie, err := r.Cookie(maintenanceBypassCookie)
+	return err == nil && cookie.Value == token
+}
+
+// handleMaintenance serves the maintenance page when the route of r is in
+// maintenance and r may not bypass it. It reports whether r was answered.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	logger := s.requestLogger(r)
+	state, ok := s.maintenance.state(r.Host)
+	if !ok || !state.Enabled {
+		return false
+	}
+
+	// Visiting with the bypass token stores it in a cookie and reloads without it
+	if token := r.URL.Query().Get(maintenanceBypassParam); token != "" && token == s.maintenance.tokens[r.Host] {
+		http.SetCookie(w, &http.Cookie{
+			Name:     maintenanceBypassCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		query := r.URL.Query()
+		query.Del(maintenanceBypassParam)
+		redirect := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		logger.Info(fmt.Sprintf("Maintenance bypass cookie set - host=%s remote_addr=%s", r.Host, r.RemoteAddr))
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+		return true
+	}
+	if s.maintenance.bypassed(r) {
+		logger.Info(fmt.Sprintf("Bypassing maintenance - host=%s remote_addr=%s", r.Host, r.RemoteAddr))
+		return false
+	}
+
+	page := errorPage{
+		Status:      http.StatusServiceUnavailable,
+		Service:     state.Name,
+		Class:       statusMaintenance,
+		Message:     state.Message,
+		Maintenance: true,
+	}
+	if page.Message == "" {
+		page.Message = "The service is being upgraded and will be back shortly."
+	}
+	if state.Until != nil {
+		page.Until = *state.Until
+		if wait := time.Until(*state.Until); wait > 0 {
+			page.RetryAfter = int(math.Ceil(wait.Seconds()))
+		}
+	}
+	logger.Info(fmt.Sprintf("Serving maintenance page - host=%s path=%s remote_addr=%s", r.Host, r.URL.Path, r.RemoteAddr))
+	s.writeErrorPage(w, r, page)
+	return true
+}
+
+// maintenanceRequest is the body of a POST to /api/maintenance
+type maintenanceRequest struct {
+	Host    string     `json:"host"`
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message"`
+	Until   *time.Time `json:"until"`
+}
+
+// serveMaintenanceAPI lists maintenance modes on GET and toggles the mode of a
+// route on POST. Toggles are kept until restart; the config sets the initial state.
+func (s *Server) serveMaintenanceAPI(w http.ResponseWriter, r *http.Request) {
+	logger := s.requestLogger(r)
+	logger.Info(fmt.Sprintf("Serving maintenance API request - method=%s host=%s path=%s remote_addr=%s",
+		r.Method, r.Host, r.URL.Path, r.RemoteAddr))
+
+	var body any
+	switch r.Method {
+	case http.MethodGet:
+		body = s.maintenance.list(s.cfg.Routes)
+	case http.MethodPost:
+		if !containsIP(s.adminNets, remoteIP(r)) {
+			logger.Error(fmt.Sprintf("Maintenance toggle refused - remote_addr=%s", r.RemoteAddr))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		state, ok := s.maintenance.set(req.Host, req.Enabled, req.Message, req.Until)
+		if !ok {
+			http.Error(w, "Unknown proxy route: "+req.Host, http.StatusNotFound)
+			return
+		}
+		logger.Info(fmt.Sprintf("Maintenance mode changed - host=%s enabled=%t message=%q remote_addr=%s",
+			state.Host, state.Enabled, state.Message, r.RemoteAddr))
+		body = state
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Error("Error encoding maintenance response:", err)
+	}
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+)
+
+// requestIDHeader correlates a request across the client, the proxy logs and
+// the upstream logs
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps IDs accepted from clients
+const maxRequestIDLength = 128
+
+// loggerKey carries the request's logger, tagged with its request ID, in the
+// request context
+type loggerKey struct{}
+
+// requestID returns the client's X-Request-ID when it is usable, otherwise a
+// new random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID accepts printable ASCII without spaces, so IDs cannot break
+// log lines or headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID tags r with its request ID: the header forwarded upstream,
+// the response header and the logger of the request
+func (s *Server) withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := requestID(r)
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	logger := s.logger.With("request_id=" + id)
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+}
+
+// loggerFrom returns the request logger in ctx, or fallback outside requests
+func loggerFrom(ctx context.Context, fallback *telemetry.Logger) *telemetry.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*telemetry.Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+// requestLogger returns the logger of r, which adds its request ID to every entry
+func (s *Server) requestLogger(r *http.Request) *telemetry.Logger {
+	return loggerFrom(r.Context(), s.logger)
+}
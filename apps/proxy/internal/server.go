@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -12,6 +13,15 @@ type Server struct {
 	logger      *telemetry.Logger
 	proxyMap    map[string]*httputil.ReverseProxy
 	redirectMap map[string]string
+	// Upstreams of proxy routes with their circuit breakers, by host
+	upstreams   map[string]*routeUpstream
+	maintenance *maintenanceRoutes
+	// Response cache of routes with caching enabled, nil when none has it
+	cache *responseStore
+	// Access log sink, nil when disabled
+	accessLog *accessLog
+	// Clients allowed to use the admin API
+	adminNets []*net.IPNet
 }
 
 func NewServer(cfg *ProxyConfig, logger *telemetry.Logger) *Server {
@@ -20,6 +30,32 @@ func NewServer(cfg *ProxyConfig, logger *telemetry.Logger) *Server {
 		logger:      logger,
 		proxyMap:    make(map[string]*httputil.ReverseProxy),
 		redirectMap: make(map[string]string),
+		upstreams:   make(map[string]*routeUpstream),
+		maintenance: newMaintenanceRoutes(cfg.Routes),
+	}
+
+	for _, ip := range cfg.AdminClients {
+		s.adminNets = append(s.adminNets, parseIPNet(ip))
+	}
+
+	if cfg.AccessLog.Output != "" {
+		accessLog, err := newAccessLog(cfg.AccessLog)
+		if err != nil {
+			logger.Error("Access log disabled:", err)
+		} else {
+			s.accessLog = accessLog
+		}
+	}
+
+	for _, route := range cfg.Routes {
+		if route.Cache.Enabled && !route.IsRedirect() {
+			cache, err := newResponseStore(cfg.Cache, logger)
+			if err != nil {
+				logger.Error("Response cache disabled:", err)
+			}
+			s.cache = cache
+			break
+		}
 	}
 
 	for _, route := range cfg.Routes {
@@ -35,9 +71,32 @@ func NewServer(cfg *ProxyConfig, logger *telemetry.Logger) *Server {
 				logger.Error("Skipping invalid target URL for host", route.Host, ":", err)
 				continue
 			}
+			upstream, err := newRouteUpstream(route, logger)
+			if err != nil {
+				logger.Error("Skipping invalid fallback URL for host", route.Host, ":", err)
+				continue
+			}
 			proxy := httputil.NewSingleHostReverseProxy(targetURL)
+			proxy.Transport = upstream
+			if route.Cache.Enabled && s.cache != nil {
+				proxy.Transport = &cachingTransport{
+					next:      upstream,
+					store:     s.cache,
+					maxObject: int64(cfg.Cache.MaxObjectSizeMB) << 20,
+				}
+			}
+			proxy.ModifyResponse = func(resp *http.Response) error {
+				// The client gets the request ID set by the proxy, not an
+				// upstream's or one stored in the cache
+				resp.Header.Del(requestIDHeader)
+				return nil
+			}
+			proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+				s.handleProxyError(w, r, upstream, err)
+			}
 			s.proxyMap[route.Host] = proxy
-			logger.Info("Registered proxy route:", route.Host, "->", targetURL.String())
+			s.upstreams[route.Host] = upstream
+			logger.Info("Registered proxy route:", route.Host, "->", targetURL.String(), "fallbacks:", route.Fallbacks)
 		}
 	}
 
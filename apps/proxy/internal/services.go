@@ -22,12 +22,20 @@ func (s *Server) generateServicesData() []ServiceInfo {
 			continue
 		}
 
+		status := statusActive
+		if upstream, ok := s.upstreams[route.Host]; ok {
+			status = upstream.status()
+		}
+		if state, ok := s.maintenance.state(route.Host); ok && state.Enabled {
+			status = statusMaintenance
+		}
+
 		service := ServiceInfo{
 			Name:        route.Name,
 			Description: route.Description,
 			URL:         "http://" + route.Host,
 			Icon:        route.Icon,
-			Status:      "active",
+			Status:      status,
 			Category:    route.Category,
 		}
 		services = append(services, service)
@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"waguri-centralized-control/packages/go-utils/telemetry"
+)
+
+// errCircuitOpen is returned when the circuits of all upstreams of a route are open
+var errCircuitOpen = errors.New("circuit open")
+
+// Service statuses reported by /api/services
+const (
+	statusActive = "active"
+	// statusDegraded means some upstreams of the route are failing
+	statusDegraded = "degraded"
+	// statusRecovering means a trial request is probing a failed upstream
+	statusRecovering  = "recovering"
+	statusUnavailable = "unavailable"
+)
+
+// Circuit breaker states
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker opens after consecutive failures and lets a single trial
+// request through once the cooldown has passed (half-open). Success of the
+// trial closes it again, failure reopens it.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	state       int
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+}
+
+// allow reports whether a request may be sent
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// success records a healthy response and reports whether the circuit closed
+func (b *circuitBreaker) success() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	recovered := b.state != circuitClosed
+	b.state = circuitClosed
+	b.consecutive = 0
+	b.probing = false
+	return recovered
+}
+
+// failure records a failed request and reports whether the circuit opened
+func (b *circuitBreaker) failure(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutive++
+	b.probing = false
+	if b.state == circuitOpen || (b.state == circuitClosed && b.consecutive < b.failures) {
+		return false
+	}
+	b.state = circuitOpen
+	b.openedAt = now
+	return true
+}
+
+// abort forgets a request that ended without a verdict, e.g. when the client left
+func (b *circuitBreaker) abort() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// snapshot returns the state at now and when a trial request will be allowed.
+// An open circuit past its cooldown is reported half-open.
+func (b *circuitBreaker) snapshot(now time.Time) (int, time.Time) {
+	if b == nil {
+		return circuitClosed, time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	next := b.openedAt.Add(b.cooldown)
+	if b.state == circuitOpen && !now.Before(next) {
+		return circuitHalfOpen, next
+	}
+	return b.state, next
+}
+
+// upstreamTarget is one upstream of a route
+type upstreamTarget struct {
+	url     *url.URL
+	breaker *circuitBreaker
+}
+
+// routeUpstream is the http.RoundTripper of a proxied route. It applies the
+// route's timeouts, skips upstreams with an open circuit and retries failed
+// connections against the next upstream.
+type routeUpstream struct {
+	name      string
+	host      string
+	targets   []*upstreamTarget
+	retries   int
+	transport *http.Transport
+	logger    *telemetry.Logger
+}
+
+func newRouteUpstream(route RoutesConfig, logger *telemetry.Logger) (*routeUpstream, error) {
+	u := &routeUpstream{
+		name:    route.Name,
+		host:    route.Host,
+		retries: *route.Retries,
+		logger:  logger,
+		transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   route.Timeouts.Dial,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       route.Timeouts.Idle,
+			TLSHandshakeTimeout:   route.Timeouts.TLSHandshake,
+			ResponseHeaderTimeout: route.Timeouts.ResponseHeader,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+
+	for _, raw := range append([]string{route.Target}, route.Fallbacks...) {
+		target, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		t := &upstreamTarget{url: target}
+		if !route.CircuitBreaker.Disabled {
+			t.breaker = &circuitBreaker{failures: route.CircuitBreaker.Failures, cooldown: route.CircuitBreaker.Cooldown}
+		}
+		u.targets = append(u.targets, t)
+	}
+	return u, nil
+}
+
+// RoundTrip sends req to the first upstream whose circuit allows it. The
+// request arrives rewritten for the route's target; fallbacks get the same
+// path on their own scheme and host.
+func (u *routeUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	logger := loggerFrom(req.Context(), u.logger)
+	retryable := isIdempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody)
+	attempts := 0
+	var lastErr error
+	start := time.Now()
+
+	for i, target := range u.targets {
+		if !target.breaker.allow(time.Now()) {
+			continue
+		}
+		outReq := req
+		if i > 0 {
+			outReq = req.Clone(req.Context())
+			outReq.URL.Scheme = target.url.Scheme
+			outReq.URL.Host = target.url.Host
+		}
+
+		resp, err := u.transport.RoundTrip(outReq)
+		recordUpstream(req.Context(), target.url.Host, time.Since(start))
+		if req.Context().Err() != nil {
+			// The client went away, which says nothing about the upstream
+			target.breaker.abort()
+			return resp, err
+		}
+		if err == nil && !isUpstreamFailure(resp.StatusCode) {
+			if target.breaker.success() {
+				logger.Info(fmt.Sprintf("Circuit closed, upstream recovered - host=%s target=%s", u.host, target.url.Host))
+			}
+			return resp, nil
+		}
+
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+		}
+		if target.breaker.failure(time.Now()) {
+			logger.Error(fmt.Sprintf("Circuit opened for upstream - host=%s target=%s reason=%s",
+				u.host, target.url.Host, reason))
+		}
+		if err == nil {
+			// The upstream answered, pass its error response on
+			return resp, nil
+		}
+
+		lastErr = err
+		attempts++
+		if !retryable || !isConnectError(err) || attempts > u.retries || i == len(u.targets)-1 {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Retrying upstream request - host=%s method=%s path=%s failed_target=%s error=%v",
+			u.host, req.Method, req.URL.Path, target.url.Host, err))
+	}
+
+	if lastErr == nil {
+		return nil, errCircuitOpen
+	}
+	return nil, lastErr
+}
+
+// status summarizes the circuits of the route's upstreams for /api/services
+func (u *routeUpstream) status() string {
+	closed, halfOpen := 0, 0
+	now := time.Now()
+	for _, target := range u.targets {
+		switch state, _ := target.breaker.snapshot(now); state {
+		case circuitClosed:
+			closed++
+		case circuitHalfOpen:
+			halfOpen++
+		}
+	}
+	switch {
+	case closed == len(u.targets):
+		return statusActive
+	case closed > 0:
+		return statusDegraded
+	case halfOpen > 0:
+		return statusRecovering
+	}
+	return statusUnavailable
+}
+
+// retryAfter returns how long until the next upstream accepts a trial request
+func (u *routeUpstream) retryAfter(now time.Time) time.Duration {
+	var wait time.Duration
+	for i, target := range u.targets {
+		_, next := target.breaker.snapshot(now)
+		if d := next.Sub(now); i == 0 || d < wait {
+			wait = d
+		}
+	}
+	return max(wait, time.Second)
+}
+
+// isIdempotent reports whether a request with this method may be sent twice (RFC 9110 9.2.2)
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isConnectError reports whether err happened before the request reached the upstream
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isUpstreamFailure reports whether a response status means the upstream is unhealthy
+func isUpstreamFailure(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
@@ -1,5 +1,10 @@
 package internal
 
+import (
+	"net"
+	"net/http"
+)
+
 // minInt returns the minimum of two integers
 func minInt(a, b int) int {
 	if a < b {
@@ -63,3 +68,38 @@ func isIPAddress(s string) bool {
 	// Basic IPv4 format check (should have 3 dots and some digits)
 	return dotCount == 3 && digitCount > 0
 }
+
+// parseIPNet parses an IP address or CIDR; a single address becomes a host network
+func parseIPNet(s string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// remoteIP returns the address of the client that sent r
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// containsIP reports whether ip is in one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -25,16 +25,7 @@ type Telemetry struct {
 
 // Load loads a YAML configuration file into any struct
 func Load(pathOrURL string, target interface{}) error {
-	var data []byte
-	var err error
-
-	// Check if it's a URL (starts with http:// or https://)
-	if strings.HasPrefix(pathOrURL, "http://") || strings.HasPrefix(pathOrURL, "https://") {
-		data, err = loadFromURL(pathOrURL)
-	} else {
-		data, err = loadFromFile(pathOrURL)
-	}
-
+	data, err := ReadSource(pathOrURL)
 	if err != nil {
 		return fmt.Errorf("failed to load config from %s: %w", pathOrURL, err)
 	}
@@ -46,6 +37,15 @@ func Load(pathOrURL string, target interface{}) error {
 	return nil
 }
 
+// ReadSource reads raw bytes from a local file or an http(s) URL
+func ReadSource(pathOrURL string) ([]byte, error) {
+	// Check if it's a URL (starts with http:// or https://)
+	if strings.HasPrefix(pathOrURL, "http://") || strings.HasPrefix(pathOrURL, "https://") {
+		return loadFromURL(pathOrURL)
+	}
+	return loadFromFile(pathOrURL)
+}
+
 // loadFromFile loads configuration from a local file
 func loadFromFile(path string) ([]byte, error) {
 	return os.ReadFile(path)
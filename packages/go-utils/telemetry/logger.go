@@ -10,6 +10,8 @@ import (
 type Logger struct {
 	output string
 	logger *log.Logger
+	// fields are appended to every message, see With
+	fields string
 }
 
 func NewLogger(output string, header string) *Logger {
@@ -38,11 +40,24 @@ func NewLogger(output string, header string) *Logger {
 	return &Logger{output: output, logger: l}
 }
 
+// With returns a logger writing to the same output that appends the given
+// fields to every message, e.g. logger.With("request_id=abc")
+func (l *Logger) With(fields ...string) *Logger {
+	child := *l
+	child.fields = strings.TrimSpace(l.fields + " " + strings.Join(fields, " "))
+	return &child
+}
+
 func (l *Logger) Info(v ...any) {
 	message := l.formatMessage(v...)
 	l.logger.Println("[INFO]", message)
 }
 
+func (l *Logger) Warn(v ...any) {
+	message := l.formatMessage(v...)
+	l.logger.Println("[WARN]", message)
+}
+
 func (l *Logger) Error(v ...any) {
 	message := l.formatMessage(v...)
 	l.logger.Println("[ERROR]", message)
@@ -51,12 +66,15 @@ func (l *Logger) Error(v ...any) {
 // formatMessage formats multiple arguments with spaces between them, similar to Python's print
 func (l *Logger) formatMessage(v ...any) string {
 	if len(v) == 0 {
-		return ""
+		return l.fields
 	}
 
 	parts := make([]string, len(v))
 	for i, arg := range v {
 		parts[i] = fmt.Sprintf("%v", arg)
 	}
+	if l.fields != "" {
+		parts = append(parts, l.fields)
+	}
 	return strings.Join(parts, " ")
 }